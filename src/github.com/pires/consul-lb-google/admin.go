@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pires/consul-lb-google/metrics"
+	"github.com/pires/consul-lb-google/notifier"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// ErrNotLeader when a cloud-changing action is attempted by a follower
+	ErrNotLeader = errors.New("Not the leader")
+	// ErrRegistryUnhealthy when an action relying on the registry is attempted while it's failing
+	ErrRegistryUnhealthy = errors.New("Registry is unhealthy")
+)
+
+// adminServer serves a JSON API for inspecting and controlling managed services.
+// Mutating endpoints require the configured bearer token, and are disabled without one.
+//
+//	GET  /services                  list services and their state
+//	GET  /services/<name>           show a service's state
+//	POST /services/<name>/resync    apply a service's latest desired state again
+//	POST /services/<name>/pause     stop touching a service's cloud resources
+//	POST /services/<name>/resume    start touching a service's cloud resources again
+//	POST /services/<name>/override  allow a service's action blocked by the safety guard
+//	POST /gc[?dry_run=true]         remove instance groups and load-balancers of unknown services,
+//	                                listing unmarked ones, e.g. created by older versions, for operators to remove.
+//	                                refused until startup adoption has finished
+//	GET  /metrics                   Prometheus metrics
+//	GET  /healthz/live              whether the main loop and registry are making progress
+//	GET  /healthz/ready             whether the registry and cloud work, and startup adoption has finished,
+//	                                along with whether this replica is the leader and since when
+type adminServer struct {
+	token  string
+	health *healthChecker
+}
+
+func newAdminServer(token string, health *healthChecker) *adminServer {
+	return &adminServer{
+		token:  token,
+		health: health,
+	}
+}
+
+// ListenAndServe serves the admin API on address until it fails
+func (a *adminServer) ListenAndServe(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services", a.handleServices)
+	mux.HandleFunc("/services/", a.handleService)
+	mux.HandleFunc("/gc", a.authorized(a.handleGC))
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz/live", func(w http.ResponseWriter, r *http.Request) {
+		writeChecks(w, a.health.live(), nil)
+	})
+	mux.HandleFunc("/healthz/ready", func(w http.ResponseWriter, r *http.Request) {
+		writeChecks(w, a.health.ready(), leadership())
+	})
+	return http.ListenAndServe(address, mux)
+}
+
+func (a *adminServer) handleServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, states.list())
+}
+
+func (a *adminServer) handleService(w http.ResponseWriter, r *http.Request) {
+	// e.g. "/services/web/resync"
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/services/"), "/")
+	name := parts[0]
+	if name == "" || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		state, ok := states.get(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, "Unknown service")
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+		return
+	}
+
+	var action func(string) bool
+	switch parts[1] {
+	case "resync":
+		action = states.resync
+	case "pause":
+		action = states.pause
+	case "resume":
+		action = states.resume
+	case "override":
+		action = func(name string) bool {
+			return guard.override(name) && states.resync(name)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	a.authorized(func(w http.ResponseWriter, r *http.Request) {
+		if !action(name) {
+			writeError(w, http.StatusNotFound, "Unknown service or nothing to "+parts[1])
+			return
+		}
+		glog.Infof("Admin API: %s service [%s].", parts[1], name)
+		state, _ := states.get(name)
+		writeJSON(w, http.StatusAccepted, state)
+	})(w, r)
+}
+
+func (a *adminServer) handleGC(w http.ResponseWriter, r *http.Request) {
+	// services not yet listed, or adopted, would look like garbage
+	if err := a.health.adopted(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	removed, skipped, err := collectGarbage(dryRun)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	out := map[string]interface{}{
+		"dry_run": dryRun,
+		"removed": removed,
+		"skipped": skipped,
+	}
+	if len(skipped) > 0 {
+		out["note"] = "Skipped instance groups aren't marked as created by this manager, e.g. created by older versions, so they must be removed by hand."
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// authorized only lets POST requests bearing the configured token through
+func (a *adminServer) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		if a.token == "" {
+			writeError(w, http.StatusForbidden, "Mutating endpoints are disabled, no token configured")
+			return
+		}
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			writeError(w, http.StatusUnauthorized, "Missing bearer token")
+			return
+		}
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// collectGarbage removes instance groups, and related load-balancers, created by this manager
+// for services it no longer knows about. It returns the services whose resources were removed,
+// along with unknown services whose instance groups aren't marked as created by this manager, so they're left alone.
+func collectGarbage(dryRun bool) ([]string, []string, error) {
+	if !isLeader() {
+		return nil, nil, ErrNotLeader
+	}
+	// services missing from a failing registry would look like garbage
+	if guard.frozen() {
+		return nil, nil, ErrRegistryUnhealthy
+	}
+
+	groupNames, unmarked, err := client.ListInstanceGroups()
+	if err != nil {
+		return nil, nil, err
+	}
+	skipped := []string{}
+	for _, groupName := range unmarked {
+		if !states.isManaged(groupName) {
+			skipped = append(skipped, groupName)
+		}
+	}
+	removed := []string{}
+	for _, groupName := range groupNames {
+		if states.isManaged(groupName) {
+			continue
+		}
+		removed = append(removed, groupName)
+		if dryRun {
+			continue
+		}
+		glog.Warningf("Collecting garbage for unknown service [%s]..", groupName)
+		if err := client.RemoveLoadBalancer(groupName); err != nil {
+			glog.Errorf("There was an error while removing load-balancer for unknown service [%s]. %s", groupName, err)
+			return removed, skipped, err
+		}
+		if err := client.RemoveInstanceGroup(groupName); err != nil {
+			glog.Errorf("There was an error while removing instance group for unknown service [%s]. %s", groupName, err)
+			return removed, skipped, err
+		}
+		forgetRecord(groupName)
+		notify(notifier.LoadBalancerRemoved, groupName, fmt.Sprintf("Removed load-balancer for unknown service [%s] by garbage collection.", groupName))
+	}
+	return removed, skipped, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("There was an error while writing admin API response. %s", err)
+	}
+}
+
+// writeChecks writes the result of health checks, failing if any check failed, along with any extra fields
+func writeChecks(w http.ResponseWriter, checks map[string]error, extra map[string]interface{}) {
+	code := http.StatusOK
+	status := "ok"
+	results := make(map[string]string, len(checks))
+	for name, err := range checks {
+		if err != nil {
+			code = http.StatusServiceUnavailable
+			status = "failing"
+			results[name] = err.Error()
+		} else {
+			results[name] = "ok"
+		}
+	}
+	out := map[string]interface{}{
+		"status": status,
+		"checks": results,
+	}
+	for k, v := range extra {
+		out[k] = v
+	}
+	writeJSON(w, code, out)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
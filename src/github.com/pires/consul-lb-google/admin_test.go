@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+// fakeRegistry is a registry that never sends updates
+type fakeRegistry struct {
+	listed bool
+}
+
+func (r *fakeRegistry) Run(upstream chan<- *registry.ServiceUpdate, done <-chan struct{}) {}
+func (r *fakeRegistry) Healthy() bool                                                     { return true }
+func (r *fakeRegistry) LastProgress() time.Time                                           { return time.Now() }
+func (r *fakeRegistry) Listed() bool                                                      { return r.listed }
+
+func TestAuthorized(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		method        string
+		authorization string
+		code          int
+	}{
+		{"bearer token", "secret", "POST", "Bearer secret", http.StatusOK},
+		{"bare token", "secret", "POST", "secret", http.StatusUnauthorized},
+		{"wrong token", "secret", "POST", "Bearer other", http.StatusUnauthorized},
+		{"token prefix", "secret", "POST", "Bearer secre", http.StatusUnauthorized},
+		{"lowercase scheme", "secret", "POST", "bearer secret", http.StatusUnauthorized},
+		{"missing", "secret", "POST", "", http.StatusUnauthorized},
+		{"no token configured", "", "POST", "Bearer ", http.StatusForbidden},
+		{"not POST", "secret", "GET", "Bearer secret", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newAdminServer(test.token, nil)
+			handler := a.authorized(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			r := httptest.NewRequest(test.method, "/gc", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.code {
+				t.Fatalf("expected %d, got %d", test.code, w.Code)
+			}
+		})
+	}
+}
+
+func TestGCBeforeAdoption(t *testing.T) {
+	defer func(previous *serviceStates) { states = previous }(states)
+
+	tests := []struct {
+		name string
+		// whether the registry has sent its first full listing
+		listed bool
+		// whether the main loop has handled it
+		checked bool
+		// services whose handlers haven't gone through their first updates
+		pending []string
+	}{
+		{"registry hasn't listed yet", false, true, nil},
+		{"listing not handled yet", true, false, nil},
+		{"handlers not adopted yet", true, true, []string{"web"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			states = newServiceStates()
+			for _, name := range test.pending {
+				states.register(name, newMailbox(name))
+			}
+			health := newHealthChecker(&fakeRegistry{listed: test.listed}, time.Minute)
+			if test.checked {
+				health.checkListed()
+			}
+			a := newAdminServer("secret", health)
+			w := httptest.NewRecorder()
+			a.handleGC(w, httptest.NewRequest("POST", "/gc", nil))
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("expected %d, got %d: %s", http.StatusServiceUnavailable, w.Code, w.Body)
+			}
+		})
+	}
+
+	// listing handled and every handler adopted
+	states = newServiceStates()
+	health := newHealthChecker(&fakeRegistry{listed: true}, time.Minute)
+	health.checkListed()
+	if err := health.adopted(); err != nil {
+		t.Fatalf("expected adoption to have finished, got %v", err)
+	}
+}
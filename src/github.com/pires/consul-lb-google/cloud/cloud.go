@@ -2,10 +2,15 @@ package cloud
 
 import (
 	"errors"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/golang/glog"
 	"github.com/pires/consul-lb-google/cloud/gce"
+	compute "google.golang.org/api/compute/v1"
 )
 
 var (
@@ -23,8 +28,8 @@ type Cloud interface {
 	// RemoveInstanceGroup removes an instance group
 	RemoveInstanceGroup(groupName string) error
 
-	// AddInstancesToInstanceGroup adds a sert of instances to an instance group
-	AddInstancesToInstanceGroup(instanceNames []string, groupName string) error
+	// AddInstancesToInstanceGroup adds a sert of instances, discovered in a datacenter, to an instance group
+	AddInstancesToInstanceGroup(instanceNames []string, groupName string, datacenter string) error
 
 	// RemoveInstancesFromInstanceGroup removes a set of instances from an instance group
 	RemoveInstancesFromInstanceGroup(instanceNames []string, groupName string) error
@@ -33,73 +38,443 @@ type Cloud interface {
 	SetPortForInstanceGroup(port int64, groupName string) error
 
 	// CreateOrUpdateLoadBalancer creates a new or updates existing load-balancer related to an instance group
-	CreateOrUpdateLoadBalancer(groupName string, port string) error
+	CreateOrUpdateLoadBalancer(groupName string, port string, config *LoadBalancerConfig) error
+
+	// UpdateLoadBalancerConfig applies settings to an existing load-balancer related to an instance group
+	UpdateLoadBalancerConfig(groupName string, port string, config *LoadBalancerConfig) error
 
 	// RemoveLoadBalancer removes an existing load-balancer related to an instance group
 	RemoveLoadBalancer(groupName string) error
+
+	// GetLoadBalancerStatus returns the status of an existing load-balancer related to an instance group
+	GetLoadBalancerStatus(groupName string) (*LoadBalancerStatus, error)
+
+	// Reconcile reads the actual state of an instance group and related load-balancer, and fixes any drift from the desired state
+	Reconcile(groupName string, desired *DesiredState) error
+
+	// GetResourceNames returns the names of cloud resources related to an instance group, keyed by kind
+	GetResourceNames(groupName string) map[string]string
+
+	// ListInstanceGroups returns the names of all instance groups created by this manager,
+	// along with those named like them but not marked as created by it, e.g. by older versions
+	ListInstanceGroups() (managed []string, unmarked []string, err error)
+
+	// RestoreInstanceGroup remembers an existing instance group, e.g. created before a restart, in the specified zones
+	RestoreInstanceGroup(groupName string, zones []string)
+
+	// Ping checks the cloud accepts our credentials, with a cheap call
+	Ping() error
+
+	// ListInstanceAddresses returns the names of all instances in the network, keyed by IP address
+	ListInstanceAddresses() (map[string]string, error)
+
+	// GetInstanceGroup returns what's known about an instance group, as of the last changes or reconcile
+	GetInstanceGroup(groupName string) (*InstanceGroup, bool)
+
+	// SetInstanceZone remembers the zone an instance lives in, e.g. as told by the registry,
+	// so it's only looked up in that zone
+	SetInstanceZone(instanceName string, zone string)
+}
+
+// DesiredState represents what an instance group and related load-balancer should look like
+type DesiredState struct {
+	// instance names per datacenter, e.g. Instances["dc1"] == []string{"my-instance"}
+	Instances map[string][]string
+	// instance port, empty if not known yet in which case there's no load-balancer
+	Port string
+	// load-balancer settings
+	Config *LoadBalancerConfig
+}
+
+// LoadBalancerConfig represents settings applied to a load-balancer.
+// Zero values mean defaults.
+type LoadBalancerConfig struct {
+	// path requested by the HTTP health-check, defaults to "/"
+	HealthCheckPath string
+	// backend service timeout, defaults to 10 seconds
+	TimeoutSec int64
+	// names of existing SSL certificates, if any an HTTPS frontend is created
+	Certificates []string
+	// HTTP frontend ports, defaults to "80"
+	FrontendPorts []string
+	// firewall rule settings, overriding the global ones
+	Firewall *FirewallConfig
+}
+
+// FirewallConfig represents settings applied to a load-balancer's firewall rule.
+// Zero values mean defaults.
+type FirewallConfig struct {
+	// source ranges allowed in, defaults to Google's load-balancer and health-check ranges
+	SourceRanges []string
+	// network tags of instances the rule applies to, defaults to every instance in the network
+	TargetTags []string
+	// service accounts of instances the rule applies to, instead of network tags
+	TargetServiceAccounts []string
+	// rule priority, defaults to 1000
+	Priority int64
+	// whether connections are logged, defaults to false
+	Logging *bool
+}
+
+// LoadBalancerStatus represents the observed status of a load-balancer
+type LoadBalancerStatus struct {
+	// public IP address, shared by all frontends
+	IPAddress string
+	// port range of the first frontend, e.g. "80-80"
+	PortRange string
+	// all frontends, HTTP ones first, ordered by port
+	Frontends []*Frontend
+	// health state per instance, e.g. Health["my-instance"] == "HEALTHY"
+	Health map[string]string
+}
+
+// Frontend represents a load-balancer frontend, i.e. a global forwarding rule
+type Frontend struct {
+	IPAddress string
+	// e.g. "443-443"
+	PortRange string
+	// "HTTP" or "HTTPS"
+	Protocol string
+}
+
+// InstanceGroup represents what's known about an instance group, i.e. its zonal instance groups
+type InstanceGroup struct {
+	// zonal instance groups, keyed by zone
+	Zones map[string]*ZoneInstanceGroup
+	// instance port, zero if not known yet
+	Port int64
+}
+
+// ZoneInstanceGroup represents an instance group in one zone
+type ZoneInstanceGroup struct {
+	Name string
+	// empty until known
+	SelfLink string
+	// instances in the instance group, mapped to their self-links
+	Instances map[string]string
+	// named ports, keyed by name
+	NamedPorts map[string]int64
 }
 
 type instanceGroup struct {
 	// name of the instance group
 	name string
-	// map of instances in the instance group
+	// self-link of the instance group, empty until known
+	selfLink string
+	// map of instances in the instance group, to their self-links
 	instances map[string]string
+	// named ports of the instance group, keyed by name
+	namedPorts map[string]int64
+}
+
+func newInstanceGroup(name string) *instanceGroup {
+	return &instanceGroup{
+		name:       name,
+		instances:  make(map[string]string),
+		namedPorts: make(map[string]int64),
+	}
 }
 
 type gceCloud struct {
+	// guards zones, datacenterZones, instanceGroups, ports and instanceZones, as service handlers share the cloud.
+	// it's never held while calling GCE.
+	sync.RWMutex
+
 	// GCE client
 	client *gce.GCEClient
 
 	// zones available to this project
 	zones []string
 
+	// zones available to each datacenter
+	// e.g. zones := datacenterZones["dc1"]
+	datacenterZones map[string][]string
+
 	// one instance group identifier represents n instance groups, one per available zone
 	// e.g. groups := instanceGroups["myIG"]["europe-west1-d"]
 	instanceGroups map[string]map[string]*instanceGroup
+
+	// instance port of each instance group, set on zonal instance groups as they're created
+	ports map[string]int64
+
+	// zones instances are known to live in, keyed by instance name
+	instanceZones map[string]string
+
+	// firewall rule settings for every load-balancer, unless overridden per service
+	firewall *FirewallConfig
+
+	// whether to create instance groups in zones that aren't allowed but instances live in
+	createUnlistedZones bool
 }
 
-func New(projectID string, network string, allowedZones []string) (Cloud, error) {
+// Config represents a cloud's configuration
+type Config struct {
+	Project string
+	Network string
+	// zones instance groups are created in
+	AllowedZones []string
+	// regions whose zones are allowed, besides AllowedZones, e.g. "us-east1"
+	AllowedRegions []string
+	// pattern zone names are allowed by, besides AllowedZones, e.g. "europe-west1-*"
+	AllowedZoneGlob string
+	// zones each datacenter's instances live in. Zones mapped to a datacenter are allowed,
+	// even if not present in AllowedZones.
+	DatacenterZones map[string][]string
+	// whether to create instance groups in zones that aren't allowed but instances live in,
+	// instead of ignoring those instances
+	CreateUnlistedZones bool
+	// where load-balancer provisioning is journaled, in memory if nil
+	Journal gce.Journal
+	// firewall rule settings for every load-balancer, unless overridden per service
+	Firewall *FirewallConfig
+	// whether to manage firewall rules, instead of leaving them to operators
+	ManageFirewalls bool
+}
+
+// New returns a GCE-backed cloud
+func New(config *Config) (Cloud, error) {
+	journal := config.Journal
+	if journal == nil {
+		journal = gce.NewMemoryJournal()
+	}
+
 	// try and provision GCE client
-	c, err := gce.CreateGCECloud(projectID, network)
+	c, err := gce.CreateGCECloud(config.Project, config.Network, journal, config.ManageFirewalls)
 	if err != nil {
 		return nil, err
 	}
 
+	// instance groups are created in any allowed zone instances live in
+	zones := append([]string{}, config.AllowedZones...)
+	for _, dcZones := range config.DatacenterZones {
+		for _, zone := range dcZones {
+			if !contains(zones, zone) {
+				zones = append(zones, zone)
+			}
+		}
+	}
+	if len(config.AllowedRegions) > 0 || config.AllowedZoneGlob != "" {
+		discovered, err := discoverZones(c, config.AllowedRegions, config.AllowedZoneGlob)
+		if err != nil {
+			return nil, err
+		}
+		glog.Infof("Discovered zones %#v [Regions: %#v, Zone Glob: %s].", discovered, config.AllowedRegions, config.AllowedZoneGlob)
+		for _, zone := range discovered {
+			if !contains(zones, zone) {
+				zones = append(zones, zone)
+			}
+		}
+	}
+
+	datacenterZones := make(map[string][]string, len(config.DatacenterZones))
+	for dc, dcZones := range config.DatacenterZones {
+		datacenterZones[dc] = append([]string{}, dcZones...)
+	}
+
 	return &gceCloud{
-		client:         c,
-		zones:          allowedZones,
-		instanceGroups: make(map[string]map[string]*instanceGroup),
+		client:              c,
+		zones:               zones,
+		datacenterZones:     datacenterZones,
+		instanceGroups:      make(map[string]map[string]*instanceGroup),
+		ports:               make(map[string]int64),
+		instanceZones:       make(map[string]string),
+		firewall:            config.Firewall,
+		createUnlistedZones: config.CreateUnlistedZones,
 	}, nil
 }
 
-func (c *gceCloud) CreateInstanceGroup(groupName string) error {
-	// create one instance-group per zone
-	cleanup := false
-	glog.Infof("Creating instance groups for [%s]..", groupName)
-	for _, zone := range c.zones {
-		finalGroupName := zonify(zone, groupName)
-		glog.Infof("Creating instance group [%s] in zone [%s].", finalGroupName, zone)
-		if err := c.client.CreateInstanceGroupForZone(finalGroupName, zone /*TODO define ports*/, make(map[string]int64)); err == nil {
-			m := make(map[string]*instanceGroup, 1)
-			m[finalGroupName] = &instanceGroup{} // empty
-			c.instanceGroups[zone] = m
-		} else {
-			glog.Errorf("There was an error creating instance group [%s] in zone [%s]. Error: %s", finalGroupName, zone, err)
-			cleanup = true
-			break
+// discoverZones returns the zones that are up, in any of regions or matching glob
+func discoverZones(c *gce.GCEClient, regions []string, glob string) ([]string, error) {
+	list, err := c.GetAvailableZones()
+	if err != nil {
+		return nil, err
+	}
+	return matchZones(list.Items, regions, glob)
+}
+
+// matchZones returns the names of zones that are up, in any of regions or matching glob
+func matchZones(available []*compute.Zone, regions []string, glob string) ([]string, error) {
+	var zones []string
+	for _, zone := range available {
+		// zones going away aren't worth creating anything in
+		if zone.Status != "UP" || zone.Deprecated != nil {
+			continue
+		}
+		// zone.Region is a region URL, so split is needed here
+		split := strings.Split(zone.Region, "/")
+		matches := contains(regions, split[len(split)-1])
+		if !matches && glob != "" {
+			var err error
+			if matches, err = path.Match(glob, zone.Name); err != nil {
+				return nil, err
+			}
+		}
+		if matches {
+			zones = append(zones, zone.Name)
 		}
 	}
+	return zones, nil
+}
 
-	// need to clean-up?
-	if cleanup {
-		glog.Warningf("Rollback instance group creation for [%s]..", groupName)
-		// delete created instance groups
-		c.RemoveInstanceGroup(groupName)
-		return ErrCantCreateInstanceGroup
+// zonesForDatacenter returns the zones mapped to a datacenter.
+// Unknown datacenters fall back to all allowed zones.
+func (c *gceCloud) zonesForDatacenter(datacenter string) []string {
+	c.RLock()
+	defer c.RUnlock()
+	if zones, ok := c.datacenterZones[datacenter]; ok {
+		return append([]string{}, zones...)
+	}
+	return append([]string{}, c.zones...)
+}
+
+// allowedZones returns all zones instance groups may be created in
+func (c *gceCloud) allowedZones() []string {
+	c.RLock()
+	defer c.RUnlock()
+	return append([]string{}, c.zones...)
+}
+
+// allowZone allows a zone from now on, for all datacenters and the specified one
+func (c *gceCloud) allowZone(zone string, datacenter string) {
+	c.Lock()
+	defer c.Unlock()
+	if !contains(c.zones, zone) {
+		c.zones = append(c.zones, zone)
+	}
+	if dcZones, ok := c.datacenterZones[datacenter]; ok && !contains(dcZones, zone) {
+		c.datacenterZones[datacenter] = append(dcZones, zone)
+	}
+}
+
+// port returns the instance port of an instance group, if known
+func (c *gceCloud) port(groupName string) (int64, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	port, ok := c.ports[groupName]
+	return port, ok
+}
+
+// setPort remembers the instance port of an instance group, so instance groups created later get it as well
+func (c *gceCloud) setPort(groupName string, port int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.ports[groupName] = port
+}
+
+// instanceZone returns the zone an instance is known to live in, if any
+func (c *gceCloud) instanceZone(instanceName string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	zone, ok := c.instanceZones[instanceName]
+	return zone, ok
+}
+
+// inZone returns whether an instance by that name in zone may be the one wanted,
+// i.e. its zone isn't known or it's that zone. Instance names are only unique per zone.
+func (c *gceCloud) inZone(instanceName string, zone string) bool {
+	known, ok := c.instanceZone(instanceName)
+	return !ok || known == zone
+}
+
+// hasZoneGroup returns whether an instance group is known to exist in a zone
+func (c *gceCloud) hasZoneGroup(groupName string, zone string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	_, ok := c.instanceGroups[groupName][zone]
+	return ok
+}
+
+// zoneGroup returns a zone's instance group, remembering it if it wasn't known. The lock must be held.
+func (c *gceCloud) zoneGroup(groupName string, zone string) *instanceGroup {
+	if _, ok := c.instanceGroups[groupName]; !ok {
+		c.instanceGroups[groupName] = make(map[string]*instanceGroup)
+	}
+	ig, ok := c.instanceGroups[groupName][zone]
+	if !ok {
+		ig = newInstanceGroup(zonify(zone, groupName))
+		c.instanceGroups[groupName][zone] = ig
 	}
+	return ig
+}
 
-	glog.Infof("Created instance groups for [%s] successfully", groupName)
+// observeZoneGroup remembers what was read of a zone's instance group
+func (c *gceCloud) observeZoneGroup(groupName string, zone string, observed *compute.InstanceGroup) {
+	c.Lock()
+	defer c.Unlock()
+	ig := c.zoneGroup(groupName, zone)
+	ig.selfLink = observed.SelfLink
+	ig.namedPorts = make(map[string]int64, len(observed.NamedPorts))
+	for _, namedPort := range observed.NamedPorts {
+		ig.namedPorts[namedPort.Name] = namedPort.Port
+	}
+}
+
+// observeMembers remembers the instances listed in a zone's instance group
+func (c *gceCloud) observeMembers(groupName string, zone string, listed *compute.InstanceGroupsListInstances) {
+	c.Lock()
+	defer c.Unlock()
+	ig := c.zoneGroup(groupName, zone)
+	ig.instances = make(map[string]string, len(listed.Items))
+	for _, groupInstance := range listed.Items {
+		ig.instances[nameFromURL(groupInstance.Instance)] = groupInstance.Instance
+	}
+}
+
+// setMembers remembers the instances of a zone's instance group, mapped to their self-links
+func (c *gceCloud) setMembers(groupName string, zone string, members map[string]string) {
+	c.Lock()
+	defer c.Unlock()
+	ig := c.zoneGroup(groupName, zone)
+	ig.instances = make(map[string]string, len(members))
+	for instanceName, selfLink := range members {
+		ig.instances[instanceName] = selfLink
+	}
+}
 
+// addMembers remembers instances added to a zone's instance group, mapped to their self-links
+func (c *gceCloud) addMembers(groupName string, zone string, members map[string]string) {
+	c.Lock()
+	defer c.Unlock()
+	ig := c.zoneGroup(groupName, zone)
+	for instanceName, selfLink := range members {
+		ig.instances[instanceName] = selfLink
+	}
+}
+
+// removeMembers forgets instances removed from a zone's instance group
+func (c *gceCloud) removeMembers(groupName string, zone string, instanceNames []string) {
+	c.Lock()
+	defer c.Unlock()
+	if ig, ok := c.instanceGroups[groupName][zone]; ok {
+		for _, instanceName := range instanceNames {
+			delete(ig.instances, instanceName)
+		}
+	}
+}
+
+// setNamedPort remembers the single named port set on a zone's instance group
+func (c *gceCloud) setNamedPort(groupName string, zone string, port int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.zoneGroup(groupName, zone).namedPorts = map[string]int64{gce.ServicePortName: port}
+}
+
+// forgetZoneGroup forgets a zone's instance group, once it's deleted
+func (c *gceCloud) forgetZoneGroup(groupName string, zone string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.instanceGroups[groupName], zone)
+}
+
+// CreateInstanceGroup starts managing an instance group. Zonal instance groups are created lazily,
+// once the first instance in each zone appears.
+func (c *gceCloud) CreateInstanceGroup(groupName string) error {
+	glog.Infof("Managing instance groups for [%s]. Each zone's is created once it has instances.", groupName)
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.instanceGroups[groupName]; !ok {
+		c.instanceGroups[groupName] = make(map[string]*instanceGroup, len(c.zones))
+	}
 	return nil
 }
 
@@ -107,16 +482,18 @@ func (c *gceCloud) RemoveInstanceGroup(groupName string) error {
 	// remove one instance-group per zone
 	cleanup := false
 	glog.Infof("Removing instance groups for [%s]..", groupName)
-	// delete created instance groups
-	for _, zone := range c.zones {
-		if _, ok := c.instanceGroups[zone]; ok {
-			finalGroupName := zonify(zone, groupName)
-			if err := c.client.DeleteInstanceGroupForZone(finalGroupName, zone); err == nil {
+	// delete created instance groups, including any not known about, e.g. created before a restart
+	for _, zone := range c.allowedZones() {
+		finalGroupName := zonify(zone, groupName)
+		if err := c.client.DeleteInstanceGroupForZone(finalGroupName, zone); err == nil {
+			if c.hasZoneGroup(groupName, zone) {
 				glog.Warningf("Removed instance group [%s] from zone [%s].", finalGroupName, zone)
-			} else {
-				glog.Errorf("HUMAN INTERVERTION REQUIRED: Failed to remove instance group [%s] from zone [%s]. Error: %s", finalGroupName, zone, err)
-				cleanup = true
 			}
+			c.forgetZoneGroup(groupName, zone)
+			instanceGroupInstances.Delete(finalGroupName, zone)
+		} else {
+			glog.Errorf("HUMAN INTERVERTION REQUIRED: Failed to remove instance group [%s] from zone [%s]. Error: %s", finalGroupName, zone, err)
+			cleanup = true
 		}
 	}
 
@@ -124,19 +501,74 @@ func (c *gceCloud) RemoveInstanceGroup(groupName string) error {
 		return ErrCantRemoveInstanceGroup
 	}
 
+	c.Lock()
+	delete(c.instanceGroups, groupName)
+	delete(c.ports, groupName)
+	c.Unlock()
 	glog.Infof("Removing instance groups for [%s] completed successfully", groupName)
 
 	return nil
 }
 
-func (c *gceCloud) AddInstancesToInstanceGroup(instanceNames []string, groupName string) error {
-	glog.Infof("Adding %d instances into instance group [%s]", len(instanceNames), groupName)
+// groupZones returns the zones an instance group has been created in, sorted
+func (c *gceCloud) groupZones(groupName string) []string {
+	c.RLock()
+	defer c.RUnlock()
+	var zones []string
+	for zone := range c.instanceGroups[groupName] {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// createZoneGroup creates a zone's instance group, setting its port if known
+// and adding it to the load-balancer's backends if there's a load-balancer
+func (c *gceCloud) createZoneGroup(groupName string, zone string) error {
+	finalGroupName := zonify(zone, groupName)
+	glog.Infof("Creating instance group [%s] in zone [%s].", finalGroupName, zone)
+	if err := c.client.CreateInstanceGroupForZone(finalGroupName, zone, make(map[string]int64)); err != nil {
+		glog.Errorf("There was an error creating instance group [%s] in zone [%s]. Error: %s", finalGroupName, zone, err)
+		return ErrCantCreateInstanceGroup
+	}
+	ig, err := c.client.GetInstanceGroupForZone(finalGroupName, zone)
+	if err != nil {
+		return err
+	}
+	c.observeZoneGroup(groupName, zone, ig)
+	if port, ok := c.port(groupName); ok {
+		if err := c.client.SetPortToInstanceGroupForZone(finalGroupName, port, zone); err != nil {
+			return err
+		}
+		c.setNamedPort(groupName, zone, port)
+	}
+	return c.client.AddInstanceGroupToBackendService(groupName, zone)
+}
+
+// removeZoneGroup removes a zone's instance group from the load-balancer's backends, and deletes it
+func (c *gceCloud) removeZoneGroup(groupName string, zone string) error {
+	finalGroupName := zonify(zone, groupName)
+	glog.Infof("Instance group [%s] in zone [%s] has no instances left. Removing..", finalGroupName, zone)
+	if err := c.client.RemoveInstanceGroupFromBackendService(groupName, zone); err != nil {
+		return err
+	}
+	if err := c.client.DeleteInstanceGroupForZone(finalGroupName, zone); err != nil {
+		return err
+	}
+	c.forgetZoneGroup(groupName, zone)
+	instanceGroupInstances.Delete(finalGroupName, zone)
+	return nil
+}
+
+func (c *gceCloud) AddInstancesToInstanceGroup(instanceNames []string, groupName string, datacenter string) error {
+	glog.Infof("Adding %d instances from datacenter [%s] into instance group [%s]", len(instanceNames), datacenter, groupName)
 
 	// since instance names are globally unique, we just need to care about matching provided
-	// instance names to each zone.
+	// instance names to each zone of the datacenter.
 	// let's do it on a per-zone basis.
 	// remember instance names were zonified before added to instance group.
-	for _, zone := range c.zones {
+	found := make(map[string]bool, len(instanceNames))
+	for _, zone := range c.zonesForDatacenter(datacenter) {
 		// instance group name for this zone
 		finalGroupName := zonify(zone, groupName)
 
@@ -146,19 +578,37 @@ func (c *gceCloud) AddInstancesToInstanceGroup(instanceNames []string, groupName
 			return err
 		}
 
+		// no instance group until the zone's first instance appears
+		if !c.hasZoneGroup(groupName, zone) {
+			inZone := false
+			for _, zoneInstance := range zoneInstances.Items {
+				inZone = inZone || (contains(instanceNames, zoneInstance.Name) && c.inZone(zoneInstance.Name, zone))
+			}
+			if !inZone {
+				continue
+			}
+			if err := c.createZoneGroup(groupName, zone); err != nil {
+				return err
+			}
+		}
+
 		// get all instances in group
 		groupInstances, err := c.client.ListInstancesInInstanceGroupForZone(finalGroupName, zone)
 		if err != nil {
 			return err
 		}
+		c.observeMembers(groupName, zone, groupInstances)
 
 		var instancesToAddtoZone []string
+		// self-links of instances to add, keyed by name
+		added := make(map[string]string)
 
 		// for each instance, un-zonify its name so we can compare against provided instanceNames
 		for _, zoneInstance := range zoneInstances.Items {
 			// for each instanceName, if equals to unzonified name, add to group
 			for _, instanceName := range instanceNames {
-				if instanceName == zoneInstance.Name {
+				if instanceName == zoneInstance.Name && c.inZone(instanceName, zone) {
+					found[instanceName] = true
 					// is instance already added to instance group?
 					ignoreOp := false
 					for _, groupInstance := range groupInstances.Items {
@@ -171,6 +621,7 @@ func (c *gceCloud) AddInstancesToInstanceGroup(instanceNames []string, groupName
 					if !ignoreOp {
 						// use real instance name, meaning the zonified
 						instancesToAddtoZone = append(instancesToAddtoZone, zoneInstance.Name)
+						added[zoneInstance.Name] = zoneInstance.SelfLink
 					}
 				}
 			}
@@ -183,16 +634,82 @@ func (c *gceCloud) AddInstancesToInstanceGroup(instanceNames []string, groupName
 			if err := c.client.AddInstancesToInstanceGroup(finalGroupName, instancesToAddtoZone, zone); err != nil {
 				return err
 			}
+			c.addMembers(groupName, zone, added)
 		} else {
 			glog.Infof("There are no instances to add to instance group [%s] on zone [%s].", groupName, zone)
 		}
 	}
 
+	// instances not found may live in zones that aren't allowed
+	var missing []string
+	for _, instanceName := range instanceNames {
+		if !found[instanceName] {
+			missing = append(missing, instanceName)
+		}
+	}
+	if len(missing) > 0 {
+		if err := c.addUnlistedInstances(missing, groupName, datacenter); err != nil {
+			return err
+		}
+	}
+
 	glog.Infof("Added %d instances into instance group [%s]", len(instanceNames), groupName)
 
 	return nil
 }
 
+// addUnlistedInstances looks up the zones of instances that weren't found in allowed zones.
+// Those zones' instance groups are created and the instances added if enabled, otherwise they're ignored.
+func (c *gceCloud) addUnlistedInstances(instanceNames []string, groupName string, datacenter string) error {
+	for _, instanceName := range instanceNames {
+		// no need to look for it everywhere if its zone is known
+		zone, ok := c.instanceZone(instanceName)
+		if !ok {
+			var err error
+			zone, err = c.client.FindInstanceZone(instanceName)
+			if err != nil {
+				if err == gce.ErrInstanceNotFound {
+					glog.Warningf("Instance [%s] of instance group [%s] doesn't exist. Ignoring..", instanceName, groupName)
+					continue
+				}
+				return err
+			}
+		}
+		if contains(c.zonesForDatacenter(datacenter), zone) {
+			// allowed meanwhile
+			continue
+		}
+		if !c.createUnlistedZones {
+			glog.Warningf("Instance [%s] of instance group [%s] lives in zone [%s], which isn't allowed for datacenter [%s]. Ignoring..", instanceName, groupName, zone, datacenter)
+			continue
+		}
+
+		// allow zone from now on, so it's reconciled along with the others
+		glog.Warningf("Instance [%s] of instance group [%s] lives in zone [%s], which isn't allowed for datacenter [%s]. Allowing..", instanceName, groupName, zone, datacenter)
+		c.allowZone(zone, datacenter)
+
+		finalGroupName := zonify(zone, groupName)
+		if !c.hasZoneGroup(groupName, zone) {
+			if err := c.createZoneGroup(groupName, zone); err != nil {
+				return err
+			}
+		}
+		instance, err := c.client.GetInstanceByNameAndZone(instanceName, zone)
+		if err != nil {
+			if gce.IsNotFound(err) {
+				glog.Warningf("Instance [%s] of instance group [%s] doesn't exist in zone [%s]. Ignoring..", instanceName, groupName, zone)
+				continue
+			}
+			return err
+		}
+		if err := c.client.AddInstancesToInstanceGroup(finalGroupName, []string{instanceName}, zone); err != nil {
+			return err
+		}
+		c.addMembers(groupName, zone, map[string]string{instanceName: instance.SelfLink})
+	}
+	return nil
+}
+
 func (c *gceCloud) RemoveInstancesFromInstanceGroup(instanceNames []string, groupName string) error {
 	glog.Infof("Removing %d instances from instance group [%s]", len(instanceNames), groupName)
 
@@ -200,7 +717,7 @@ func (c *gceCloud) RemoveInstancesFromInstanceGroup(instanceNames []string, grou
 	// instance names to each zone.
 	// let's do it on a per-zone basis.
 	// remember instance names were zonified before added to instance group.
-	for _, zone := range c.zones {
+	for _, zone := range c.groupZones(groupName) {
 		// instance group name for this zone
 		finalGroupName := zonify(zone, groupName)
 
@@ -232,6 +749,13 @@ func (c *gceCloud) RemoveInstancesFromInstanceGroup(instanceNames []string, grou
 			if err := c.client.RemoveInstancesFromInstanceGroup(finalGroupName, instancesToRemoveFromZone, zone); err != nil {
 				return err
 			}
+			c.removeMembers(groupName, zone, instancesToRemoveFromZone)
+			// unused backends aren't kept around
+			if total == len(groupInstances.Items) {
+				if err := c.removeZoneGroup(groupName, zone); err != nil {
+					return err
+				}
+			}
 		} else {
 			glog.Infof("There are no instances to be removed from instance group [%s] on zone [%s].", groupName, zone)
 		}
@@ -243,8 +767,11 @@ func (c *gceCloud) RemoveInstancesFromInstanceGroup(instanceNames []string, grou
 func (c *gceCloud) SetPortForInstanceGroup(port int64, groupName string) error {
 	glog.Infof("Setting instance group [%s] port [%d]..", groupName, port)
 
+	// instance groups created later get the port as well
+	c.setPort(groupName, port)
+
 	success := true
-	for _, zone := range c.zones {
+	for _, zone := range c.groupZones(groupName) {
 		// instance group name for this zone
 		finalGroupName := zonify(zone, groupName)
 
@@ -252,7 +779,9 @@ func (c *gceCloud) SetPortForInstanceGroup(port int64, groupName string) error {
 		if err := c.client.SetPortToInstanceGroupForZone(finalGroupName, port, zone); err != nil {
 			glog.Errorf("There was an error while setting port [%d] for instance group [%s] in zone [%s]. %s", port, finalGroupName, zone, err)
 			success = false
+			continue
 		}
+		c.setNamedPort(groupName, zone, port)
 	}
 
 	if !success {
@@ -262,11 +791,22 @@ func (c *gceCloud) SetPortForInstanceGroup(port int64, groupName string) error {
 	return nil
 }
 
-func (c *gceCloud) CreateOrUpdateLoadBalancer(groupName string, port string) error {
+func (c *gceCloud) CreateOrUpdateLoadBalancer(groupName string, port string, config *LoadBalancerConfig) error {
 	glog.Infof("Creating/updating load-balancer for [%s:%s].", groupName, port)
-	err := c.client.CreateOrUpdateLoadBalancer(groupName, port, c.zones)
-	glog.Infof("Load-balancer [%s] created successfully.", groupName)
-	return err
+	if err := c.client.CreateOrUpdateLoadBalancer(groupName, port, c.groupZones(groupName), c.toGCEConfig(config)); err != nil {
+		return err
+	}
+	glog.Infof("Load-balancer [%s] created/updated successfully.", groupName)
+	return nil
+}
+
+func (c *gceCloud) UpdateLoadBalancerConfig(groupName string, port string, config *LoadBalancerConfig) error {
+	glog.Infof("Updating load-balancer settings for [%s:%s].", groupName, port)
+	if err := c.client.UpdateLoadBalancerConfig(groupName, port, c.groupZones(groupName), c.toGCEConfig(config)); err != nil {
+		return err
+	}
+	glog.Infof("Load-balancer [%s] settings updated successfully.", groupName)
+	return nil
 }
 
 func (c *gceCloud) RemoveLoadBalancer(groupName string) error {
@@ -277,14 +817,348 @@ func (c *gceCloud) RemoveLoadBalancer(groupName string) error {
 	return err
 }
 
+func (c *gceCloud) GetLoadBalancerStatus(groupName string) (*LoadBalancerStatus, error) {
+	rules, err := c.client.ListGlobalForwardingRules(groupName)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("load-balancer has no frontends")
+	}
+
+	health, err := c.client.GetBackendServiceHealth(groupName, c.groupZones(groupName))
+	if err != nil {
+		return nil, err
+	}
+
+	status := &LoadBalancerStatus{Health: health}
+	for _, rule := range rules {
+		protocol := "HTTP"
+		if strings.Contains(rule.Target, "/targetHttpsProxies/") {
+			protocol = "HTTPS"
+		}
+		status.Frontends = append(status.Frontends, &Frontend{
+			IPAddress: rule.IPAddress,
+			PortRange: rule.PortRange,
+			Protocol:  protocol,
+		})
+	}
+	sortFrontends(status.Frontends)
+	status.IPAddress = status.Frontends[0].IPAddress
+	status.PortRange = status.Frontends[0].PortRange
+	return status, nil
+}
+
+// sortFrontends orders frontends by protocol, HTTP first, then by port
+func sortFrontends(frontends []*Frontend) {
+	port := func(f *Frontend) int {
+		p, _ := strconv.Atoi(strings.Split(f.PortRange, "-")[0])
+		return p
+	}
+	sort.Slice(frontends, func(i, j int) bool {
+		if frontends[i].Protocol != frontends[j].Protocol {
+			return frontends[i].Protocol == "HTTP"
+		}
+		return port(frontends[i]) < port(frontends[j])
+	})
+}
+
+func (c *gceCloud) Reconcile(groupName string, desired *DesiredState) error {
+	glog.Infof("Reconciling instance group [%s]..", groupName)
+
+	// desired members per zone, mapped to their self-links, e.g. members["us-east1-d"]["my-instance"] == "https://..."
+	zones := c.allowedZones()
+	members := make(map[string]map[string]string, len(zones))
+	for _, zone := range zones {
+		members[zone] = make(map[string]string)
+	}
+	// instances in each zone, mapped to their self-links, listed once per reconcile
+	zoneInstances := make(map[string]map[string]string, len(zones))
+	for dc, instanceNames := range desired.Instances {
+		for _, zone := range c.zonesForDatacenter(dc) {
+			if _, ok := zoneInstances[zone]; !ok {
+				list, err := c.client.ListInstancesInZone(zone)
+				if err != nil {
+					return err
+				}
+				zoneInstances[zone] = make(map[string]string, len(list.Items))
+				for _, instance := range list.Items {
+					zoneInstances[zone][instance.Name] = instance.SelfLink
+				}
+			}
+			for _, instanceName := range instanceNames {
+				if selfLink, ok := zoneInstances[zone][instanceName]; ok && c.inZone(instanceName, zone) {
+					members[zone][instanceName] = selfLink
+				}
+			}
+		}
+	}
+
+	port, err := strconv.ParseInt(desired.Port, 10, 64)
+	if desired.Port != "" && err != nil {
+		return err
+	}
+	if desired.Port != "" {
+		// instance groups created from now on get the port as well
+		c.setPort(groupName, port)
+	}
+
+	for _, zone := range zones {
+		finalGroupName := zonify(zone, groupName)
+
+		// does instance group exist?
+		ig, err := c.client.GetInstanceGroupForZone(finalGroupName, zone)
+		if err != nil && !gce.IsNotFound(err) {
+			return err
+		}
+		exists := err == nil
+
+		// zones without instances have no instance group, so unused backends don't pile up
+		if len(members[zone]) == 0 {
+			if exists {
+				if err := c.removeZoneGroup(groupName, zone); err != nil {
+					return err
+				}
+			}
+			c.forgetZoneGroup(groupName, zone)
+			continue
+		}
+
+		if !exists {
+			glog.Warningf("Instance group [%s] is missing in zone [%s]. Creating..", finalGroupName, zone)
+			if err := c.createZoneGroup(groupName, zone); err != nil {
+				return err
+			}
+			if ig, err = c.client.GetInstanceGroupForZone(finalGroupName, zone); err != nil {
+				return err
+			}
+		}
+		c.observeZoneGroup(groupName, zone, ig)
+
+		// are members the desired ones?
+		groupInstances, err := c.client.ListInstancesInInstanceGroupForZone(finalGroupName, zone)
+		if err != nil {
+			return err
+		}
+		actual := make(map[string]bool, len(groupInstances.Items))
+		var toRemove []string
+		for _, groupInstance := range groupInstances.Items {
+			// groupInstance.Instance is an instance URL
+			instanceName := nameFromURL(groupInstance.Instance)
+			actual[instanceName] = true
+			if _, ok := members[zone][instanceName]; !ok {
+				toRemove = append(toRemove, instanceName)
+			}
+		}
+		var toAdd []string
+		for instanceName := range members[zone] {
+			if !actual[instanceName] {
+				toAdd = append(toAdd, instanceName)
+			}
+		}
+		if len(toRemove) > 0 {
+			glog.Warningf("Instance group [%s] in zone [%s] has %d unwanted instances. Removing..", finalGroupName, zone, len(toRemove))
+			if err := c.client.RemoveInstancesFromInstanceGroup(finalGroupName, toRemove, zone); err != nil {
+				return err
+			}
+		}
+		if len(toAdd) > 0 {
+			glog.Warningf("Instance group [%s] in zone [%s] is missing %d instances. Adding..", finalGroupName, zone, len(toAdd))
+			if err := c.client.AddInstancesToInstanceGroup(finalGroupName, toAdd, zone); err != nil {
+				return err
+			}
+		}
+		c.setMembers(groupName, zone, members[zone])
+		instanceGroupInstances.Set(float64(len(members[zone])), finalGroupName, zone)
+
+		// is named port the desired one?
+		if desired.Port != "" && !(len(ig.NamedPorts) == 1 && ig.NamedPorts[0].Port == port) {
+			glog.Warningf("Instance group [%s] in zone [%s] has drifted from port [%d]. Setting..", finalGroupName, zone, port)
+			if err := c.client.SetPortToInstanceGroupForZone(finalGroupName, port, zone); err != nil {
+				return err
+			}
+			c.setNamedPort(groupName, zone, port)
+		}
+	}
+
+	// there's no load-balancer until port is known
+	if desired.Port == "" {
+		return nil
+	}
+
+	glog.Infof("Reconciling load-balancer [%s]..", groupName)
+	return c.client.ReconcileLoadBalancer(groupName, desired.Port, c.groupZones(groupName), c.toGCEConfig(desired.Config))
+}
+
+func (c *gceCloud) GetResourceNames(groupName string) map[string]string {
+	names := gce.ResourceNames(groupName)
+	c.RLock()
+	defer c.RUnlock()
+	for zone, ig := range c.instanceGroups[groupName] {
+		names["instance_group/"+zone] = ig.name
+	}
+	return names
+}
+
+func (c *gceCloud) ListInstanceGroups() ([]string, []string, error) {
+	var groupNames, unmarked []string
+	seen := make(map[string]bool)
+	for _, zone := range c.allowedZones() {
+		list, err := c.client.ListInstanceGroupsForZone(zone)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ig := range list.Items {
+			// leave alone whatever wasn't created by us, only telling about what may have been
+			if ig.Description != gce.ManagedDescription {
+				if groupName := unzonify(ig.Name, zone); groupName != ig.Name && !contains(unmarked, groupName) {
+					unmarked = append(unmarked, groupName)
+				}
+				continue
+			}
+			groupName := unzonify(ig.Name, zone)
+			// remember it, e.g. so it can be removed even if created before a restart
+			c.observeZoneGroup(groupName, zone, ig)
+			if !seen[groupName] {
+				seen[groupName] = true
+				groupNames = append(groupNames, groupName)
+			}
+		}
+	}
+	return groupNames, unmarked, nil
+}
+
+func (c *gceCloud) RestoreInstanceGroup(groupName string, zones []string) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.instanceGroups[groupName]; !ok {
+		c.instanceGroups[groupName] = make(map[string]*instanceGroup, len(zones))
+	}
+	for _, zone := range zones {
+		// keeps what's known already
+		c.zoneGroup(groupName, zone)
+	}
+}
+
+func (c *gceCloud) GetInstanceGroup(groupName string) (*InstanceGroup, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	zoneGroups, ok := c.instanceGroups[groupName]
+	if !ok {
+		return nil, false
+	}
+
+	// copy everything, as handlers keep changing the model
+	group := &InstanceGroup{
+		Zones: make(map[string]*ZoneInstanceGroup, len(zoneGroups)),
+		Port:  c.ports[groupName],
+	}
+	for zone, ig := range zoneGroups {
+		zoneGroup := &ZoneInstanceGroup{
+			Name:       ig.name,
+			SelfLink:   ig.selfLink,
+			Instances:  make(map[string]string, len(ig.instances)),
+			NamedPorts: make(map[string]int64, len(ig.namedPorts)),
+		}
+		for instanceName, selfLink := range ig.instances {
+			zoneGroup.Instances[instanceName] = selfLink
+		}
+		for name, port := range ig.namedPorts {
+			zoneGroup.NamedPorts[name] = port
+		}
+		group.Zones[zone] = zoneGroup
+	}
+	return group, true
+}
+
+func (c *gceCloud) SetInstanceZone(instanceName string, zone string) {
+	c.Lock()
+	defer c.Unlock()
+	c.instanceZones[instanceName] = zone
+}
+
+func (c *gceCloud) Ping() error {
+	_, err := c.client.GetAvailableZones()
+	return err
+}
+
+func (c *gceCloud) ListInstanceAddresses() (map[string]string, error) {
+	return c.client.ListInstanceAddresses()
+}
+
+// toGCEConfig converts load-balancer settings to what the GCE client understands,
+// along with the global firewall settings
+func (c *gceCloud) toGCEConfig(config *LoadBalancerConfig) *gce.LoadBalancerConfig {
+	var firewall *FirewallConfig
+	if config != nil {
+		firewall = config.Firewall
+	}
+	gceConfig := &gce.LoadBalancerConfig{
+		Firewall: c.toGCEFirewallConfig(firewall),
+	}
+	if config != nil {
+		gceConfig.HealthCheckPath = config.HealthCheckPath
+		gceConfig.TimeoutSec = config.TimeoutSec
+		gceConfig.Certificates = config.Certificates
+		gceConfig.FrontendPorts = config.FrontendPorts
+	}
+	return gceConfig
+}
+
+// toGCEFirewallConfig merges per-service firewall settings over the global ones
+func (c *gceCloud) toGCEFirewallConfig(config *FirewallConfig) *gce.FirewallConfig {
+	merged := new(gce.FirewallConfig)
+	for _, fw := range []*FirewallConfig{c.firewall, config} {
+		if fw == nil {
+			continue
+		}
+		if len(fw.SourceRanges) > 0 {
+			merged.SourceRanges = fw.SourceRanges
+		}
+		// targets replace each other, as they can't be combined
+		if len(fw.TargetTags) > 0 {
+			merged.TargetTags = fw.TargetTags
+			merged.TargetServiceAccounts = nil
+		}
+		if len(fw.TargetServiceAccounts) > 0 {
+			merged.TargetServiceAccounts = fw.TargetServiceAccounts
+			merged.TargetTags = nil
+		}
+		if fw.Priority != 0 {
+			merged.Priority = fw.Priority
+		}
+		if fw.Logging != nil {
+			merged.Logging = *fw.Logging
+		}
+	}
+	return merged
+}
+
 //zonify takes a specified name and prepends a specified zone plus an hyphen
 // e.g. zone == "us-east1-d" && name == "myname", returns "us-east1-d-myname"
 func zonify(zone string, name string) string {
 	return strings.Join([]string{zone, name}, "-")
 }
 
+// contains returns whether a slice of strings contains a specified string
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
+
+// nameFromURL takes a resource URL and returns the resource name
+// e.g. url == ".../zones/us-east1-d/instances/my-instance", returns "my-instance"
+func nameFromURL(url string) string {
+	split := strings.Split(url, "/")
+	return split[len(split)-1]
+}
+
 // unzonify takes a specified supposedly zonified name and removes the zone prefix.
 // e.g. name == "us-east1-d-myname" && zone == "us-east1-d", returns "myname"
 func unzonify(name string, zone string) string {
-	return strings.TrimPrefix(name, zone)
+	return strings.TrimPrefix(name, zone+"-")
 }
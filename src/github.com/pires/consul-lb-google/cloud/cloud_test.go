@@ -0,0 +1,131 @@
+package cloud
+
+import (
+	"reflect"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestSortFrontends(t *testing.T) {
+	frontends := []*Frontend{
+		{PortRange: "443-443", Protocol: "HTTPS"},
+		{PortRange: "8080-8080", Protocol: "HTTP"},
+		{PortRange: "80-80", Protocol: "HTTP"},
+		{PortRange: "443-443", Protocol: "HTTP"},
+	}
+	sortFrontends(frontends)
+
+	expected := []string{"HTTP 80-80", "HTTP 443-443", "HTTP 8080-8080", "HTTPS 443-443"}
+	for i, f := range frontends {
+		if got := f.Protocol + " " + f.PortRange; got != expected[i] {
+			t.Fatalf("frontend %d: expected %s, got %s", i, expected[i], got)
+		}
+	}
+}
+
+func TestInZone(t *testing.T) {
+	c := &gceCloud{instanceZones: make(map[string]string)}
+	c.SetInstanceZone("web-1", "us-east1-d")
+
+	tests := []struct {
+		instance string
+		zone     string
+		expected bool
+	}{
+		{"web-1", "us-east1-d", true},
+		{"web-1", "us-east1-b", false},
+		// zone not known, so any will do
+		{"web-2", "us-east1-b", true},
+	}
+	for _, test := range tests {
+		if got := c.inZone(test.instance, test.zone); got != test.expected {
+			t.Errorf("%s in %s: expected %t, got %t", test.instance, test.zone, test.expected, got)
+		}
+	}
+}
+
+func TestMatchZones(t *testing.T) {
+	region := func(name string) string {
+		return "https://www.googleapis.com/compute/v1/projects/my-project/regions/" + name
+	}
+	available := []*compute.Zone{
+		{Name: "us-east1-b", Region: region("us-east1"), Status: "UP"},
+		{Name: "us-east1-c", Region: region("us-east1"), Status: "UP"},
+		{Name: "us-east1-d", Region: region("us-east1"), Status: "DOWN"},
+		{Name: "europe-west1-b", Region: region("europe-west1"), Status: "UP"},
+		{Name: "europe-west1-c", Region: region("europe-west1"), Status: "UP", Deprecated: &compute.DeprecationStatus{State: "DEPRECATED"}},
+		{Name: "europe-west2-a", Region: region("europe-west2"), Status: "UP"},
+	}
+
+	tests := []struct {
+		name     string
+		regions  []string
+		glob     string
+		expected []string
+	}{
+		{"nothing", nil, "", nil},
+		{"region", []string{"us-east1"}, "", []string{"us-east1-b", "us-east1-c"}},
+		{"regions", []string{"us-east1", "europe-west2"}, "", []string{"us-east1-b", "us-east1-c", "europe-west2-a"}},
+		{"unknown region", []string{"asia-east1"}, "", nil},
+		{"glob", nil, "europe-west*", []string{"europe-west1-b", "europe-west2-a"}},
+		{"glob with single character", nil, "us-east1-?", []string{"us-east1-b", "us-east1-c"}},
+		{"region and glob", []string{"us-east1"}, "europe-west2-*", []string{"us-east1-b", "us-east1-c", "europe-west2-a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			zones, err := matchZones(available, test.regions, test.glob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(zones, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, zones)
+			}
+		})
+	}
+
+	if _, err := matchZones(available, nil, "[us-east1"); err == nil {
+		t.Fatal("expected malformed glob to fail")
+	}
+}
+
+func TestZonesForDatacenter(t *testing.T) {
+	c := &gceCloud{
+		zones:           []string{"us-east1-b", "us-east1-c", "europe-west1-b"},
+		datacenterZones: map[string][]string{"dc1": {"us-east1-b", "us-east1-c"}},
+	}
+
+	tests := []struct {
+		datacenter string
+		expected   []string
+	}{
+		{"dc1", []string{"us-east1-b", "us-east1-c"}},
+		// unknown datacenters fall back to all allowed zones
+		{"dc2", []string{"us-east1-b", "us-east1-c", "europe-west1-b"}},
+		{"", []string{"us-east1-b", "us-east1-c", "europe-west1-b"}},
+	}
+	for _, test := range tests {
+		if zones := c.zonesForDatacenter(test.datacenter); !reflect.DeepEqual(zones, test.expected) {
+			t.Errorf("datacenter %q: expected %v, got %v", test.datacenter, test.expected, zones)
+		}
+	}
+
+	// callers get copies
+	c.zonesForDatacenter("dc1")[0] = "changed"
+	if c.datacenterZones["dc1"][0] != "us-east1-b" {
+		t.Fatal("expected zones to be copied")
+	}
+
+	// zones allowed later apply to all datacenters and the one they're allowed for
+	c.allowZone("us-east1-d", "dc1")
+	if zones := c.zonesForDatacenter("dc1"); !contains(zones, "us-east1-d") {
+		t.Fatalf("expected us-east1-d allowed for dc1, got %v", zones)
+	}
+	if zones := c.allowedZones(); !contains(zones, "us-east1-d") || len(zones) != 4 {
+		t.Fatalf("expected us-east1-d allowed, got %v", zones)
+	}
+	c.allowZone("us-east1-d", "dc1")
+	if zones := c.zonesForDatacenter("dc1"); len(zones) != 3 {
+		t.Fatalf("expected zones allowed once, got %v", zones)
+	}
+}
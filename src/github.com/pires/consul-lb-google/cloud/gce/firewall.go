@@ -0,0 +1,145 @@
+package gce
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultFirewallPriority = 1000
+)
+
+var (
+	// ranges Google's load-balancers and health-checks connect from
+	defaultFirewallSourceRanges = []string{"130.211.0.0/22", "35.191.0.0/16"}
+)
+
+// FirewallConfig represents settings applied to a load-balancer's firewall rule.
+// Zero values mean defaults.
+type FirewallConfig struct {
+	// source ranges allowed in, defaults to Google's load-balancer and health-check ranges
+	SourceRanges []string
+	// network tags of instances the rule applies to, defaults to every instance in the network
+	TargetTags []string
+	// service accounts of instances the rule applies to, instead of network tags
+	TargetServiceAccounts []string
+	// rule priority, defaults to 1000
+	Priority int64
+	// whether connections are logged
+	Logging bool
+}
+
+func (c *FirewallConfig) sourceRanges() []string {
+	if c == nil || len(c.SourceRanges) == 0 {
+		return defaultFirewallSourceRanges
+	}
+	return c.SourceRanges
+}
+
+func (c *FirewallConfig) targetTags() []string {
+	if c == nil {
+		return nil
+	}
+	return c.TargetTags
+}
+
+// extras returns the settings the vendored compute API predates
+func (c *FirewallConfig) extras() *firewallExtras {
+	extras := &firewallExtras{
+		Priority:              defaultFirewallPriority,
+		TargetServiceAccounts: []string{},
+		LogConfig:             &firewallLogConfig{},
+	}
+	if c == nil {
+		return extras
+	}
+	if c.Priority != 0 {
+		extras.Priority = c.Priority
+	}
+	if len(c.TargetServiceAccounts) > 0 {
+		extras.TargetServiceAccounts = c.TargetServiceAccounts
+	}
+	extras.LogConfig.Enable = c.Logging
+	return extras
+}
+
+// firewallExtras are firewall fields the vendored compute API predates,
+// so they're read and patched with plain API calls
+type firewallExtras struct {
+	Priority              int64              `json:"priority"`
+	TargetServiceAccounts []string           `json:"targetServiceAccounts"`
+	LogConfig             *firewallLogConfig `json:"logConfig"`
+}
+
+type firewallLogConfig struct {
+	Enable bool `json:"enable"`
+}
+
+// equal returns whether extras are the same, telling missing fields apart from defaults
+func (e *firewallExtras) equal(other *firewallExtras) bool {
+	if len(e.TargetServiceAccounts) != 0 || len(other.TargetServiceAccounts) != 0 {
+		if !reflect.DeepEqual(e.TargetServiceAccounts, other.TargetServiceAccounts) {
+			return false
+		}
+	}
+	enabled := e.LogConfig != nil && e.LogConfig.Enable
+	otherEnabled := other.LogConfig != nil && other.LogConfig.Enable
+	return e.Priority == other.Priority && enabled == otherEnabled
+}
+
+// firewallURL returns the API URL of a firewall rule
+func (gce *GCEClient) firewallURL(fwName string) string {
+	return gce.service.BasePath + gce.projectID + "/global/firewalls/" + fwName
+}
+
+// getFirewallExtras returns the fields of a firewall rule the vendored compute API predates
+func (gce *GCEClient) getFirewallExtras(fwName string) (*firewallExtras, error) {
+	resp, err := gce.httpClient.Get(gce.firewallURL(fwName))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	extras := new(firewallExtras)
+	if err := json.NewDecoder(resp.Body).Decode(extras); err != nil {
+		return nil, err
+	}
+	// missing priority means the default one
+	if extras.Priority == 0 {
+		extras.Priority = defaultFirewallPriority
+	}
+	return extras, nil
+}
+
+// patchFirewallExtras sets the fields of a firewall rule the vendored compute API predates
+func (gce *GCEClient) patchFirewallExtras(fwName string, extras *firewallExtras) error {
+	body, err := json.Marshal(extras)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PATCH", gce.firewallURL(fwName), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := gce.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+	op := new(compute.Operation)
+	if err := json.NewDecoder(resp.Body).Decode(op); err != nil {
+		return err
+	}
+	return gce.waitForGlobalOp(op)
+}
@@ -0,0 +1,127 @@
+package gce
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// fakeFirewalls is a local GCE API serving a single firewall rule, recording changes to it
+type fakeFirewalls struct {
+	sync.Mutex
+	// firewall rule as GCE returns it, nil if it doesn't exist
+	rule map[string]interface{}
+	// methods of requests changing the rule, e.g. "PUT"
+	changes []string
+}
+
+func (f *fakeFirewalls) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.URL.Path != "/my-project/global/firewalls/fw-web" && r.URL.Path != "/my-project/global/firewalls" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		if f.rule == nil {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(f.rule)
+	default:
+		f.changes = append(f.changes, r.Method)
+		json.NewEncoder(w).Encode(map[string]string{"name": "op", "status": "DONE"})
+	}
+}
+
+// rule returns a firewall rule as desired with defaults, changed by change
+func rule(change func(rule map[string]interface{})) map[string]interface{} {
+	r := map[string]interface{}{
+		"name":         "fw-web",
+		"network":      makeNetworkURL("my-project", "default"),
+		"sourceRanges": []string{"130.211.0.0/22", "35.191.0.0/16"},
+		"allowed":      []map[string]interface{}{{"IPProtocol": "tcp", "ports": []string{"8080"}}},
+		"priority":     1000,
+	}
+	if change != nil {
+		change(r)
+	}
+	return r
+}
+
+func TestReconcileFirewall(t *testing.T) {
+	logging := &FirewallConfig{Logging: true}
+	tests := []struct {
+		name   string
+		actual map[string]interface{}
+		config *FirewallConfig
+		// expected requests changing the rule
+		changes []string
+	}{
+		{"missing", nil, nil, []string{"POST", "PATCH"}},
+		{"as desired", rule(nil), nil, nil},
+		{"missing priority is the default", rule(func(r map[string]interface{}) { delete(r, "priority") }), nil, nil},
+		{"port drifted", rule(func(r map[string]interface{}) {
+			r["allowed"] = []map[string]interface{}{{"IPProtocol": "tcp", "ports": []string{"9090"}}}
+		}), nil, []string{"PUT", "PATCH"}},
+		{"protocol drifted", rule(func(r map[string]interface{}) {
+			r["allowed"] = []map[string]interface{}{{"IPProtocol": "udp", "ports": []string{"8080"}}}
+		}), nil, []string{"PUT", "PATCH"}},
+		{"extra allowed", rule(func(r map[string]interface{}) {
+			r["allowed"] = []map[string]interface{}{{"IPProtocol": "tcp", "ports": []string{"8080"}}, {"IPProtocol": "udp"}}
+		}), nil, []string{"PUT", "PATCH"}},
+		{"source ranges drifted", rule(func(r map[string]interface{}) { r["sourceRanges"] = []string{"0.0.0.0/0"} }), nil, []string{"PUT", "PATCH"}},
+		{"custom source ranges", rule(func(r map[string]interface{}) { r["sourceRanges"] = []string{"10.0.0.0/8"} }), &FirewallConfig{SourceRanges: []string{"10.0.0.0/8"}}, nil},
+		{"network drifted", rule(func(r map[string]interface{}) { r["network"] = makeNetworkURL("my-project", "other") }), nil, []string{"PUT", "PATCH"}},
+		{"target tags added", rule(func(r map[string]interface{}) { r["targetTags"] = []string{"web"} }), nil, []string{"PUT", "PATCH"}},
+		{"target tags as desired", rule(func(r map[string]interface{}) { r["targetTags"] = []string{"web"} }), &FirewallConfig{TargetTags: []string{"web"}}, nil},
+		{"priority drifted", rule(func(r map[string]interface{}) { r["priority"] = 900 }), nil, []string{"PUT", "PATCH"}},
+		{"custom priority", rule(func(r map[string]interface{}) { r["priority"] = 900 }), &FirewallConfig{Priority: 900}, nil},
+		{"logging disabled", rule(nil), logging, []string{"PUT", "PATCH"}},
+		{"logging as desired", rule(func(r map[string]interface{}) { r["logConfig"] = map[string]bool{"enable": true} }), logging, nil},
+		{"logging config disabled", rule(func(r map[string]interface{}) { r["logConfig"] = map[string]bool{"enable": false} }), nil, nil},
+		{"service accounts drifted", rule(func(r map[string]interface{}) { r["targetServiceAccounts"] = []string{"a@my-project"} }), nil, []string{"PUT", "PATCH"}},
+		{"service accounts as desired", rule(func(r map[string]interface{}) { r["targetServiceAccounts"] = []string{"a@my-project"} }), &FirewallConfig{TargetServiceAccounts: []string{"a@my-project"}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeFirewalls{rule: test.actual}
+			gce := newTestClient(t, fake)
+			if err := gce.reconcileFirewall("web", "8080", test.config); err != nil {
+				t.Fatal(err)
+			}
+			fake.Lock()
+			defer fake.Unlock()
+			if len(fake.changes) != len(test.changes) {
+				t.Fatalf("expected changes %v, got %v", test.changes, fake.changes)
+			}
+			for i := range test.changes {
+				if fake.changes[i] != test.changes[i] {
+					t.Fatalf("expected changes %v, got %v", test.changes, fake.changes)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileFirewallUnmanaged(t *testing.T) {
+	fake := &fakeFirewalls{}
+	gce := newTestClient(t, fake)
+	gce.manageFirewalls = false
+	if err := gce.reconcileFirewall("web", "8080", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.changes) != 0 {
+		t.Fatalf("expected firewall left alone, got %v", fake.changes)
+	}
+}
+
+func TestFirewallTargetsConflict(t *testing.T) {
+	gce := newTestClient(t, &fakeFirewalls{})
+	config := &FirewallConfig{TargetTags: []string{"web"}, TargetServiceAccounts: []string{"a@my-project"}}
+	if err := gce.reconcileFirewall("web", "8080", config); err != ErrFirewallTargets {
+		t.Fatalf("expected %v, got %v", ErrFirewallTargets, err)
+	}
+}
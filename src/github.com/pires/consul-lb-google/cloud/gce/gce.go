@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
+	"regexp"
 	"strings"
 	"time"
 
@@ -28,22 +30,90 @@ const (
 	operationPollInterval        = 3 * time.Second
 	operationPollTimeoutDuration = 30 * time.Minute
 
-	servicePort = "service-port"
+	// ServicePortName is the name of the instance groups' named port backends are served on
+	ServicePortName = "service-port"
+
+	defaultHealthCheckPath = "/"
+	defaultTimeoutSec      = 10
+	defaultFrontendPort    = "80"
+	httpsFrontendPort      = "443"
+
+	// ManagedDescription marks resources created by this manager
+	ManagedDescription = "Generated by consul-lb-gce"
 )
 
 var (
 	ErrInstanceNotFound = errors.New("Instance not found")
+	// ErrFirewallTargets when a firewall rule would target both network tags and service accounts
+	ErrFirewallTargets = errors.New("Firewall rules can target either network tags or service accounts, not both")
 )
 
+// LoadBalancerConfig represents settings applied to a load-balancer.
+// Zero values mean defaults.
+type LoadBalancerConfig struct {
+	// path requested by the HTTP health-check
+	HealthCheckPath string
+	// backend service timeout
+	TimeoutSec int64
+	// names of existing SSL certificates, if any an HTTPS frontend is created
+	Certificates []string
+	// HTTP frontend ports
+	FrontendPorts []string
+	// firewall rule settings
+	Firewall *FirewallConfig
+}
+
+func (c *LoadBalancerConfig) healthCheckPath() string {
+	if c == nil || c.HealthCheckPath == "" {
+		return defaultHealthCheckPath
+	}
+	return c.HealthCheckPath
+}
+
+func (c *LoadBalancerConfig) timeoutSec() int64 {
+	if c == nil || c.TimeoutSec == 0 {
+		return defaultTimeoutSec
+	}
+	return c.TimeoutSec
+}
+
+func (c *LoadBalancerConfig) certificates() []string {
+	if c == nil {
+		return nil
+	}
+	return c.Certificates
+}
+
+func (c *LoadBalancerConfig) firewall() *FirewallConfig {
+	if c == nil {
+		return nil
+	}
+	return c.Firewall
+}
+
+func (c *LoadBalancerConfig) frontendPorts() []string {
+	if c == nil || len(c.FrontendPorts) == 0 {
+		return []string{defaultFrontendPort}
+	}
+	return c.FrontendPorts
+}
+
 // GCEClient is a placeholder for GCE stuff.
 type GCEClient struct {
 	service    *compute.Service
 	projectID  string
 	networkURL string
+	// how far provisioning of each load-balancer got
+	journal Journal
+	// for API calls the vendored compute API predates
+	httpClient *http.Client
+	// whether firewall rules are created, updated and removed along with load-balancers
+	manageFirewalls bool
 }
 
-// CreateGCECloud creates a new instance of GCECloud.
-func CreateGCECloud(project string, network string) (*GCEClient, error) {
+// CreateGCECloud creates a new instance of GCECloud, journaling load-balancer provisioning in journal.
+// Unless manageFirewalls is set, firewall rules are left for operators to manage.
+func CreateGCECloud(project string, network string, journal Journal, manageFirewalls bool) (*GCEClient, error) {
 	// Use oauth2.NoContext if there isn't a good context to pass in.
 	ctx := context.TODO()
 
@@ -51,6 +121,7 @@ func CreateGCECloud(project string, network string) (*GCEClient, error) {
 	if err != nil {
 		return nil, err
 	}
+	client.Transport = &instrumentedTransport{client.Transport}
 	svc, err := compute.New(client)
 	if err != nil {
 		return nil, err
@@ -59,9 +130,12 @@ func CreateGCECloud(project string, network string) (*GCEClient, error) {
 	// TODO validate project and network exist
 
 	return &GCEClient{
-		service:    svc,
-		projectID:  project,
-		networkURL: makeNetworkURL(project, network),
+		service:         svc,
+		projectID:       project,
+		networkURL:      makeNetworkURL(project, network),
+		journal:         journal,
+		httpClient:      client,
+		manageFirewalls: manageFirewalls,
 	}, nil
 }
 
@@ -83,12 +157,18 @@ func (gce *GCEClient) CreateInstanceGroupForZone(name string, zone string, ports
 
 	// define InstanceGroup
 	ig := &compute.InstanceGroup{
-		Name:       name,
-		NamedPorts: namedPorts,
-		Network:    gce.networkURL}
+		Name:        name,
+		Description: ManagedDescription,
+		NamedPorts:  namedPorts,
+		Network:     gce.networkURL}
 
 	op, err := gce.service.InstanceGroups.Insert(gce.projectID, zone, ig).Do()
 	if err != nil {
+		// instance group may have been created by a previous leader, so adopt it
+		if isHTTPErrorCode(err, http.StatusConflict) {
+			glog.Infof("Instance group [%s] already exists in zone [%s].", name, zone)
+			return nil
+		}
 		return err
 	}
 	if err = gce.waitForZoneOp(op, zone); err != nil {
@@ -102,6 +182,10 @@ func (gce *GCEClient) DeleteInstanceGroupForZone(name string, zone string) error
 	op, err := gce.service.InstanceGroups.Delete(
 		gce.projectID, zone, name).Do()
 	if err != nil {
+		// never created or already deleted
+		if isHTTPErrorCode(err, http.StatusNotFound) {
+			return nil
+		}
 		return err
 	}
 	return gce.waitForZoneOp(op, zone)
@@ -183,7 +267,7 @@ func (gce *GCEClient) RemoveInstancesFromInstanceGroup(name string, instanceName
 // SetPortToInstanceGroupForZone makes sure there's one single port to the given instance group for the given zone.
 func (gce *GCEClient) SetPortToInstanceGroupForZone(name string, port int64, zone string) error {
 	var namedPorts []*compute.NamedPort
-	namedPorts = append(namedPorts, &compute.NamedPort{Name: servicePort, Port: port})
+	namedPorts = append(namedPorts, &compute.NamedPort{Name: ServicePortName, Port: port})
 	op, err := gce.service.InstanceGroups.SetNamedPorts(
 		gce.projectID, zone, name,
 		&compute.InstanceGroupsSetNamedPortsRequest{
@@ -202,6 +286,54 @@ func (gce *GCEClient) GetInstanceGroupForZone(name string, zone string) (*comput
 	return gce.service.InstanceGroups.Get(gce.projectID, zone, name).Do()
 }
 
+// FindInstanceZone returns the zone an instance lives in, whichever it is
+func (gce *GCEClient) FindInstanceZone(name string) (string, error) {
+	list, err := gce.service.Instances.AggregatedList(gce.projectID).Filter("name eq " + regexp.QuoteMeta(name)).Do()
+	if err != nil {
+		return "", err
+	}
+	for scope, scoped := range list.Items {
+		for _, instance := range scoped.Instances {
+			if instance.Name == name {
+				// scope is e.g. "zones/us-east1-d"
+				return strings.TrimPrefix(scope, "zones/"), nil
+			}
+		}
+	}
+	return "", ErrInstanceNotFound
+}
+
+// ListInstanceAddresses returns the names of all instances in the network, keyed by internal and external IP address
+func (gce *GCEClient) ListInstanceAddresses() (map[string]string, error) {
+	addresses := make(map[string]string)
+	pageToken := ""
+	for {
+		list, err := gce.service.Instances.AggregatedList(gce.projectID).PageToken(pageToken).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, scoped := range list.Items {
+			for _, instance := range scoped.Instances {
+				for _, nic := range instance.NetworkInterfaces {
+					if nic.Network != gce.networkURL {
+						continue
+					}
+					addresses[nic.NetworkIP] = instance.Name
+					for _, ac := range nic.AccessConfigs {
+						if ac.NatIP != "" {
+							addresses[ac.NatIP] = instance.Name
+						}
+					}
+				}
+			}
+		}
+		if list.NextPageToken == "" {
+			return addresses, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
 // GetAvailableZones returns all available zones for this project
 func (gce *GCEClient) GetAvailableZones() (*compute.ZoneList, error) {
 	return gce.service.Zones.List(gce.projectID).Do()
@@ -209,10 +341,16 @@ func (gce *GCEClient) GetAvailableZones() (*compute.ZoneList, error) {
 
 // Firewall rules management
 
+// GetFirewall returns a global firewall rule by name.
+func (gce *GCEClient) GetFirewall(name string) (*compute.Firewall, error) {
+	fwName := makeFirewallName(name)
+	return gce.service.Firewalls.Get(gce.projectID, fwName).Do()
+}
+
 // CreateFirewall creates a global firewall rule
-func (gce *GCEClient) CreateFirewall(name string, allowedPorts []string) error {
+func (gce *GCEClient) CreateFirewall(name string, allowedPorts []string, config *FirewallConfig) error {
 	fwName := makeFirewallName(name)
-	firewall, err := gce.makeFirewallObject(fwName, allowedPorts)
+	firewall, err := gce.makeFirewallObject(fwName, allowedPorts, config)
 	if err != nil {
 		return err
 	}
@@ -226,13 +364,13 @@ func (gce *GCEClient) CreateFirewall(name string, allowedPorts []string) error {
 			return err
 		}
 	}
-	return nil
+	return gce.patchFirewallExtras(fwName, config.extras())
 }
 
 // UpdateFirewall updates a global firewall rule
-func (gce *GCEClient) UpdateFirewall(name string, allowedPorts []string) error {
+func (gce *GCEClient) UpdateFirewall(name string, allowedPorts []string, config *FirewallConfig) error {
 	fwName := makeFirewallName(name)
-	firewall, err := gce.makeFirewallObject(fwName, allowedPorts)
+	firewall, err := gce.makeFirewallObject(fwName, allowedPorts, config)
 	if err != nil {
 		return err
 	}
@@ -246,7 +384,7 @@ func (gce *GCEClient) UpdateFirewall(name string, allowedPorts []string) error {
 			return err
 		}
 	}
-	return nil
+	return gce.patchFirewallExtras(fwName, config.extras())
 }
 
 // RemoveFirewall removes a global firewall rule
@@ -276,15 +414,16 @@ func (gce *GCEClient) GetHttpHealthCheck(name string) (*compute.HttpHealthCheck,
 }
 
 // CreateHttpHealthCheck creates the given HttpHealthCheck.
-func (gce *GCEClient) CreateHttpHealthCheck(name string, port string) error {
+func (gce *GCEClient) CreateHttpHealthCheck(name string, port string, path string) error {
 	hcName := makeHttpHealthCheckName(name)
 	hcPort, err := strconv.ParseInt(port, 10, 64)
 	if err != nil {
 		hcPort = 80
 	}
 	hc := &compute.HttpHealthCheck{
-		Name: hcName,
-		Port: hcPort,
+		Name:        hcName,
+		Port:        hcPort,
+		RequestPath: path,
 	}
 	op, err := gce.service.HttpHealthChecks.Insert(gce.projectID, hc).Do()
 	if err != nil {
@@ -294,15 +433,16 @@ func (gce *GCEClient) CreateHttpHealthCheck(name string, port string) error {
 }
 
 // UpdateHttpHealthCheck applies the given HttpHealthCheck as an update.
-func (gce *GCEClient) UpdateHttpHealthCheck(name string, port string) error {
+func (gce *GCEClient) UpdateHttpHealthCheck(name string, port string, path string) error {
 	hcName := makeHttpHealthCheckName(name)
 	hcPort, err := strconv.ParseInt(port, 10, 64)
 	if err != nil {
 		hcPort = 80
 	}
 	hc := &compute.HttpHealthCheck{
-		Name: hcName,
-		Port: hcPort,
+		Name:        hcName,
+		Port:        hcPort,
+		RequestPath: path,
 	}
 	op, err := gce.service.HttpHealthChecks.Update(gce.projectID, hcName, hc).Do()
 	if err != nil {
@@ -338,32 +478,50 @@ func zonify(zone string, name string) string {
 	return strings.Join([]string{zone, name}, "-")
 }
 
-// CreateBackendService creates the given BackendService.
-func (gce *GCEClient) CreateBackendService(name string, zones []string) error {
-	bsName := makeBackendServiceName(name)
-
-	// prepare backends
+// makeBackends returns one backend (instance group) per zone.
+// Zones whose instance group doesn't exist are skipped, as groups are added as backends once created.
+func (gce *GCEClient) makeBackends(name string, zones []string) ([]*compute.Backend, error) {
 	var backends []*compute.Backend
-	// one backend (instance group) per zone
 	for _, zone := range zones {
 		// instance groups have been previously zonified
-		ig, _ := gce.GetInstanceGroupForZone(zonify(zone, name), zone)
+		ig, err := gce.GetInstanceGroupForZone(zonify(zone, name), zone)
+		if err != nil {
+			if isHTTPErrorCode(err, http.StatusNotFound) {
+				glog.Warningf("Instance group [%s] doesn't exist in zone [%s]. Skipping backend..", name, zone)
+				continue
+			}
+			return nil, err
+		}
 		backends = append(backends, &compute.Backend{
 			Description: zone,
 			Group:       ig.SelfLink,
 		})
 	}
+	return backends, nil
+}
 
-	hc, _ := gce.GetHttpHealthCheck(name)
+// CreateBackendService creates the given BackendService.
+func (gce *GCEClient) CreateBackendService(name string, zones []string, timeoutSec int64) error {
+	bsName := makeBackendServiceName(name)
+
+	backends, err := gce.makeBackends(name, zones)
+	if err != nil {
+		return err
+	}
+
+	hc, err := gce.GetHttpHealthCheck(name)
+	if err != nil {
+		return err
+	}
 
 	// prepare backend service
 	bs := &compute.BackendService{
 		Backends:     backends,
 		HealthChecks: []string{hc.SelfLink},
 		Name:         bsName,
-		PortName:     servicePort,
+		PortName:     ServicePortName,
 		Protocol:     "HTTP",
-		TimeoutSec:   10, // TODO make configurable
+		TimeoutSec:   timeoutSec,
 	}
 	op, err := gce.service.BackendServices.Insert(gce.projectID, bs).Do()
 	if err != nil {
@@ -373,30 +531,34 @@ func (gce *GCEClient) CreateBackendService(name string, zones []string) error {
 }
 
 // UpdateBackendService applies the given BackendService as an update to an existing service.
-func (gce *GCEClient) UpdateBackendService(name string, zones []string) error {
+func (gce *GCEClient) UpdateBackendService(name string, zones []string, timeoutSec int64) error {
 	bsName := makeBackendServiceName(name)
 
-	// prepare backends
-	var backends []*compute.Backend
-	// one backend (instance group) per zone
-	for _, zone := range zones {
-		// instance groups have been previously zonified
-		ig, _ := gce.GetInstanceGroupForZone(zonify(zone, name), zone)
-		backends = append(backends, &compute.Backend{
-			Description: zone,
-			Group:       ig.SelfLink,
-		})
+	backends, err := gce.makeBackends(name, zones)
+	if err != nil {
+		return err
+	}
+
+	hc, err := gce.GetHttpHealthCheck(name)
+	if err != nil {
+		return err
 	}
 
-	hc, _ := gce.GetHttpHealthCheck(name)
+	// GCE rejects updates that don't carry the latest fingerprint
+	actual, err := gce.GetBackendService(name)
+	if err != nil {
+		return err
+	}
 
 	// prepare backend service
 	bs := &compute.BackendService{
 		Backends:     backends,
 		HealthChecks: []string{hc.SelfLink},
 		Name:         bsName,
-		PortName:     servicePort,
+		PortName:     ServicePortName,
 		Protocol:     "HTTP",
+		TimeoutSec:   timeoutSec,
+		Fingerprint:  actual.Fingerprint,
 	}
 
 	op, err := gce.service.BackendServices.Update(gce.projectID, bsName, bs).Do()
@@ -406,6 +568,100 @@ func (gce *GCEClient) UpdateBackendService(name string, zones []string) error {
 	return gce.waitForGlobalOp(op)
 }
 
+// AddInstanceGroupToBackendService adds a zone's instance group as a backend of the given BackendService,
+// unless it's there already. There's nothing to do if the BackendService doesn't exist yet.
+func (gce *GCEClient) AddInstanceGroupToBackendService(name string, zone string) error {
+	bs, err := gce.GetBackendService(name)
+	if err != nil {
+		if isHTTPErrorCode(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	}
+	// instance groups have been previously zonified
+	ig, err := gce.GetInstanceGroupForZone(zonify(zone, name), zone)
+	if err != nil {
+		return err
+	}
+	for _, backend := range bs.Backends {
+		if backend.Group == ig.SelfLink {
+			return nil
+		}
+	}
+
+	// fingerprint is kept, as GCE rejects updates that don't carry the latest one
+	bs.Backends = append(bs.Backends, &compute.Backend{
+		Description: zone,
+		Group:       ig.SelfLink,
+	})
+	op, err := gce.service.BackendServices.Update(gce.projectID, bs.Name, bs).Do()
+	if err != nil {
+		return err
+	}
+	return gce.waitForGlobalOp(op)
+}
+
+// RemoveInstanceGroupFromBackendService removes a zone's instance group from the backends of the given
+// BackendService, if it's there.
+func (gce *GCEClient) RemoveInstanceGroupFromBackendService(name string, zone string) error {
+	bs, err := gce.GetBackendService(name)
+	if err != nil {
+		if isHTTPErrorCode(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	}
+	// backend.Group is an instance group URL, e.g. ".../zones/us-east1-d/instanceGroups/us-east1-d-web"
+	suffix := "/zones/" + zone + "/instanceGroups/" + zonify(zone, name)
+	backends := []*compute.Backend{}
+	for _, backend := range bs.Backends {
+		if !strings.HasSuffix(backend.Group, suffix) {
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) == len(bs.Backends) {
+		return nil
+	}
+
+	// fingerprint is kept, as GCE rejects updates that don't carry the latest one
+	bs.Backends = backends
+	// an empty list would be left out otherwise
+	bs.ForceSendFields = []string{"Backends"}
+	op, err := gce.service.BackendServices.Update(gce.projectID, bs.Name, bs).Do()
+	if err != nil {
+		return err
+	}
+	return gce.waitForGlobalOp(op)
+}
+
+// GetBackendServiceHealth returns the health state of each instance, per zone, behind the given BackendService.
+// e.g. health := states["my-instance"]
+func (gce *GCEClient) GetBackendServiceHealth(name string, zones []string) (map[string]string, error) {
+	bsName := makeBackendServiceName(name)
+	states := make(map[string]string)
+	for _, zone := range zones {
+		// instance groups have been previously zonified
+		ig, err := gce.GetInstanceGroupForZone(zonify(zone, name), zone)
+		if err != nil {
+			if isHTTPErrorCode(err, http.StatusNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		health, err := gce.service.BackendServices.GetHealth(gce.projectID, bsName,
+			&compute.ResourceGroupReference{Group: ig.SelfLink}).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, status := range health.HealthStatus {
+			// status.Instance is an instance URL, so replace is needed here
+			split := strings.Split(status.Instance, "/")
+			states[split[len(split)-1]] = status.HealthState
+		}
+	}
+	return states, nil
+}
+
 // RemoveBackendService deletes the given BackendService by name.
 func (gce *GCEClient) RemoveBackendService(name string) error {
 	bsName := makeBackendServiceName(name)
@@ -428,7 +684,10 @@ func (gce *GCEClient) GetUrlMap(name string) (*compute.UrlMap, error) {
 
 // CreateUrlMap creates an url map, using the given backend service as the default service.
 func (gce *GCEClient) CreateUrlMap(name string) error {
-	backend, _ := gce.GetBackendService(name)
+	backend, err := gce.GetBackendService(name)
+	if err != nil {
+		return err
+	}
 	urlMap := &compute.UrlMap{
 		Name:           name,
 		DefaultService: backend.SelfLink,
@@ -443,6 +702,29 @@ func (gce *GCEClient) CreateUrlMap(name string) error {
 	return nil
 }
 
+// UpdateUrlMap points an existing url map to the given backend service as the default service.
+func (gce *GCEClient) UpdateUrlMap(name string) error {
+	backend, err := gce.GetBackendService(name)
+	if err != nil {
+		return err
+	}
+	// GCE rejects updates that don't carry the latest fingerprint
+	actual, err := gce.GetUrlMap(name)
+	if err != nil {
+		return err
+	}
+	urlMap := &compute.UrlMap{
+		Name:           name,
+		DefaultService: backend.SelfLink,
+		Fingerprint:    actual.Fingerprint,
+	}
+	op, err := gce.service.UrlMaps.Update(gce.projectID, name, urlMap).Do()
+	if err != nil {
+		return err
+	}
+	return gce.waitForGlobalOp(op)
+}
+
 // RemoveUrlMap deletes a url map by name.
 func (gce *GCEClient) RemoveUrlMap(name string) error {
 	op, err := gce.service.UrlMaps.Delete(gce.projectID, name).Do()
@@ -465,7 +747,10 @@ func (gce *GCEClient) GetTargetHttpProxy(name string) (*compute.TargetHttpProxy,
 
 // CreateTargetHttpProxy creates and returns a TargetHttpProxy with the given UrlMap.
 func (gce *GCEClient) CreateTargetHttpProxy(name string) error {
-	urlMap, _ := gce.GetUrlMap(name)
+	urlMap, err := gce.GetUrlMap(name)
+	if err != nil {
+		return err
+	}
 	thpName := makeHttpProxyName(name)
 	proxy := &compute.TargetHttpProxy{
 		Name:   thpName,
@@ -482,6 +767,21 @@ func (gce *GCEClient) CreateTargetHttpProxy(name string) error {
 	return nil
 }
 
+// SetUrlMapForTargetHttpProxy points the TargetHttpProxy by name to the given UrlMap.
+func (gce *GCEClient) SetUrlMapForTargetHttpProxy(name string) error {
+	urlMap, err := gce.GetUrlMap(name)
+	if err != nil {
+		return err
+	}
+	thpName := makeHttpProxyName(name)
+	op, err := gce.service.TargetHttpProxies.SetUrlMap(gce.projectID, thpName,
+		&compute.UrlMapReference{UrlMap: urlMap.SelfLink}).Do()
+	if err != nil {
+		return err
+	}
+	return gce.waitForGlobalOp(op)
+}
+
 // RemoveTargetHttpProxy removes the TargetHttpProxy by name.
 func (gce *GCEClient) RemoveTargetHttpProxy(name string) error {
 	thpName := makeHttpProxyName(name)
@@ -496,17 +796,191 @@ func (gce *GCEClient) RemoveTargetHttpProxy(name string) error {
 	return gce.waitForGlobalOp(op)
 }
 
+// TargetHttpsProxy management
+
+// GetTargetHttpsProxy returns the TargetHttpsProxy by name.
+func (gce *GCEClient) GetTargetHttpsProxy(name string) (*compute.TargetHttpsProxy, error) {
+	thpName := makeHttpsProxyName(name)
+	return gce.service.TargetHttpsProxies.Get(gce.projectID, thpName).Do()
+}
+
+// CreateTargetHttpsProxy creates a TargetHttpsProxy with the given UrlMap and SSL certificates.
+func (gce *GCEClient) CreateTargetHttpsProxy(name string, certificates []string) error {
+	urlMap, err := gce.GetUrlMap(name)
+	if err != nil {
+		return err
+	}
+	thpName := makeHttpsProxyName(name)
+	proxy := &compute.TargetHttpsProxy{
+		Name:            thpName,
+		UrlMap:          urlMap.SelfLink,
+		SslCertificates: gce.makeSslCertificateURLs(certificates),
+	}
+	op, err := gce.service.TargetHttpsProxies.Insert(gce.projectID, proxy).Do()
+	if err != nil {
+		return err
+	}
+	return gce.waitForGlobalOp(op)
+}
+
+// SetSslCertificatesForTargetHttpsProxy replaces the SSL certificates of the TargetHttpsProxy by name.
+func (gce *GCEClient) SetSslCertificatesForTargetHttpsProxy(name string, certificates []string) error {
+	thpName := makeHttpsProxyName(name)
+	op, err := gce.service.TargetHttpsProxies.SetSslCertificates(gce.projectID, thpName,
+		&compute.TargetHttpsProxiesSetSslCertificatesRequest{
+			SslCertificates: gce.makeSslCertificateURLs(certificates),
+		}).Do()
+	if err != nil {
+		return err
+	}
+	return gce.waitForGlobalOp(op)
+}
+
+// RemoveTargetHttpsProxy removes the TargetHttpsProxy by name.
+func (gce *GCEClient) RemoveTargetHttpsProxy(name string) error {
+	thpName := makeHttpsProxyName(name)
+	op, err := gce.service.TargetHttpsProxies.Delete(gce.projectID, thpName).Do()
+	if err != nil {
+		if isHTTPErrorCode(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	}
+	return gce.waitForGlobalOp(op)
+}
+
 // GlobalForwardingRule management
 
-// CreateGlobalForwardingRule creates and returns a GlobalForwardingRule that points to the given TargetHttpProxy.
+// GlobalAddress management
+
+// GetGlobalAddress returns the global address reserved for a load-balancer by name.
+func (gce *GCEClient) GetGlobalAddress(name string) (*compute.Address, error) {
+	return gce.service.GlobalAddresses.Get(gce.projectID, makeGlobalAddressName(name)).Do()
+}
+
+// ReserveGlobalAddress reserves a global address shared by all of a load-balancer's forwarding rules,
+// unless it's reserved already, and returns the IP address.
+func (gce *GCEClient) ReserveGlobalAddress(name string) (string, error) {
+	address, err := gce.GetGlobalAddress(name)
+	if err == nil {
+		return address.Address, nil
+	}
+	if !isHTTPErrorCode(err, http.StatusNotFound) {
+		return "", err
+	}
+	op, err := gce.service.GlobalAddresses.Insert(gce.projectID, &compute.Address{
+		Name:        makeGlobalAddressName(name),
+		Description: ManagedDescription,
+	}).Do()
+	if err != nil {
+		return "", err
+	}
+	if err = gce.waitForGlobalOp(op); err != nil {
+		return "", err
+	}
+	address, err = gce.GetGlobalAddress(name)
+	if err != nil {
+		return "", err
+	}
+	return address.Address, nil
+}
+
+// ReleaseGlobalAddress releases the global address reserved for a load-balancer by name.
+func (gce *GCEClient) ReleaseGlobalAddress(name string) error {
+	op, err := gce.service.GlobalAddresses.Delete(gce.projectID, makeGlobalAddressName(name)).Do()
+	if err != nil {
+		if isHTTPErrorCode(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	}
+	return gce.waitForGlobalOp(op)
+}
+
+// GlobalForwardingRule management
+
+// CreateGlobalForwardingRule creates, or fixes, a GlobalForwardingRule that points to the given TargetHttpProxy.
 func (gce *GCEClient) CreateGlobalForwardingRule(name string, portRange string) error {
-	thp, _ := gce.GetTargetHttpProxy(name)
-	fwdName := makeForwardingRuleName(name)
+	thp, err := gce.GetTargetHttpProxy(name)
+	if err != nil {
+		return err
+	}
+	ip, err := gce.ReserveGlobalAddress(name)
+	if err != nil {
+		return err
+	}
+	return gce.createGlobalForwardingRule(makeForwardingRuleNameForPort(name, portRange), portRange, thp.SelfLink, ip)
+}
+
+// CreateHttpsGlobalForwardingRule creates, or fixes, a GlobalForwardingRule that points to the given TargetHttpsProxy.
+func (gce *GCEClient) CreateHttpsGlobalForwardingRule(name string) error {
+	thp, err := gce.GetTargetHttpsProxy(name)
+	if err != nil {
+		return err
+	}
+	ip, err := gce.ReserveGlobalAddress(name)
+	if err != nil {
+		return err
+	}
+	return gce.createGlobalForwardingRule(makeHttpsForwardingRuleName(name), httpsFrontendPort, thp.SelfLink, ip)
+}
+
+// ListGlobalForwardingRulesForTarget lists all GlobalForwardingRules pointing to the given target URL.
+func (gce *GCEClient) ListGlobalForwardingRulesForTarget(target string) ([]*compute.ForwardingRule, error) {
+	var rules []*compute.ForwardingRule
+	pageToken := ""
+	for {
+		list, err := gce.service.GlobalForwardingRules.List(gce.projectID).PageToken(pageToken).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range list.Items {
+			if rule.Target == target {
+				rules = append(rules, rule)
+			}
+		}
+		if list.NextPageToken == "" {
+			return rules, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+// createGlobalForwardingRule creates a GlobalForwardingRule, or fixes an existing one by the same name.
+// Forwarding rules can't be updated, so one with the wrong port range or IP address is replaced.
+func (gce *GCEClient) createGlobalForwardingRule(fwdName string, portRange string, target string, ip string) error {
+	actual, err := gce.service.GlobalForwardingRules.Get(gce.projectID, fwdName).Do()
+	if err == nil {
+		if strings.Split(actual.PortRange, "-")[0] != portRange {
+			glog.Warningf("Global forwarding rule [%s] has port range [%s] instead of [%s]. Replacing..", fwdName, actual.PortRange, portRange)
+			if err := gce.removeGlobalForwardingRule(fwdName); err != nil {
+				return err
+			}
+		} else if actual.IPAddress != ip {
+			glog.Warningf("Global forwarding rule [%s] has IP address [%s] instead of [%s]. Replacing..", fwdName, actual.IPAddress, ip)
+			if err := gce.removeGlobalForwardingRule(fwdName); err != nil {
+				return err
+			}
+		} else if actual.Target != target {
+			glog.Warningf("Global forwarding rule [%s] has drifted from its target. Updating..", fwdName)
+			op, err := gce.service.GlobalForwardingRules.SetTarget(gce.projectID, fwdName, &compute.TargetReference{Target: target}).Do()
+			if err != nil {
+				return err
+			}
+			return gce.waitForGlobalOp(op)
+		} else {
+			return nil
+		}
+	} else if !isHTTPErrorCode(err, http.StatusNotFound) {
+		return err
+	}
+
 	rule := &compute.ForwardingRule{
 		Name:       fwdName,
+		IPAddress:  ip,
 		IPProtocol: "TCP",
-		PortRange:  "80", // TODO enable portRange
-		Target:     thp.SelfLink,
+		PortRange:  portRange,
+		Target:     target,
 	}
 	op, err := gce.service.GlobalForwardingRules.Insert(gce.projectID, rule).Do()
 	if err != nil {
@@ -518,9 +992,39 @@ func (gce *GCEClient) CreateGlobalForwardingRule(name string, portRange string)
 	return nil
 }
 
+// GetGlobalForwardingRule returns the GlobalForwardingRule by name.
+func (gce *GCEClient) GetGlobalForwardingRule(name string) (*compute.ForwardingRule, error) {
+	fwdName := makeForwardingRuleName(name)
+	return gce.service.GlobalForwardingRules.Get(gce.projectID, fwdName).Do()
+}
+
+// ListGlobalForwardingRules lists all of a load-balancer's GlobalForwardingRules,
+// i.e. one per HTTP frontend port along with the HTTPS one, if any.
+func (gce *GCEClient) ListGlobalForwardingRules(name string) ([]*compute.ForwardingRule, error) {
+	thp, err := gce.GetTargetHttpProxy(name)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := gce.ListGlobalForwardingRulesForTarget(thp.SelfLink)
+	if err != nil {
+		return nil, err
+	}
+	https, err := gce.service.GlobalForwardingRules.Get(gce.projectID, makeHttpsForwardingRuleName(name)).Do()
+	if err != nil {
+		if isHTTPErrorCode(err, http.StatusNotFound) {
+			return rules, nil
+		}
+		return nil, err
+	}
+	return append(rules, https), nil
+}
+
 // RemoveGlobalForwardingRule deletes the GlobalForwardingRule by name.
 func (gce *GCEClient) RemoveGlobalForwardingRule(name string) error {
-	fwdName := makeForwardingRuleName(name)
+	return gce.removeGlobalForwardingRule(makeForwardingRuleName(name))
+}
+
+func (gce *GCEClient) removeGlobalForwardingRule(fwdName string) error {
 	op, err := gce.service.GlobalForwardingRules.Delete(gce.projectID, fwdName).Do()
 	if err != nil {
 		if isHTTPErrorCode(err, http.StatusNotFound) {
@@ -531,100 +1035,148 @@ func (gce *GCEClient) RemoveGlobalForwardingRule(name string) error {
 	return gce.waitForGlobalOp(op)
 }
 
-func (gce *GCEClient) CreateOrUpdateLoadBalancer(name string, port string, zones []string) error {
-	// create or update firewall rule
-	// try to update first
-	if err := gce.UpdateFirewall(name, []string{port}); err != nil {
-		// couldn't update most probably because firewall didn't exist
-		if err := gce.CreateFirewall(name, []string{port}); err != nil {
-			// couldn't update or create
-			return err
-		}
+// CreateOrUpdateLoadBalancer provisions a load-balancer step by step, journaling progress
+// so a failed or interrupted provisioning resumes at the step that didn't complete.
+func (gce *GCEClient) CreateOrUpdateLoadBalancer(name string, port string, zones []string, config *LoadBalancerConfig) error {
+	return gce.runPlan(name, gce.provisioningPlan(name, port, zones, config), fingerprint(port, zones, config))
+}
+
+// UpdateLoadBalancerConfig applies settings to an existing load-balancer.
+// Only components whose settings differ from the desired ones are changed.
+func (gce *GCEClient) UpdateLoadBalancerConfig(name string, port string, zones []string, config *LoadBalancerConfig) error {
+	// firewall rule
+	if err := gce.reconcileFirewall(name, port, config.firewall()); err != nil {
+		return err
 	}
-	glog.Infof("Created/updated firewall rule with success.")
 
-	// create or update HTTP health-check
-	// try to update first
-	if err := gce.UpdateHttpHealthCheck(name, port); err != nil {
-		// couldn't update most probably because health-check didn't exist
-		if err := gce.CreateHttpHealthCheck(name, port); err != nil {
-			// couldn't update or create
+	// HTTP health-check
+	hc, err := gce.GetHttpHealthCheck(name)
+	if err != nil {
+		return err
+	}
+	if hc.RequestPath != config.healthCheckPath() {
+		if err := gce.UpdateHttpHealthCheck(name, port, config.healthCheckPath()); err != nil {
 			return err
 		}
+		glog.Infof("Updated HTTP health-check with success.")
 	}
-	glog.Infof("Created/updated HTTP health-check with success.")
 
-	// create or update backend service, only for allowed zones
-	// try to update first
-	if err := gce.UpdateBackendService(name, zones); err != nil {
-		// couldn't update most probably because backend service didn't exist
-		if err := gce.CreateBackendService(name, zones); err != nil {
-			// couldn't update or create
+	// backend service
+	bs, err := gce.GetBackendService(name)
+	if err != nil {
+		return err
+	}
+	if bs.TimeoutSec != config.timeoutSec() {
+		if err := gce.UpdateBackendService(name, zones, config.timeoutSec()); err != nil {
 			return err
 		}
+		glog.Infof("Updated backend service with success.")
 	}
-	glog.Infof("Created/updated backend service with success.")
 
-	// create url map
-	if err := gce.CreateUrlMap(name); err != nil {
-		return err
-	}
-	glog.Infof("Created URL map with success.")
+	// global forwarding rules and HTTPS frontend
+	return gce.applyFrontends(name, config)
+}
 
-	// create target http proxy
-	if err := gce.CreateTargetHttpProxy(name); err != nil {
+// applyFrontends makes sure there's one global forwarding rule per desired HTTP frontend port,
+// and an HTTPS proxy and forwarding rule if SSL certificates are desired.
+func (gce *GCEClient) applyFrontends(name string, config *LoadBalancerConfig) error {
+	// HTTP frontends
+	thp, err := gce.GetTargetHttpProxy(name)
+	if err != nil {
 		return err
 	}
-	glog.Infof("Created target HTTP proxy with success.")
-
-	// TODO make the following optional
-	// create global forwarding rule
-	if err := gce.CreateGlobalForwardingRule(name, port); err != nil {
+	rules, err := gce.ListGlobalForwardingRulesForTarget(thp.SelfLink)
+	if err != nil {
 		return err
 	}
-	glog.Infof("Created global forwarding rule with success.")
-
-	return nil
+	ports := config.frontendPorts()
+	existing := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		port := strings.Split(rule.PortRange, "-")[0]
+		existing[port] = true
+		if !containsString(ports, port) {
+			if err := gce.removeGlobalForwardingRule(rule.Name); err != nil {
+				return err
+			}
+			glog.Infof("Removed global forwarding rule for port [%s] with success.", port)
+		}
+	}
+	for _, port := range ports {
+		if !existing[port] {
+			if err := gce.CreateGlobalForwardingRule(name, port); err != nil {
+				return err
+			}
+			glog.Infof("Created global forwarding rule for port [%s] with success.", port)
+		}
+	}
 
+	// HTTPS frontend
+	certificates := config.certificates()
+	if len(certificates) == 0 {
+		if err := gce.removeGlobalForwardingRule(makeHttpsForwardingRuleName(name)); err != nil {
+			return err
+		}
+		return gce.RemoveTargetHttpsProxy(name)
+	}
+	proxy, err := gce.GetTargetHttpsProxy(name)
+	if err != nil {
+		if !isHTTPErrorCode(err, http.StatusNotFound) {
+			return err
+		}
+		if err := gce.CreateTargetHttpsProxy(name, certificates); err != nil {
+			return err
+		}
+		glog.Infof("Created target HTTPS proxy with success.")
+	} else if !reflect.DeepEqual(proxy.SslCertificates, gce.makeSslCertificateURLs(certificates)) {
+		if err := gce.SetSslCertificatesForTargetHttpsProxy(name, certificates); err != nil {
+			return err
+		}
+		glog.Infof("Updated target HTTPS proxy SSL certificates with success.")
+	}
+	return gce.CreateHttpsGlobalForwardingRule(name)
 }
 
+// RemoveLoadBalancer removes a load-balancer in reverse dependency order.
+// If its provisioning never completed, only the steps started are rolled back.
 func (gce *GCEClient) RemoveLoadBalancer(name string) error {
-	// TODO make the following optional according to creation
-	// remove global forwarding rule
-	if err := gce.RemoveGlobalForwardingRule(name); err != nil {
-		return err
-	}
-	glog.Infof("Removed global forwarding rule with success.")
+	return gce.rollbackPlan(name, gce.provisioningPlan(name, "", nil, nil))
+}
 
-	// remove target http proxy
-	if err := gce.RemoveTargetHttpProxy(name); err != nil {
+// removeFrontends removes global forwarding rules, along with any HTTPS frontend
+func (gce *GCEClient) removeFrontends(name string) error {
+	// remove global forwarding rules, one per HTTP frontend port
+	if thp, err := gce.GetTargetHttpProxy(name); err == nil {
+		rules, err := gce.ListGlobalForwardingRulesForTarget(thp.SelfLink)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if err := gce.removeGlobalForwardingRule(rule.Name); err != nil {
+				return err
+			}
+		}
+	} else if !isHTTPErrorCode(err, http.StatusNotFound) {
 		return err
 	}
-	glog.Infof("Removed target HTTP proxy with success.")
-
-	// remove url map
-	if err := gce.RemoveUrlMap(name); err != nil {
+	if err := gce.RemoveGlobalForwardingRule(name); err != nil {
 		return err
 	}
-	glog.Infof("Removed URL map with success.")
+	glog.Infof("Removed global forwarding rule with success.")
 
-	// remove backend service
-	if err := gce.RemoveBackendService(name); err != nil {
+	// remove HTTPS frontend, if any
+	if err := gce.removeGlobalForwardingRule(makeHttpsForwardingRuleName(name)); err != nil {
 		return err
 	}
-	glog.Infof("Removed backend service with success.")
-
-	// remove HTTP health-check
-	if err := gce.RemoveHttpHealthCheck(name); err != nil {
+	if err := gce.RemoveTargetHttpsProxy(name); err != nil {
 		return err
 	}
-	glog.Infof("Removed HTTP health-check with success.")
+	glog.Infof("Removed target HTTPS proxy with success.")
 
-	// remove firewall rule
-	if err := gce.RemoveFirewall(name); err != nil {
+	// release the address shared by forwarding rules, once none are left
+	if err := gce.ReleaseGlobalAddress(name); err != nil {
 		return err
 	}
-	glog.Infof("Removed firewall rule with success.")
+	glog.Infof("Released global address with success.")
 
 	return nil
 }
@@ -652,6 +1204,21 @@ func makeHostURL(projectID, zone, host string) string {
 		projectID, zone, host)
 }
 
+// ResourceNames returns the names of load-balancer resources for a name, keyed by kind
+func ResourceNames(name string) map[string]string {
+	return map[string]string{
+		"firewall":              makeFirewallName(name),
+		"http_health_check":     makeHttpHealthCheckName(name),
+		"backend_service":       makeBackendServiceName(name),
+		"url_map":               name,
+		"target_http_proxy":     makeHttpProxyName(name),
+		"target_https_proxy":    makeHttpsProxyName(name),
+		"forwarding_rule":       makeForwardingRuleName(name),
+		"https_forwarding_rule": makeHttpsForwardingRuleName(name),
+		"global_address":        makeGlobalAddressName(name),
+	}
+}
+
 func makeName(prefix string, name string) string {
 	return strings.Join([]string{prefix, name}, "-")
 }
@@ -676,17 +1243,60 @@ func makeHttpProxyName(name string) string {
 	return makeName("http-proxy", name)
 }
 
+func makeHttpsProxyName(name string) string {
+	return makeName("https-proxy", name)
+}
+
 func makeForwardingRuleName(name string) string {
 	return makeName("fwd-rule", name)
 }
 
+// makeForwardingRuleNameForPort keeps the default frontend port rule name as is,
+// e.g. "fwd-rule-web" for port 80, "fwd-rule-web-8080" for port 8080
+func makeForwardingRuleNameForPort(name string, port string) string {
+	if port == defaultFrontendPort {
+		return makeForwardingRuleName(name)
+	}
+	return makeName(makeForwardingRuleName(name), port)
+}
+
+func makeHttpsForwardingRuleName(name string) string {
+	return makeName("fwd-rule-https", name)
+}
+
+func makeGlobalAddressName(name string) string {
+	return makeName("address", name)
+}
+
+func (gce *GCEClient) makeSslCertificateURLs(certificates []string) []string {
+	var urls []string
+	for _, certificate := range certificates {
+		urls = append(urls, fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/global/sslCertificates/%s", gce.projectID, certificate))
+	}
+	return urls
+}
+
+// containsString returns whether a slice of strings contains a specified string
+func containsString(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
+
 // makeFirewallObject returns a pre-populated instance of *computeFirewall
-func (gce *GCEClient) makeFirewallObject(name string, allowedPorts []string) (*compute.Firewall, error) {
+func (gce *GCEClient) makeFirewallObject(name string, allowedPorts []string, config *FirewallConfig) (*compute.Firewall, error) {
+	if len(config.targetTags()) > 0 && len(config.extras().TargetServiceAccounts) > 0 {
+		return nil, ErrFirewallTargets
+	}
 	firewall := &compute.Firewall{
 		Name:         name,
-		Description:  "Generated by consul-lb-gce",
+		Description:  ManagedDescription,
 		Network:      gce.networkURL,
-		SourceRanges: []string{"130.211.0.0/22"}, // allow load-balancers alone
+		SourceRanges: config.sourceRanges(), // defaults to load-balancers alone
+		TargetTags:   config.targetTags(),
 		Allowed: []*compute.FirewallAllowed{
 			{
 				IPProtocol: "tcp",
@@ -697,15 +1307,24 @@ func (gce *GCEClient) makeFirewallObject(name string, allowedPorts []string) (*c
 	return firewall, nil
 }
 
+// IsNotFound returns whether err means a resource doesn't exist
+func IsNotFound(err error) bool {
+	return isHTTPErrorCode(err, http.StatusNotFound)
+}
+
 func isHTTPErrorCode(err error, code int) bool {
 	apiErr, ok := err.(*googleapi.Error)
 	return ok && apiErr.Code == code
 }
 
-func waitForOp(op *compute.Operation, getOperation func(operationName string) (*compute.Operation, error)) error {
+func waitForOp(op *compute.Operation, getOperation func(operationName string) (*compute.Operation, error)) (err error) {
 	if op == nil {
 		return fmt.Errorf("operation must not be nil")
 	}
+	start := time.Now()
+	defer func() {
+		observeOperation(op, start, err)
+	}()
 
 	if opIsDone(op) {
 		return getErrorFromOp(op)
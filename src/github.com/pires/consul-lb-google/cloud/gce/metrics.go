@@ -0,0 +1,83 @@
+package gce
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pires/consul-lb-google/metrics"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+var (
+	apiCalls = metrics.NewCounterVec("consul_lb_gce_api_calls_total",
+		"GCE API calls, by HTTP method, resource and response code.", "method", "resource", "code")
+	apiCallDuration = metrics.NewHistogramVec("consul_lb_gce_api_call_duration_seconds",
+		"How long GCE API calls took, by HTTP method and resource.", metrics.DefBuckets, "method", "resource")
+	operationDuration = metrics.NewHistogramVec("consul_lb_gce_operation_duration_seconds",
+		"How long GCE operations took to complete, by operation type, resource and result.", metrics.DefBuckets, "operation", "resource", "result")
+)
+
+// instrumentedTransport records every GCE API call
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	resource := resourceFromPath(req.URL.Path)
+	apiCallDuration.Observe(time.Since(start).Seconds(), req.Method, resource)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	apiCalls.Inc(req.Method, resource, code)
+	return resp, err
+}
+
+// resourceFromPath returns the kind of resource an API path is about, along with any custom verb,
+// e.g. "/compute/v1/projects/p/zones/z/instanceGroups/ig/addInstances" returns "instanceGroups/addInstances"
+func resourceFromPath(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] != "projects" {
+			continue
+		}
+		// skip project, and scope if any
+		rest := parts[i+2:]
+		if len(rest) > 0 && rest[0] == "global" {
+			rest = rest[1:]
+		} else if len(rest) > 1 && (rest[0] == "zones" || rest[0] == "regions") {
+			// e.g. a zone itself
+			if len(rest) == 2 {
+				return rest[0]
+			}
+			rest = rest[2:]
+		}
+		switch len(rest) {
+		case 0:
+			return "project"
+		case 1, 2:
+			return rest[0]
+		default:
+			return rest[0] + "/" + rest[2]
+		}
+	}
+	return "unknown"
+}
+
+// observeOperation records how long an operation took to complete since start
+func observeOperation(op *compute.Operation, start time.Time, err error) {
+	resource := "unknown"
+	if op.TargetLink != "" {
+		resource = resourceFromPath(op.TargetLink)
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	operationDuration.Observe(time.Since(start).Seconds(), op.OperationType, resource, result)
+}
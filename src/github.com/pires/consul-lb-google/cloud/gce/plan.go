@@ -0,0 +1,227 @@
+package gce
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Provisioning is how far provisioning of a load-balancer got
+type Provisioning struct {
+	// steps started, keyed by name, along with the fingerprint of the inputs they completed with.
+	// An empty fingerprint means the step was started but didn't complete.
+	Steps map[string]string `json:"steps"`
+	// whether every step completed at least once, i.e. the load-balancer was complete
+	Created bool `json:"created"`
+}
+
+// Journal persists how far provisioning of each load-balancer got,
+// so it can be resumed or rolled back after a failure or crash
+type Journal interface {
+	GetProvisioning(name string) (*Provisioning, bool)
+	PutProvisioning(name string, p *Provisioning) error
+	DeleteProvisioning(name string) error
+}
+
+// memoryJournal is a journal that doesn't survive restarts
+type memoryJournal struct {
+	sync.Mutex
+	provisionings map[string]*Provisioning
+}
+
+// NewMemoryJournal returns a journal that's kept in memory only
+func NewMemoryJournal() Journal {
+	return &memoryJournal{provisionings: make(map[string]*Provisioning)}
+}
+
+func (j *memoryJournal) GetProvisioning(name string) (*Provisioning, bool) {
+	j.Lock()
+	defer j.Unlock()
+	p, ok := j.provisionings[name]
+	if !ok {
+		return nil, false
+	}
+	return p.Copy(), true
+}
+
+func (j *memoryJournal) PutProvisioning(name string, p *Provisioning) error {
+	j.Lock()
+	defer j.Unlock()
+	j.provisionings[name] = p.Copy()
+	return nil
+}
+
+func (j *memoryJournal) DeleteProvisioning(name string) error {
+	j.Lock()
+	defer j.Unlock()
+	delete(j.provisionings, name)
+	return nil
+}
+
+// Copy returns a deep copy, so journals don't share state with callers
+func (p *Provisioning) Copy() *Provisioning {
+	c := &Provisioning{
+		Steps:   make(map[string]string, len(p.Steps)),
+		Created: p.Created,
+	}
+	for k, v := range p.Steps {
+		c.Steps[k] = v
+	}
+	return c
+}
+
+// step is one step of provisioning a load-balancer, along with how to undo it
+type step struct {
+	name     string
+	apply    func() error
+	rollback func() error
+}
+
+// provisioningPlan returns the steps provisioning a load-balancer, in dependency order.
+// Rollbacks don't depend on port, zones or config.
+func (gce *GCEClient) provisioningPlan(name string, port string, zones []string, config *LoadBalancerConfig) []step {
+	return []step{
+		{
+			name: "firewall",
+			apply: func() error {
+				return gce.reconcileFirewall(name, port, config.firewall())
+			},
+			rollback: func() error {
+				// left for operators to manage?
+				if !gce.manageFirewalls {
+					return nil
+				}
+				return gce.RemoveFirewall(name)
+			},
+		},
+		{
+			name: "http_health_check",
+			apply: func() error {
+				return gce.reconcileHttpHealthCheck(name, port, config.healthCheckPath())
+			},
+			rollback: func() error {
+				return gce.RemoveHttpHealthCheck(name)
+			},
+		},
+		{
+			name: "backend_service",
+			apply: func() error {
+				// only for allowed zones
+				return gce.reconcileBackendService(name, zones, config.timeoutSec())
+			},
+			rollback: func() error {
+				return gce.RemoveBackendService(name)
+			},
+		},
+		{
+			name: "url_map",
+			apply: func() error {
+				return gce.reconcileUrlMap(name)
+			},
+			rollback: func() error {
+				return gce.RemoveUrlMap(name)
+			},
+		},
+		{
+			name: "target_http_proxy",
+			apply: func() error {
+				return gce.reconcileTargetHttpProxy(name)
+			},
+			rollback: func() error {
+				return gce.RemoveTargetHttpProxy(name)
+			},
+		},
+		{
+			name: "frontends",
+			apply: func() error {
+				// global forwarding rules and HTTPS frontend
+				return gce.applyFrontends(name, config)
+			},
+			rollback: func() error {
+				return gce.removeFrontends(name)
+			},
+		},
+	}
+}
+
+// fingerprint identifies the inputs of a plan, so steps completed with other inputs are re-applied
+func fingerprint(port string, zones []string, config *LoadBalancerConfig) string {
+	b, _ := json.Marshal(struct {
+		Port   string
+		Zones  []string
+		Config *LoadBalancerConfig
+	}{port, zones, config})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// runPlan applies a load-balancer's provisioning steps in order, journaling each one.
+// Steps completed with the same inputs, e.g. before a crash, are skipped.
+func (gce *GCEClient) runPlan(name string, plan []step, fp string) error {
+	p, ok := gce.journal.GetProvisioning(name)
+	if !ok {
+		// load-balancer may have been provisioned before journaling
+		_, err := gce.GetTargetHttpProxy(name)
+		p = &Provisioning{
+			Steps:   make(map[string]string, len(plan)),
+			Created: err == nil,
+		}
+	}
+
+	for _, s := range plan {
+		if p.Steps[s.name] == fp {
+			glog.Infof("Skipping step [%s] of load-balancer [%s], completed before.", s.name, name)
+			continue
+		}
+		// mark as started, so it's rolled back even if it fails half-way
+		if _, ok := p.Steps[s.name]; !ok {
+			p.Steps[s.name] = ""
+			if err := gce.journal.PutProvisioning(name, p); err != nil {
+				return err
+			}
+		}
+		if err := s.apply(); err != nil {
+			glog.Errorf("Provisioning load-balancer [%s] failed at step [%s]. %s", name, s.name, err)
+			return err
+		}
+		glog.Infof("Applied step [%s] of load-balancer [%s] with success.", s.name, name)
+		p.Steps[s.name] = fp
+		if err := gce.journal.PutProvisioning(name, p); err != nil {
+			return err
+		}
+	}
+
+	// done, so nothing's left to resume
+	p.Created = true
+	p.Steps = make(map[string]string)
+	return gce.journal.PutProvisioning(name, p)
+}
+
+// rollbackPlan undoes a load-balancer's provisioning steps in reverse order.
+// Unless the load-balancer was complete, only steps started are undone.
+func (gce *GCEClient) rollbackPlan(name string, plan []step) error {
+	p, ok := gce.journal.GetProvisioning(name)
+	for i := len(plan) - 1; i >= 0; i-- {
+		s := plan[i]
+		if ok && !p.Created {
+			if _, started := p.Steps[s.name]; !started {
+				continue
+			}
+		}
+		if err := s.rollback(); err != nil {
+			glog.Errorf("Rolling back load-balancer [%s] failed at step [%s]. %s", name, s.name, err)
+			return err
+		}
+		glog.Infof("Rolled back step [%s] of load-balancer [%s] with success.", s.name, name)
+		if ok {
+			delete(p.Steps, s.name)
+			if err := gce.journal.PutProvisioning(name, p); err != nil {
+				return err
+			}
+		}
+	}
+	return gce.journal.DeleteProvisioning(name)
+}
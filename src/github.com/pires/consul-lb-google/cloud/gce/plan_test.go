@@ -0,0 +1,201 @@
+package gce
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// newTestClient returns a client of a local GCE API served by handler, journaling in memory
+func newTestClient(t *testing.T, handler http.Handler) *GCEClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	svc, err := compute.New(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.BasePath = server.URL + "/"
+	return &GCEClient{
+		service:         svc,
+		projectID:       "my-project",
+		networkURL:      makeNetworkURL("my-project", "default"),
+		journal:         NewMemoryJournal(),
+		httpClient:      server.Client(),
+		manageFirewalls: true,
+	}
+}
+
+// recorder records steps applied and rolled back, failing those set to
+type recorder struct {
+	applied    []string
+	rolledBack []string
+	failApply  map[string]bool
+	failUndo   map[string]bool
+}
+
+func newRecorder() *recorder {
+	return &recorder{failApply: make(map[string]bool), failUndo: make(map[string]bool)}
+}
+
+func (r *recorder) plan(names ...string) []step {
+	var plan []step
+	for _, name := range names {
+		name := name
+		plan = append(plan, step{
+			name: name,
+			apply: func() error {
+				if r.failApply[name] {
+					return errors.New("failed")
+				}
+				r.applied = append(r.applied, name)
+				return nil
+			},
+			rollback: func() error {
+				if r.failUndo[name] {
+					return errors.New("failed")
+				}
+				r.rolledBack = append(r.rolledBack, name)
+				return nil
+			},
+		})
+	}
+	return plan
+}
+
+func TestRunPlanResumes(t *testing.T) {
+	// load-balancer doesn't exist yet
+	gce := newTestClient(t, http.NotFoundHandler())
+	r := newRecorder()
+
+	r.failApply["b"] = true
+	if err := gce.runPlan("web", r.plan("a", "b", "c"), "v1"); err == nil {
+		t.Fatal("expected plan to fail")
+	}
+	p, ok := gce.journal.GetProvisioning("web")
+	if !ok || p.Created || !reflect.DeepEqual(p.Steps, map[string]string{"a": "v1", "b": ""}) {
+		t.Fatalf("unexpected provisioning %+v", p)
+	}
+
+	// resumes at the step that failed
+	r.failApply["b"] = false
+	r.applied = nil
+	if err := gce.runPlan("web", r.plan("a", "b", "c"), "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.applied, []string{"b", "c"}) {
+		t.Fatalf("expected b and c applied, got %v", r.applied)
+	}
+	p, _ = gce.journal.GetProvisioning("web")
+	if !p.Created || len(p.Steps) != 0 {
+		t.Fatalf("expected complete provisioning, got %+v", p)
+	}
+}
+
+func TestRunPlanReappliesChangedInputs(t *testing.T) {
+	gce := newTestClient(t, http.NotFoundHandler())
+	r := newRecorder()
+
+	r.failApply["c"] = true
+	gce.runPlan("web", r.plan("a", "b", "c"), "v1")
+
+	// steps completed with other inputs are applied again
+	r.failApply["c"] = false
+	r.applied = nil
+	if err := gce.runPlan("web", r.plan("a", "b", "c"), "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.applied, []string{"a", "b", "c"}) {
+		t.Fatalf("expected all steps applied, got %v", r.applied)
+	}
+}
+
+func TestRollbackPlan(t *testing.T) {
+	tests := []struct {
+		name string
+		// journaled provisioning, nil for none
+		provisioning *Provisioning
+		expected     []string
+	}{
+		{"not journaled", nil, []string{"c", "b", "a"}},
+		{"complete", &Provisioning{Steps: map[string]string{}, Created: true}, []string{"c", "b", "a"}},
+		{"partial", &Provisioning{Steps: map[string]string{"a": "v1", "b": ""}}, []string{"b", "a"}},
+		{"nothing started", &Provisioning{Steps: map[string]string{}}, nil},
+		{"updating complete", &Provisioning{Steps: map[string]string{"a": "v2"}, Created: true}, []string{"c", "b", "a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gce := newTestClient(t, http.NotFoundHandler())
+			if test.provisioning != nil {
+				gce.journal.PutProvisioning("web", test.provisioning)
+			}
+			r := newRecorder()
+			if err := gce.rollbackPlan("web", r.plan("a", "b", "c")); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(r.rolledBack, test.expected) {
+				t.Fatalf("expected %v rolled back, got %v", test.expected, r.rolledBack)
+			}
+			if _, ok := gce.journal.GetProvisioning("web"); ok {
+				t.Fatal("expected provisioning to be forgotten")
+			}
+		})
+	}
+}
+
+func TestRollbackPlanResumes(t *testing.T) {
+	gce := newTestClient(t, http.NotFoundHandler())
+	gce.journal.PutProvisioning("web", &Provisioning{Steps: map[string]string{"a": "v1", "b": "v1", "c": ""}})
+	r := newRecorder()
+
+	r.failUndo["b"] = true
+	if err := gce.rollbackPlan("web", r.plan("a", "b", "c")); err == nil {
+		t.Fatal("expected rollback to fail")
+	}
+	p, ok := gce.journal.GetProvisioning("web")
+	if !ok || !reflect.DeepEqual(p.Steps, map[string]string{"a": "v1", "b": "v1"}) {
+		t.Fatalf("expected a and b left to roll back, got %+v", p)
+	}
+
+	// resumes at the step that failed
+	r.failUndo["b"] = false
+	r.rolledBack = nil
+	if err := gce.rollbackPlan("web", r.plan("a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.rolledBack, []string{"b", "a"}) {
+		t.Fatalf("expected b and a rolled back, got %v", r.rolledBack)
+	}
+}
+
+func TestMemoryJournalCopies(t *testing.T) {
+	j := NewMemoryJournal()
+	p := &Provisioning{Steps: map[string]string{"a": "v1"}}
+	j.PutProvisioning("web", p)
+
+	// changes after putting or getting don't leak into the journal
+	p.Steps["b"] = "v1"
+	got, _ := j.GetProvisioning("web")
+	got.Steps["c"] = "v1"
+	if again, _ := j.GetProvisioning("web"); len(again.Steps) != 1 {
+		t.Fatalf("expected journal to keep its own copy, got %+v", again)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	base := fingerprint("8080", []string{"us-east1-d"}, &LoadBalancerConfig{})
+	if fingerprint("8080", []string{"us-east1-d"}, &LoadBalancerConfig{}) != base {
+		t.Fatal("expected same inputs to have the same fingerprint")
+	}
+	for name, other := range map[string]string{
+		"port":  fingerprint("8081", []string{"us-east1-d"}, &LoadBalancerConfig{}),
+		"zones": fingerprint("8080", []string{"us-east1-b"}, &LoadBalancerConfig{}),
+	} {
+		if other == base {
+			t.Errorf("expected different %s to change the fingerprint", name)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package gce
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// ReconcileLoadBalancer reads the actual state of every load-balancer component and fixes
+// any drift from the desired state, e.g. a component that failed to be created or was
+// manually edited. Components are reconciled in dependency order.
+// Every component is read, compared and then created, updated or replaced, so it's
+// safe to call whatever state the load-balancer is in. Provisioning relies on it.
+func (gce *GCEClient) ReconcileLoadBalancer(name string, port string, zones []string, config *LoadBalancerConfig) error {
+	if err := gce.reconcileFirewall(name, port, config.firewall()); err != nil {
+		return err
+	}
+	if err := gce.reconcileHttpHealthCheck(name, port, config.healthCheckPath()); err != nil {
+		return err
+	}
+	if err := gce.reconcileBackendService(name, zones, config.timeoutSec()); err != nil {
+		return err
+	}
+	if err := gce.reconcileUrlMap(name); err != nil {
+		return err
+	}
+	if err := gce.reconcileTargetHttpProxy(name); err != nil {
+		return err
+	}
+	return gce.applyFrontends(name, config)
+}
+
+func (gce *GCEClient) reconcileFirewall(name string, port string, config *FirewallConfig) error {
+	// left for operators to manage?
+	if !gce.manageFirewalls {
+		return nil
+	}
+
+	actual, err := gce.GetFirewall(name)
+	if err != nil {
+		if !isHTTPErrorCode(err, http.StatusNotFound) {
+			return err
+		}
+		glog.Warningf("Firewall rule for [%s] is missing. Creating..", name)
+		return gce.CreateFirewall(name, []string{port}, config)
+	}
+
+	desired, err := gce.makeFirewallObject(actual.Name, []string{port}, config)
+	if err != nil {
+		return err
+	}
+	actualExtras, err := gce.getFirewallExtras(actual.Name)
+	if err != nil {
+		return err
+	}
+	if actual.Network == desired.Network &&
+		reflect.DeepEqual(actual.SourceRanges, desired.SourceRanges) &&
+		len(actual.TargetTags) == len(desired.TargetTags) &&
+		(len(actual.TargetTags) == 0 || reflect.DeepEqual(actual.TargetTags, desired.TargetTags)) &&
+		len(actual.Allowed) == 1 &&
+		actual.Allowed[0].IPProtocol == desired.Allowed[0].IPProtocol &&
+		reflect.DeepEqual(actual.Allowed[0].Ports, desired.Allowed[0].Ports) &&
+		actualExtras.equal(config.extras()) {
+		return nil
+	}
+	glog.Warningf("Firewall rule for [%s] has drifted. Updating..", name)
+	return gce.UpdateFirewall(name, []string{port}, config)
+}
+
+func (gce *GCEClient) reconcileHttpHealthCheck(name string, port string, path string) error {
+	actual, err := gce.GetHttpHealthCheck(name)
+	if err != nil {
+		if !isHTTPErrorCode(err, http.StatusNotFound) {
+			return err
+		}
+		glog.Warningf("HTTP health-check for [%s] is missing. Creating..", name)
+		return gce.CreateHttpHealthCheck(name, port, path)
+	}
+
+	if strconv.FormatInt(actual.Port, 10) == port && actual.RequestPath == path {
+		return nil
+	}
+	glog.Warningf("HTTP health-check for [%s] has drifted. Updating..", name)
+	return gce.UpdateHttpHealthCheck(name, port, path)
+}
+
+func (gce *GCEClient) reconcileBackendService(name string, zones []string, timeoutSec int64) error {
+	actual, err := gce.GetBackendService(name)
+	if err != nil {
+		if !isHTTPErrorCode(err, http.StatusNotFound) {
+			return err
+		}
+		glog.Warningf("Backend service for [%s] is missing. Creating..", name)
+		return gce.CreateBackendService(name, zones, timeoutSec)
+	}
+
+	hc, err := gce.GetHttpHealthCheck(name)
+	if err != nil {
+		return err
+	}
+
+	// one backend (instance group) per zone, skipping missing groups as backends are made
+	backends, err := gce.makeBackends(name, zones)
+	if err != nil {
+		return err
+	}
+	var desiredGroups []string
+	for _, backend := range backends {
+		desiredGroups = append(desiredGroups, backend.Group)
+	}
+	var actualGroups []string
+	for _, backend := range actual.Backends {
+		actualGroups = append(actualGroups, backend.Group)
+	}
+	sort.Strings(desiredGroups)
+	sort.Strings(actualGroups)
+
+	if reflect.DeepEqual(actualGroups, desiredGroups) &&
+		reflect.DeepEqual(actual.HealthChecks, []string{hc.SelfLink}) &&
+		actual.PortName == ServicePortName &&
+		actual.TimeoutSec == timeoutSec {
+		return nil
+	}
+	glog.Warningf("Backend service for [%s] has drifted. Updating..", name)
+	return gce.UpdateBackendService(name, zones, timeoutSec)
+}
+
+func (gce *GCEClient) reconcileUrlMap(name string) error {
+	actual, err := gce.GetUrlMap(name)
+	if err != nil {
+		if !isHTTPErrorCode(err, http.StatusNotFound) {
+			return err
+		}
+		glog.Warningf("URL map for [%s] is missing. Creating..", name)
+		return gce.CreateUrlMap(name)
+	}
+
+	backend, err := gce.GetBackendService(name)
+	if err != nil {
+		return err
+	}
+	if actual.DefaultService == backend.SelfLink {
+		return nil
+	}
+	glog.Warningf("URL map for [%s] has drifted. Updating..", name)
+	return gce.UpdateUrlMap(name)
+}
+
+func (gce *GCEClient) reconcileTargetHttpProxy(name string) error {
+	actual, err := gce.GetTargetHttpProxy(name)
+	if err != nil {
+		if !isHTTPErrorCode(err, http.StatusNotFound) {
+			return err
+		}
+		glog.Warningf("Target HTTP proxy for [%s] is missing. Creating..", name)
+		return gce.CreateTargetHttpProxy(name)
+	}
+
+	urlMap, err := gce.GetUrlMap(name)
+	if err != nil {
+		return err
+	}
+	if actual.UrlMap == urlMap.SelfLink {
+		return nil
+	}
+	glog.Warningf("Target HTTP proxy for [%s] has drifted. Updating..", name)
+	return gce.SetUrlMapForTargetHttpProxy(name)
+}
@@ -0,0 +1,99 @@
+package gce
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeBackends is a local GCE API serving a backend service, its health check and instance groups,
+// recording changes to the backend service
+type fakeBackends struct {
+	sync.Mutex
+	// resources as GCE returns them, keyed by path
+	resources map[string]interface{}
+	// backend groups the backend service was last updated with
+	updated []string
+	changes int
+}
+
+func (f *fakeBackends) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.Method != "GET" {
+		var bs struct {
+			Backends []struct {
+				Group string `json:"group"`
+			} `json:"backends"`
+		}
+		json.NewDecoder(r.Body).Decode(&bs)
+		f.updated = nil
+		for _, backend := range bs.Backends {
+			f.updated = append(f.updated, backend.Group)
+		}
+		f.changes++
+		json.NewEncoder(w).Encode(map[string]string{"name": "op", "status": "DONE"})
+		return
+	}
+	resource, ok := f.resources[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resource)
+}
+
+func TestReconcileBackendService(t *testing.T) {
+	const (
+		group = "https://www.googleapis.com/compute/v1/projects/my-project/zones/us-east1-b/instanceGroups/us-east1-b-web"
+		hc    = "https://www.googleapis.com/compute/v1/projects/my-project/global/httpHealthChecks/http-hc-web"
+	)
+	backendService := func(groups ...string) map[string]interface{} {
+		var backends []map[string]string
+		for _, group := range groups {
+			backends = append(backends, map[string]string{"group": group})
+		}
+		return map[string]interface{}{
+			"name":         makeBackendServiceName("web"),
+			"backends":     backends,
+			"healthChecks": []string{hc},
+			"portName":     ServicePortName,
+			"timeoutSec":   defaultTimeoutSec,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		actual map[string]interface{}
+		// expected backend groups updated with, nil for no update
+		updated []string
+	}{
+		{"missing zone group skipped", backendService(group), nil},
+		{"existing zone group added", backendService(), []string{group}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// instance group of us-east1-c, e.g. restored from a snapshot, no longer exists
+			f := &fakeBackends{resources: map[string]interface{}{
+				"/my-project/global/backendServices/" + makeBackendServiceName("web"):   test.actual,
+				"/my-project/global/httpHealthChecks/" + makeHttpHealthCheckName("web"): map[string]string{"selfLink": hc},
+				"/my-project/zones/us-east1-b/instanceGroups/us-east1-b-web":            map[string]string{"selfLink": group},
+			}}
+			gce := newTestClient(t, f)
+			if err := gce.reconcileBackendService("web", []string{"us-east1-b", "us-east1-c"}, defaultTimeoutSec); err != nil {
+				t.Fatal(err)
+			}
+			if test.updated == nil {
+				if f.changes != 0 {
+					t.Fatalf("expected no update, got %d", f.changes)
+				}
+				return
+			}
+			if !reflect.DeepEqual(f.updated, test.updated) {
+				t.Fatalf("expected update with %v, got %v", test.updated, f.updated)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package cloud
+
+import (
+	"github.com/pires/consul-lb-google/metrics"
+)
+
+var instanceGroupInstances = metrics.NewGaugeVec("consul_lb_instance_group_instances",
+	"Instances in each instance group, by instance group and zone, as of last reconcile.", "instance_group", "zone")
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+const (
+	// how long cloud credential checks are cached, so probes don't eat into API quota
+	cloudCheckTTL = 30 * time.Second
+)
+
+var (
+	// ErrNotAdopted when services found on startup haven't all been handled yet
+	ErrNotAdopted = errors.New("Startup adoption hasn't finished")
+)
+
+// healthChecker tells whether the manager is alive, i.e. making progress, and ready, i.e. its dependencies work
+type healthChecker struct {
+	sync.Mutex
+	registry registry.Registry
+	// how long the main loop or registry may go without progress before being considered stuck
+	timeout time.Duration
+	// when the main loop last went around
+	heartbeat time.Time
+	// whether the main loop has handled the registry's first full listing
+	listed bool
+	// latest cloud credentials check
+	cloudErr       error
+	cloudCheckedAt time.Time
+}
+
+func newHealthChecker(r registry.Registry, timeout time.Duration) *healthChecker {
+	return &healthChecker{
+		registry:  r,
+		timeout:   timeout,
+		heartbeat: time.Now(),
+	}
+}
+
+// beat marks the main loop as making progress
+func (h *healthChecker) beat() {
+	h.Lock()
+	defer h.Unlock()
+	h.heartbeat = time.Now()
+}
+
+// checkListed marks the registry's first full listing as handled, once the registry has sent it all.
+// Must be called from the main loop, as only then were all updates sent before handled.
+func (h *healthChecker) checkListed() {
+	h.Lock()
+	defer h.Unlock()
+	if !h.listed && h.registry.Listed() {
+		h.listed = true
+	}
+}
+
+// adopted returns whether the registry's first full listing was handled, and every service handler
+// went through its first updates, i.e. services missing by now are truly gone
+func (h *healthChecker) adopted() error {
+	h.Lock()
+	listed := h.listed
+	h.Unlock()
+
+	if !listed || !states.adopted() {
+		return ErrNotAdopted
+	}
+	return nil
+}
+
+// live returns the result of every liveness check, keyed by check name. A nil result means it passed.
+func (h *healthChecker) live() map[string]error {
+	h.Lock()
+	heartbeat := h.heartbeat
+	h.Unlock()
+
+	checks := make(map[string]error)
+	if since := time.Since(heartbeat); since > h.timeout {
+		checks["main_loop"] = fmt.Errorf("No progress for %s", since)
+	} else {
+		checks["main_loop"] = nil
+	}
+	// registry may not have answered yet on startup
+	if progressed := h.registry.LastProgress(); !progressed.IsZero() && time.Since(progressed) > h.timeout {
+		checks["registry"] = fmt.Errorf("No progress for %s", time.Since(progressed))
+	} else {
+		checks["registry"] = nil
+	}
+	return checks
+}
+
+// ready returns the result of every readiness check, keyed by check name. A nil result means it passed.
+func (h *healthChecker) ready() map[string]error {
+	checks := make(map[string]error)
+	if h.registry.Healthy() {
+		checks["registry"] = nil
+	} else {
+		checks["registry"] = ErrRegistryUnhealthy
+	}
+	checks["cloud"] = h.checkCloud()
+	checks["adoption"] = h.adopted()
+	return checks
+}
+
+// checkCloud returns whether the cloud accepted our credentials, as of the latest check
+func (h *healthChecker) checkCloud() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if time.Since(h.cloudCheckedAt) > cloudCheckTTL {
+		h.cloudErr = client.Ping()
+		h.cloudCheckedAt = time.Now()
+	}
+	return h.cloudErr
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+// mailbox coalesces updates for a single service, keeping only the latest desired state,
+// so whoever sends updates never blocks on whoever handles them.
+type mailbox struct {
+	sync.Mutex
+	serviceName string
+	// a NEW update was put since last take
+	created bool
+	// a DELETED update was put since last take, and the service didn't reappear meanwhile
+	deleted bool
+	// latest CHANGED update put since last take
+	changed *registry.ServiceUpdate
+	// whether the service exists, as far as updates put so far tell
+	exists bool
+	// latest CHANGED update ever put while the service exists, used for retries
+	latest *registry.ServiceUpdate
+	// signals there are pending updates
+	ready chan struct{}
+}
+
+func newMailbox(serviceName string) *mailbox {
+	return &mailbox{
+		serviceName: serviceName,
+		ready:       make(chan struct{}, 1),
+	}
+}
+
+// put coalesces an update with any pending ones. It never blocks.
+func (m *mailbox) put(update *registry.ServiceUpdate) {
+	m.Lock()
+	switch update.UpdateType {
+	case registry.NEW:
+		m.created = true
+		m.deleted = false
+		m.exists = true
+	case registry.CHANGED:
+		m.changed = update
+		m.latest = update
+		m.exists = true
+	case registry.DELETED:
+		m.created = false
+		m.deleted = true
+		m.changed = nil
+		m.exists = false
+		m.latest = nil
+	}
+	m.Unlock()
+
+	m.signal()
+}
+
+// retry puts the latest desired state again, so whatever failed to be applied is retried. It never blocks.
+func (m *mailbox) retry() {
+	m.Lock()
+	if m.exists {
+		m.created = true
+		if m.changed == nil {
+			m.changed = m.latest
+		}
+	} else {
+		m.deleted = true
+	}
+	m.Unlock()
+
+	m.signal()
+}
+
+// signal signals pending updates, unless already signaled
+func (m *mailbox) signal() {
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns pending updates in the order they're to be handled, and clears them.
+func (m *mailbox) take() []*registry.ServiceUpdate {
+	m.Lock()
+	defer m.Unlock()
+
+	var updates []*registry.ServiceUpdate
+	if m.deleted {
+		updates = append(updates, &registry.ServiceUpdate{
+			ServiceName: m.serviceName,
+			UpdateType:  registry.DELETED,
+		})
+	}
+	if m.created {
+		updates = append(updates, &registry.ServiceUpdate{
+			ServiceName: m.serviceName,
+			UpdateType:  registry.NEW,
+		})
+	}
+	if m.changed != nil {
+		updates = append(updates, m.changed)
+	}
+	m.created = false
+	m.deleted = false
+	m.changed = nil
+	return updates
+}
+
+// settle waits, once pending updates were signaled through ready, for a quiet period without new ones,
+// but never longer than maxDelay.
+// It returns false if done was closed meanwhile.
+func (m *mailbox) settle(quietPeriod time.Duration, maxDelay time.Duration, done <-chan struct{}) bool {
+	deadline := time.Now().Add(maxDelay)
+	timer := time.NewTimer(quietPeriod)
+	defer timer.Stop()
+	for {
+		select {
+		case <-m.ready:
+			// restart quiet period, without going past max delay
+			wait := quietPeriod
+			if left := deadline.Sub(time.Now()); left < wait {
+				wait = left
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			return true
+		case <-done:
+			return false
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+func changed(port string) *registry.ServiceUpdate {
+	return &registry.ServiceUpdate{
+		ServiceName: "web",
+		UpdateType:  registry.CHANGED,
+		ServiceInstances: map[string]*registry.ServiceInstance{
+			"web-1": {Host: "web-1", Port: port},
+		},
+	}
+}
+
+func TestMailboxTake(t *testing.T) {
+	tests := []struct {
+		name string
+		put  []*registry.ServiceUpdate
+		// whether to retry after putting
+		retry    bool
+		expected []string
+		// port of the CHANGED update taken, if any
+		port string
+	}{
+		{"nothing", nil, false, nil, ""},
+		{"new", []*registry.ServiceUpdate{{UpdateType: registry.NEW}}, false, []string{registry.NEW}, ""},
+		{"latest change wins", []*registry.ServiceUpdate{{UpdateType: registry.NEW}, changed("1"), changed("2")}, false, []string{registry.NEW, registry.CHANGED}, "2"},
+		{"deleted", []*registry.ServiceUpdate{{UpdateType: registry.NEW}, changed("1"), {UpdateType: registry.DELETED}}, false, []string{registry.DELETED}, ""},
+		{"deleted then reappeared", []*registry.ServiceUpdate{changed("1"), {UpdateType: registry.DELETED}, {UpdateType: registry.NEW}, changed("2")}, false, []string{registry.NEW, registry.CHANGED}, "2"},
+		{"retry replays latest", []*registry.ServiceUpdate{changed("1")}, true, []string{registry.NEW, registry.CHANGED}, "1"},
+		{"retry of deleted", []*registry.ServiceUpdate{changed("1"), {UpdateType: registry.DELETED}}, true, []string{registry.DELETED}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMailbox("web")
+			for _, update := range test.put {
+				m.put(update)
+			}
+			if test.retry {
+				// retries come after what was put was taken
+				m.take()
+				m.retry()
+			}
+			taken := m.take()
+			if len(taken) != len(test.expected) {
+				t.Fatalf("expected %v, got %d updates", test.expected, len(taken))
+			}
+			for i, update := range taken {
+				if update.UpdateType != test.expected[i] {
+					t.Fatalf("update %d: expected %s, got %s", i, test.expected[i], update.UpdateType)
+				}
+				if update.UpdateType == registry.CHANGED && update.ServiceInstances["web-1"].Port != test.port {
+					t.Fatalf("expected port %s, got %s", test.port, update.ServiceInstances["web-1"].Port)
+				}
+			}
+			if again := m.take(); len(again) != 0 {
+				t.Fatalf("expected take to clear updates, got %d", len(again))
+			}
+		})
+	}
+}
+
+func TestMailboxSettle(t *testing.T) {
+	tests := []struct {
+		name        string
+		quietPeriod time.Duration
+		maxDelay    time.Duration
+		// how long updates keep coming in every 20ms while settling, zero for none
+		updatesFor time.Duration
+		// bounds on how long settling takes
+		min, max time.Duration
+	}{
+		{"quiet period", 50 * time.Millisecond, time.Second, 0, 50 * time.Millisecond, 500 * time.Millisecond},
+		{"updates extend quiet period", 100 * time.Millisecond, time.Second, 250 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond},
+		{"max delay caps quiet period", 100 * time.Millisecond, 200 * time.Millisecond, time.Hour, 200 * time.Millisecond, 600 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMailbox("web")
+			stop := make(chan struct{})
+			defer close(stop)
+			if test.updatesFor > 0 {
+				go func() {
+					ticker := time.NewTicker(20 * time.Millisecond)
+					defer ticker.Stop()
+					deadline := time.After(test.updatesFor)
+					for {
+						select {
+						case <-ticker.C:
+							m.put(changed("1"))
+						case <-deadline:
+							return
+						case <-stop:
+							return
+						}
+					}
+				}()
+			}
+
+			start := time.Now()
+			if !m.settle(test.quietPeriod, test.maxDelay, make(chan struct{})) {
+				t.Fatal("expected settle to succeed")
+			}
+			if took := time.Since(start); took < test.min || took > test.max {
+				t.Fatalf("expected settling to take between %s and %s, took %s", test.min, test.max, took)
+			}
+		})
+	}
+}
+
+func TestMailboxSettleDone(t *testing.T) {
+	m := newMailbox("web")
+	done := make(chan struct{})
+	close(done)
+	if m.settle(time.Hour, time.Hour, done) {
+		t.Fatal("expected settle to return false once done")
+	}
+}
@@ -2,15 +2,25 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"reflect"
 	"strconv"
-	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pires/consul-lb-google/cloud"
+	"github.com/pires/consul-lb-google/cloud/gce"
+	"github.com/pires/consul-lb-google/notifier"
 	"github.com/pires/consul-lb-google/registry"
 	"github.com/pires/consul-lb-google/registry/consul"
+	"github.com/pires/consul-lb-google/registry/file"
+	"github.com/pires/consul-lb-google/registry/nomad"
+	"github.com/pires/consul-lb-google/resolver"
+	"github.com/pires/consul-lb-google/store"
 
 	"github.com/BurntSushi/toml"
 	"github.com/golang/glog"
@@ -21,23 +31,185 @@ var (
 
 	client cloud.Cloud
 
+	// leader is nil unless running highly available
+	leader *consul.Leader
+
+	// publisher is nil unless publishing load-balancer status
+	publisher *consul.StatusPublisher
+
+	// retries holds failed services waiting to be retried
+	retries *retryQueue
+
+	// guard blocks destructive actions that look like a registry outage
+	guard *safetyGuard
+
+	// states keeps track of every service handler
+	states = newServiceStates()
+
+	// notifications is nil unless webhooks are configured
+	notifications *notifier.Notifier
+
+	// records is nil unless the local state store is enabled
+	records *store.Store
+
+	// nodes maps registry instances to the cloud instances they run on
+	nodes resolver.Resolver
+
 	err error
 )
 
+type registryConfiguration struct {
+	// either "consul" (default), "nomad" or "file"
+	Type string
+}
+
+type fileConfiguration struct {
+	// path to a YAML, JSON or TOML services file
+	Path string
+}
+
+type nomadConfiguration struct {
+	Url         string
+	TagsToWatch []string `toml:"tags_to_watch"`
+	// job meta key marking jobs whose services are to be watched
+	JobMetaKey string `toml:"job_meta_key"`
+}
+
 type consulConfiguration struct {
 	Url         string
 	TagsToWatch []string `toml:"tags_to_watch"`
+	Datacenters []string
+	// KV key to lock on for leader election, empty disables high availability
+	LeaderLockKey string `toml:"leader_lock_key"`
+	// KV prefix to publish load-balancer status under, empty disables publishing
+	StatusPrefix string `toml:"status_prefix"`
+	// KV prefix to read per-service settings from, empty disables per-service settings
+	ConfigPrefix string `toml:"config_prefix"`
+	// watch all services with a single blocking query, instead of one per service
+	Multiplex bool
+	// register the manager itself as a service, with its health endpoints as checks. Requires the admin API.
+	RegisterSelf bool `toml:"register_self"`
+}
+
+type managerConfiguration struct {
+	// how long a service must go without updates before changes are applied
+	QuietPeriod duration `toml:"quiet_period"`
+	// how long changes may be delayed by a service that keeps being updated
+	MaxDelay duration `toml:"max_delay"`
+	// how often desired and actual state are reconciled, besides on every update. Zero disables it.
+	ReconcileInterval duration `toml:"reconcile_interval"`
+	// how long to wait before first retrying a failed service, doubled on every failed retry
+	RetryBaseDelay duration `toml:"retry_base_delay"`
+	// how long to wait at most before retrying a failed service
+	RetryMaxDelay duration `toml:"retry_max_delay"`
+	// how long to wait before tearing down a deleted service, in case it reappears
+	DeletionGracePeriod duration `toml:"deletion_grace_period"`
+	// how long to wait for in-flight cloud operations on exit
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+	// whether to tear down managed load-balancers on exit, instead of leaving them in place
+	TeardownOnExit bool `toml:"teardown_on_exit"`
+	// how long the main loop or registry may go without progress before liveness fails
+	LivenessTimeout duration `toml:"liveness_timeout"`
+}
+
+type safetyConfiguration struct {
+	// largest fraction of a service's instances that may be removed at once, e.g. 0.5
+	MaxRemovalFraction float64 `toml:"max_removal_fraction"`
+	// fewest instances a service may be left with by removing instances. Zero disables it.
+	MinInstances int `toml:"min_instances"`
+	// block removals and teardowns while the registry is failing
+	FreezeOnRegistryErrors bool `toml:"freeze_on_registry_errors"`
+}
+
+type adminConfiguration struct {
+	// address to serve the admin API on, e.g. ":8080". Empty disables it.
+	Address string
+	// bearer token required by mutating endpoints. Empty disables them.
+	Token string
+	// host others reach the admin API at, e.g. for health checks. Defaults to the hostname.
+	AdvertiseHost string `toml:"advertise_host"`
+}
+
+type storeConfiguration struct {
+	// file to record managed services' state in, so it's resumed on restart. Empty disables it.
+	Path string
+}
+
+type resolverConfiguration struct {
+	// how registry instances are mapped to cloud instances, either "hostname" (default), "address" or "node_meta"
+	Strategy string
+	// Consul node metadata key holding the instance name, optionally prefixed by its zone, e.g. "us-east1-d/web-1"
+	NodeMetaKey string `toml:"node_meta_key"`
+}
+
+type notificationsConfiguration struct {
+	// how long the same event isn't sent again
+	DedupWindow duration `toml:"dedup_window"`
+	// most events of each type sent per minute
+	MaxPerMinute int `toml:"max_per_minute"`
+	Webhooks     []webhookConfiguration
+}
+
+type webhookConfiguration struct {
+	Url string
+	// template rendering the JSON payload, defaults to the event as is
+	Template string
+	// event types to send, defaults to all
+	Events []string
 }
 
 type cloudConfiguration struct {
-	Project      string
-	Network      string
-	AllowedZones []string `toml:"allowed_zones"`
+	Project         string
+	Network         string
+	AllowedZones    []string            `toml:"allowed_zones"`
+	DatacenterZones map[string][]string `toml:"datacenter_zones"`
+	// regions whose zones are allowed, besides allowed_zones
+	AllowedRegions []string `toml:"allowed_regions"`
+	// pattern zone names are allowed by, besides allowed_zones, e.g. "europe-west1-*"
+	AllowedZoneGlob string `toml:"allowed_zone_glob"`
+	// whether to create instance groups in zones that aren't allowed but instances live in
+	CreateUnlistedZones bool `toml:"create_unlisted_zones"`
+	Firewall            firewallConfiguration
+}
+
+type firewallConfiguration struct {
+	// whether to manage load-balancers' firewall rules, instead of leaving them to operators
+	Manage bool
+	// source ranges allowed in, defaults to Google's load-balancer and health-check ranges
+	SourceRanges []string `toml:"source_ranges"`
+	// network tags of instances to open up, defaults to every instance in the network
+	TargetTags []string `toml:"target_tags"`
+	// service accounts of instances to open up, instead of network tags
+	TargetServiceAccounts []string `toml:"target_service_accounts"`
+	// rule priority, defaults to 1000
+	Priority int64
+	// whether to log connections
+	Logging bool
 }
 
 type configuration struct {
-	Consul consulConfiguration
-	Cloud  cloudConfiguration
+	Registry      registryConfiguration
+	Consul        consulConfiguration
+	Nomad         nomadConfiguration
+	File          fileConfiguration
+	Manager       managerConfiguration
+	Safety        safetyConfiguration
+	Admin         adminConfiguration
+	Notifications notificationsConfiguration
+	Store         storeConfiguration
+	Resolver      resolverConfiguration
+	Cloud         cloudConfiguration
+}
+
+// duration is a time.Duration read from configuration, e.g. "5s"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
 func main() {
@@ -46,93 +218,540 @@ func main() {
 	glog.Info("Starting..")
 
 	// read configuration
-	var cfg configuration
+	cfg := configuration{
+		Manager: managerConfiguration{
+			QuietPeriod:       duration{5 * time.Second},
+			MaxDelay:          duration{30 * time.Second},
+			ReconcileInterval: duration{5 * time.Minute},
+			RetryBaseDelay:    duration{5 * time.Second},
+			RetryMaxDelay:     duration{10 * time.Minute},
+			ShutdownTimeout:   duration{30 * time.Second},
+			LivenessTimeout:   duration{2 * time.Minute},
+		},
+		Notifications: notificationsConfiguration{
+			DedupWindow:  duration{time.Hour},
+			MaxPerMinute: 10,
+		},
+		Cloud: cloudConfiguration{
+			Firewall: firewallConfiguration{
+				Manage: true,
+			},
+		},
+		Resolver: resolverConfiguration{
+			NodeMetaKey: "gce-instance",
+		},
+		Safety: safetyConfiguration{
+			MaxRemovalFraction:     1,
+			MinInstances:           1,
+			FreezeOnRegistryErrors: true,
+		},
+	}
 	if _, err := toml.DecodeFile(*config, &cfg); err != nil {
 		panic(err)
 	}
+	if cfg.Manager.LivenessTimeout.Duration <= 0 {
+		glog.Fatalf("Invalid liveness timeout [%s].", cfg.Manager.LivenessTimeout.Duration)
+	}
+
+	// resume from recorded state, if enabled
+	if cfg.Store.Path != "" {
+		records, err = store.Open(cfg.Store.Path)
+		if err != nil {
+			panic(err)
+		}
+		glog.Infof("Recording state at %s [Recorded Services: %d]..", cfg.Store.Path, records.Len())
+	}
+
+	// journal load-balancer provisioning along with recorded state, if enabled
+	var journal gce.Journal
+	if records != nil {
+		journal = records
+	}
 
 	// provision cloud client
-	glog.Infof("Initializing cloud client [Project ID: %s, Network: %s, Allowed Zones: %#v]..", cfg.Cloud.Project, cfg.Cloud.Network, cfg.Cloud.AllowedZones)
-	client, err = cloud.New(cfg.Cloud.Project, cfg.Cloud.Network, cfg.Cloud.AllowedZones)
+	glog.Infof("Initializing cloud client [Project ID: %s, Network: %s, Allowed Zones: %#v, Allowed Regions: %#v, Allowed Zone Glob: %s, Datacenter Zones: %#v, Manage Firewalls: %t]..", cfg.Cloud.Project, cfg.Cloud.Network, cfg.Cloud.AllowedZones, cfg.Cloud.AllowedRegions, cfg.Cloud.AllowedZoneGlob, cfg.Cloud.DatacenterZones, cfg.Cloud.Firewall.Manage)
+	firewall := cfg.Cloud.Firewall
+	if len(firewall.TargetTags) > 0 && len(firewall.TargetServiceAccounts) > 0 {
+		glog.Fatalf("Invalid firewall settings. %s", gce.ErrFirewallTargets)
+	}
+	client, err = cloud.New(&cloud.Config{
+		Project:             cfg.Cloud.Project,
+		Network:             cfg.Cloud.Network,
+		AllowedZones:        cfg.Cloud.AllowedZones,
+		AllowedRegions:      cfg.Cloud.AllowedRegions,
+		AllowedZoneGlob:     cfg.Cloud.AllowedZoneGlob,
+		DatacenterZones:     cfg.Cloud.DatacenterZones,
+		CreateUnlistedZones: cfg.Cloud.CreateUnlistedZones,
+		Journal:             journal,
+		Firewall: &cloud.FirewallConfig{
+			SourceRanges:          firewall.SourceRanges,
+			TargetTags:            firewall.TargetTags,
+			TargetServiceAccounts: firewall.TargetServiceAccounts,
+			Priority:              firewall.Priority,
+			Logging:               &firewall.Logging,
+		},
+		ManageFirewalls: firewall.Manage,
+	})
 	if err != nil {
 		panic(err)
 	}
 
-	// connect to Consul
-	glog.Infof("Connecting to Consul at %s..", cfg.Consul.Url)
-	r, err := consul.NewRegistry(&registry.Config{
-		Addresses:   []string{cfg.Consul.Url},
-		TagsToWatch: cfg.Consul.TagsToWatch,
-	})
+	// map registry instances to cloud instances
+	glog.Infof("Resolving cloud instances [Strategy: %s, Node Meta Key: %s]..", cfg.Resolver.Strategy, cfg.Resolver.NodeMetaKey)
+	nodes, err = newResolver(cfg)
+	if err != nil {
+		glog.Fatalf("Invalid resolver settings. %s", err)
+	}
+
+	// connect to registry
+	var r registry.Registry
+	switch cfg.Registry.Type {
+	case "", "consul":
+		glog.Infof("Connecting to Consul at %s [Datacenters: %#v]..", cfg.Consul.Url, cfg.Consul.Datacenters)
+		r, err = consul.NewRegistry(&registry.Config{
+			Addresses:    []string{cfg.Consul.Url},
+			TagsToWatch:  cfg.Consul.TagsToWatch,
+			Datacenters:  cfg.Consul.Datacenters,
+			ConfigPrefix: cfg.Consul.ConfigPrefix,
+			Multiplex:    cfg.Consul.Multiplex,
+		})
+	case "nomad":
+		glog.Infof("Connecting to Nomad at %s..", cfg.Nomad.Url)
+		r, err = nomad.NewRegistry(&registry.Config{
+			Addresses:   []string{cfg.Nomad.Url},
+			TagsToWatch: cfg.Nomad.TagsToWatch,
+			JobMetaKey:  cfg.Nomad.JobMetaKey,
+		})
+	case "file":
+		glog.Infof("Reading services from %s..", cfg.File.Path)
+		r, err = file.NewRegistry(&registry.Config{
+			Addresses: []string{cfg.File.Path},
+		})
+	default:
+		glog.Fatalf("Unknown registry type [%s].", cfg.Registry.Type)
+	}
 	if err != nil {
 		panic(err)
 	}
 
+	// publish load-balancer status, if enabled
+	if cfg.Consul.StatusPrefix != "" {
+		glog.Infof("Publishing load-balancer status [Prefix: %s]..", cfg.Consul.StatusPrefix)
+		publisher, err = consul.NewStatusPublisher(cfg.Consul.Url, cfg.Consul.StatusPrefix)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	retries = newRetryQueue(cfg.Manager.RetryBaseDelay.Duration, cfg.Manager.RetryMaxDelay.Duration)
+
+	glog.Infof("Guarding against mass removals [Max Removal Fraction: %.2f, Min Instances: %d, Freeze On Registry Errors: %t]..", cfg.Safety.MaxRemovalFraction, cfg.Safety.MinInstances, cfg.Safety.FreezeOnRegistryErrors)
+	guard = newSafetyGuard(cfg.Safety, r.Healthy)
+
+	// notify operators, if enabled
+	notificationsDone := make(chan struct{})
+	notificationsStopped := make(chan struct{})
+	if len(cfg.Notifications.Webhooks) > 0 {
+		glog.Infof("Sending notifications to %d webhooks [Dedup Window: %s, Max Per Minute: %d]..", len(cfg.Notifications.Webhooks), cfg.Notifications.DedupWindow.Duration, cfg.Notifications.MaxPerMinute)
+		var webhooks []*notifier.Webhook
+		for _, webhook := range cfg.Notifications.Webhooks {
+			w, err := notifier.NewWebhook(webhook.Url, webhook.Template, webhook.Events)
+			if err != nil {
+				panic(err)
+			}
+			webhooks = append(webhooks, w)
+		}
+		notifications = notifier.New(webhooks, cfg.Notifications.DedupWindow.Duration, cfg.Notifications.MaxPerMinute)
+		go func() {
+			notifications.Run(notificationsDone)
+			close(notificationsStopped)
+		}()
+	} else {
+		close(notificationsStopped)
+	}
+
+	// serve admin API, if enabled
+	health := newHealthChecker(r, cfg.Manager.LivenessTimeout.Duration)
+	if cfg.Admin.Address != "" {
+		glog.Infof("Serving admin API at %s..", cfg.Admin.Address)
+		go func() {
+			if err := newAdminServer(cfg.Admin.Token, health).ListenAndServe(cfg.Admin.Address); err != nil {
+				glog.Fatalf("There was an error while serving admin API. %s", err)
+			}
+		}()
+	}
+
+	// register ourselves in Consul, if enabled
+	var self *consul.SelfRegistration
+	if cfg.Consul.RegisterSelf {
+		self, err = registerSelf(cfg)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	glog.Info("Initiating registry..")
 	updates := make(chan *registry.ServiceUpdate)
+	// closed on exit, so no more updates are taken
 	done := make(chan struct{})
 	// register for service updates
 	go r.Run(updates, done)
 
+	// campaign for leadership, if running highly available.
+	// leadership is only released once handlers are done with the cloud.
+	elections := make(chan bool)
+	resign := make(chan struct{})
+	resigned := make(chan struct{})
+	if cfg.Consul.LeaderLockKey != "" {
+		glog.Infof("Running highly available [Lock Key: %s]..", cfg.Consul.LeaderLockKey)
+		leader, err = consul.NewLeader(cfg.Consul.Url, cfg.Consul.LeaderLockKey)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			leader.Run(elections, resign)
+			close(resigned)
+		}()
+	} else {
+		close(resigned)
+	}
+
 	glog.Info("Waiting for service updates..")
-	go func(updates <-chan *registry.ServiceUpdate, done chan struct{}) {
-		var wg sync.WaitGroup
-		handlers := make(map[string]chan *registry.ServiceUpdate)
+	// handlers still running
+	var wg sync.WaitGroup
+	go func(updates <-chan *registry.ServiceUpdate, elections <-chan bool, done chan struct{}) {
+		// let liveness checks know we're making progress, even without updates
+		heartbeats := time.NewTicker(cfg.Manager.LivenessTimeout.Duration / 4)
+		defer heartbeats.Stop()
+		handlers := make(map[string]*mailbox)
+		// latest update per service, replayed when leadership is acquired
+		latest := make(map[string]*registry.ServiceUpdate)
 		for {
 			select {
-			case update := <-updates:
+			case <-heartbeats.C:
+				health.beat()
+				health.checkListed()
+			case leading := <-elections:
+				if !leading {
+					glog.Warning("Lost leadership, no longer managing services.")
+					// wake handlers up, so they forget about applied state right away
+					for _, handler := range handlers {
+						handler.retry()
+					}
+					break
+				}
+				glog.Infof("Acquired leadership, taking over %d services..", len(latest))
+				for name, update := range latest {
+					handlers[name].put(&registry.ServiceUpdate{
+						ServiceName: name,
+						UpdateType:  registry.NEW,
+					})
+					if update.UpdateType == registry.CHANGED {
+						handlers[name].put(update)
+					}
+				}
+			case update, ok := <-updates:
+				// registry stopped, i.e. we're exiting
+				if !ok {
+					return
+				}
+				registryUpdates.Inc(update.UpdateType)
+
+				// keep cache warm for a leadership takeover
+				if update.UpdateType == registry.DELETED {
+					delete(latest, update.ServiceName)
+				} else {
+					latest[update.ServiceName] = update
+				}
+
 				// is there and handler for updated service?
 				if handler, ok := handlers[update.ServiceName]; !ok {
 					// no so provision handler
-					handler = make(chan *registry.ServiceUpdate)
+					handler = newMailbox(update.ServiceName)
 					handlers[update.ServiceName] = handler
+					states.register(update.ServiceName, handler)
 					// start handler in its own goroutine
 					wg.Add(1)
-					go handleService(update.ServiceName, handler, wg, done)
+					go handleService(update.ServiceName, handler, cfg.Manager, &wg, done)
 				}
-				// send update to handler
-				handlers[update.ServiceName] <- update
+				// send update to handler, coalescing with any pending ones
+				handlers[update.ServiceName].put(update)
+				health.checkListed()
 			case <-done:
-				// wait for all handlers to terminate
-				wg.Wait()
 				return
 			}
 		}
-	}(updates, done)
+	}(updates, elections, done)
 
-	// wait for Ctrl-c to stop server
+	// wait for Ctrl-c or SIGTERM to stop server
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 
 	glog.Info("Terminating all pending jobs..")
+	if self != nil {
+		if err := self.Deregister(); err != nil {
+			glog.Errorf("There was an error while deregistering from Consul. %s", err)
+		}
+	}
 	close(done)
+
+	// wait for in-flight cloud operations to finish
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(cfg.Manager.ShutdownTimeout.Duration):
+		glog.Warningf("Timed out after %s waiting for pending jobs. Cloud resources may be left half-updated.", cfg.Manager.ShutdownTimeout.Duration)
+	}
+
+	// let another replica take over
+	close(resign)
+	<-resigned
+
+	// send whatever is left to send
+	close(notificationsDone)
+	<-notificationsStopped
 	glog.Info("Terminated")
 }
 
 // handleService handles service updates in a consistent way.
-// It will run until service is deleted or done is closed.
-func handleService(name string, updates <-chan *registry.ServiceUpdate, wg sync.WaitGroup, done chan struct{}) {
+// Updates are coalesced and only handled after a quiet period, or max delay, without updates.
+// Desired and actual state are reconciled on every update and periodically.
+// Whatever fails is retried with backoff.
+// It will run until done is closed.
+func handleService(name string, updates *mailbox, settings managerConfiguration, wg *sync.WaitGroup, done chan struct{}) {
+	defer wg.Done()
+
 	// service model
 	lock := &sync.RWMutex{}
 	var serviceName string
 	var servicePort string
+	var serviceConfig *registry.ServiceConfig
 	isRunning := false
 	instances := make(map[string]*registry.ServiceInstance)
+	// names of the cloud instances registry instances run on, keyed like instances
+	resolved := make(map[string]string)
+	// registry instances no cloud instance was found for, along with why
+	unresolved := make(map[string]string)
+	// latest update with instances, i.e. desired state
+	var desired *registry.ServiceUpdate
+	// fires when a deleted service's grace period expires, nil if there's no pending teardown
+	var teardown <-chan time.Time
+	// whether a deleted service's grace period has expired, so it's to be torn down right away
+	teardownDue := false
+	// whether tearing down a deleted service was blocked or failed, so it's still to be torn down
+	teardownFailed := false
+	// status model
+	var createdAt time.Time
+	// error applying updates or tearing down, kept until they're applied again
+	var lastErr error
+	// whether lastErr is one operators must act on
+	needsIntervention := false
+	// error from periodic reconciliation, kept until the next reconciliation or update
+	var reconcileErr error
+	// failed returns what failed most recently, if anything, updates and teardowns first
+	failed := func() error {
+		if lastErr != nil {
+			return lastErr
+		}
+		return reconcileErr
+	}
+
+	// forget about any applied state, once no longer the leader, so it's all re-applied when leadership is acquired.
+	// lock must be held.
+	forget := func() {
+		if isRunning {
+			glog.Warningf("Not the leader, stopped managing service [%s].", serviceName)
+		}
+		serviceName = ""
+		servicePort = ""
+		serviceConfig = nil
+		isRunning = false
+		instances = make(map[string]*registry.ServiceInstance)
+		resolved = make(map[string]string)
+		unresolved = make(map[string]string)
+		desired = nil
+		teardown = nil
+		teardownDue = false
+		teardownFailed = false
+	}
+
+	// periodic reconciliation, if enabled
+	var reconciliations <-chan time.Time
+	if settings.ReconcileInterval.Duration > 0 {
+		ticker := time.NewTicker(settings.ReconcileInterval.Duration)
+		defer ticker.Stop()
+		reconciliations = ticker.C
+	}
+
+	// retry is called once all updates have been handled, so whatever failed is retried with backoff
+	retry := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if err := failed(); err != nil && isLeader() {
+			retries.addRateLimited(name, err, updates.retry)
+		} else {
+			retries.forget(name)
+		}
+		if isRunning && isLeader() {
+			saveRecord(serviceName, servicePort, instances, serviceConfig, createdAt)
+		}
+		states.report(name, serviceName, servicePort, isRunning, instances, unresolved, failed(), needsIntervention, createdAt)
+	}
+
+	// shutdown either leaves the load-balancer in place, publishing its latest status, or tears it down
+	shutdown := func() {
+		glog.Warningf("Received termination signal for service [%s]", name)
+		lock.Lock()
+		defer lock.Unlock()
+		retries.forget(name)
+		if !isRunning || !isLeader() {
+			return
+		}
+		if !settings.TeardownOnExit {
+			publishStatus(serviceName, servicePort, failed(), createdAt)
+			return
+		}
+
+		glog.Warningf("Tearing down service [%s] on exit..", serviceName)
+		if err := client.RemoveLoadBalancer(serviceName); err != nil {
+			intervene(serviceName, "There was an error while propagating network changes for service [%s] port [%s]. %s", serviceName, servicePort, err)
+			return
+		}
+		if err := client.RemoveInstanceGroup(serviceName); err != nil {
+			intervene(serviceName, "There was an error while removing instance group for service [%s]. %s", serviceName, err)
+			return
+		}
+		unpublishStatus(serviceName)
+		forgetRecord(serviceName)
+		notify(notifier.LoadBalancerRemoved, serviceName, fmt.Sprintf("Removed load-balancer for service [%s] on exit.", serviceName))
+	}
 
 	for {
 		select {
-		case update := <-updates:
+		case <-reconciliations:
+			lock.Lock()
+			// a deleted service is on its way out, so reconciling would bring back what's being torn down
+			tearingDown := teardown != nil || teardownDue || teardownFailed
+			if isRunning && isLeader() && !states.isPaused(name) && !tearingDown {
+				// errors applying updates are left for the updates' retries to clear
+				reconcileErr = nil
+				if err := reconcile(serviceName, servicePort, desired); err != nil {
+					glog.Errorf("There was an error while reconciling service [%s]. %s", serviceName, err)
+					reconcileErr = err
+				}
+				publishStatus(serviceName, servicePort, failed(), createdAt)
+			}
+			lock.Unlock()
+			retry()
+			continue
+		case <-teardown:
+			glog.Warningf("Grace period expired for deleted service [%s].", name)
+			lock.Lock()
+			teardown = nil
+			teardownDue = true
+			lock.Unlock()
+			// service may have reappeared meanwhile, otherwise it's torn down
+			updates.retry()
+			continue
+		case <-updates.ready:
+			// wait for updates to settle
+			if !updates.settle(settings.QuietPeriod.Duration, settings.MaxDelay.Duration, done) {
+				shutdown()
+				return
+			}
+		case <-done:
+			shutdown()
+			return
+		}
+
+		// only the leader touches the cloud, so followers drop updates, paused or not.
+		// they're replayed when leadership is acquired.
+		if !isLeader() {
+			updates.take()
+			lock.Lock()
+			forget()
+			lastErr = nil
+			needsIntervention = false
+			reconcileErr = nil
+			lock.Unlock()
+			retry()
+			continue
+		}
+
+		// leave pending updates alone until resumed
+		if states.isPaused(name) {
+			glog.Warningf("Management of service [%s] is paused, not applying updates.", name)
+			continue
+		}
+
+		// updates are applied in full, so whatever failed before either fails again or is fixed
+		lock.Lock()
+		lastErr = nil
+		needsIntervention = false
+		reconcileErr = nil
+		lock.Unlock()
+
+	handling:
+		for _, update := range updates.take() {
+			// exiting, so stop taking updates
+			select {
+			case <-done:
+				break handling
+			default:
+			}
+
+			// leadership may be lost while handling updates
+			if !isLeader() {
+				lock.Lock()
+				forget()
+				lock.Unlock()
+				continue
+			}
+
 			switch update.UpdateType {
 			case registry.NEW:
 				lock.Lock()
-				if !isRunning {
+				// did a deleted service reappear within its grace period?
+				if teardown != nil || teardownDue || teardownFailed {
+					glog.Infof("Service [%s] reappeared within its grace period. Reusing existing resources.", name)
+					teardown = nil
+					teardownDue = false
+					teardownFailed = false
+				}
+				if record, ok := recordedService(update.ServiceName); ok && !isRunning {
+					// resume from where we were before restarting, so only differences are applied
+					glog.Infof("Resuming service [%s] from recorded state [Port: %s, Instances: %d]..", update.ServiceName, record.Port, len(record.Instances))
+					client.RestoreInstanceGroup(update.ServiceName, recordedZones(record))
+					serviceName = update.ServiceName
+					servicePort = record.Port
+					serviceConfig = record.Config
+					for k, v := range record.Instances {
+						instances[k] = v
+					}
+					desired = &registry.ServiceUpdate{
+						ServiceName:      update.ServiceName,
+						UpdateType:       registry.CHANGED,
+						ServiceInstances: record.Instances,
+						ServiceConfig:    record.Config,
+					}
+					isRunning = true
+					createdAt = record.CreatedAt
+					glog.Infof("Watching service [%s].", serviceName)
+				} else if !isRunning {
 					glog.Infof("Initializing service [%s]..", update.ServiceName)
 					if err := client.CreateInstanceGroup(update.ServiceName); err != nil {
 						glog.Errorf("There was an error while initializing service [%s]. %s", update.ServiceName, err)
+						lastErr = err
 					} else {
 						serviceName = update.ServiceName
 						isRunning = true
+						createdAt = time.Now()
+						lastErr = nil
 						glog.Infof("Watching service [%s].", serviceName)
 					}
 				}
@@ -140,19 +759,59 @@ func handleService(name string, updates <-chan *registry.ServiceUpdate, wg sync.
 			case registry.DELETED:
 				lock.Lock()
 				if isRunning {
+					// wait for grace period before tearing down, in case service reappears
+					if grace := deletionGracePeriod(settings, desired); grace > 0 && !teardownDue {
+						if teardown == nil {
+							glog.Warningf("Service [%s] was deleted. Tearing down in %s, unless it reappears.", serviceName, grace)
+							teardown = time.After(grace)
+						}
+						lock.Unlock()
+						break
+					}
+
+					// registry may just be failing, so don't remove anything yet
+					if err := guard.checkTeardown(serviceName); err != nil {
+						glog.Errorf("HUMAN INTERVENTION REQUIRED: Not tearing down service [%s]. %s", serviceName, err)
+						needsIntervention = true
+						lastErr = err
+						teardownFailed = true
+						lock.Unlock()
+						break
+					}
+
 					// remove everything
 					if err := client.RemoveLoadBalancer(serviceName); err != nil {
-						glog.Errorf("HUMAN INTERVENTION REQUIRED: There was an error while propagating network changes for service [%s] port [%d]. %s", serviceName, servicePort, err)
+						intervene(serviceName, "There was an error while propagating network changes for service [%s] port [%s]. %s", serviceName, servicePort, err)
+						needsIntervention = true
+						lastErr = err
 					}
 					if err := client.RemoveInstanceGroup(serviceName); err != nil {
-						glog.Errorf("HUMAN INTERVENTION REQUIRED: There was an error while removing instance group for service [%s]. %s", serviceName, err)
+						intervene(serviceName, "There was an error while removing instance group for service [%s]. %s", serviceName, err)
+						needsIntervention = true
+						lastErr = err
+					}
+					// keep state so removal is retried
+					if lastErr != nil {
+						teardownFailed = true
+						lock.Unlock()
+						break
 					}
+					unpublishStatus(serviceName)
+					forgetRecord(serviceName)
+					guard.forget(serviceName)
+					notify(notifier.LoadBalancerRemoved, serviceName, fmt.Sprintf("Removed load-balancer for deleted service [%s].", serviceName))
 					glog.Infof("Stopped watching service [%s].", serviceName)
 					// reset state
 					serviceName = ""
 					servicePort = ""
+					serviceConfig = nil
 					isRunning = false
 					instances = make(map[string]*registry.ServiceInstance)
+					resolved = make(map[string]string)
+					unresolved = make(map[string]string)
+					desired = nil
+					teardownDue = false
+					teardownFailed = false
 				}
 				lock.Unlock()
 			case registry.CHANGED:
@@ -165,25 +824,65 @@ func handleService(name string, updates <-chan *registry.ServiceUpdate, wg sync.
 					break
 				}
 
+				// are too many instances being removed at once, e.g. registry returned none during an outage?
+				removing := 0
+				for k := range instances {
+					if _, ok := update.ServiceInstances[k]; !ok {
+						removing++
+					}
+				}
+				if err := guard.checkRemoval(serviceName, len(instances), removing, len(update.ServiceInstances)); err != nil {
+					glog.Errorf("HUMAN INTERVENTION REQUIRED: Not applying update for service [%s]. %s", serviceName, err)
+					needsIntervention = true
+					lastErr = err
+					publishStatus(serviceName, servicePort, lastErr, createdAt)
+					lock.Unlock()
+					break
+				}
+
+				desired = update
 				currentPort := servicePort
-				var toAdd, toRemove []string
+				var toRemove []string
+				// instances to add are grouped by datacenter, so they're mapped to the right zones
+				toAdd := make(map[string][]string)
+
+				// removed instances are looked up by the name they were added with
+				remove := func(k string) {
+					name, ok := resolved[k]
+					if !ok {
+						// e.g. resumed from recorded state, otherwise reconciliation removes it
+						var err error
+						if name, err = resolveInstance(serviceName, instances[k]); err != nil {
+							glog.Warningf("Leaving instance [%s] for reconciliation to remove.", k)
+							return
+						}
+					}
+					toRemove = append(toRemove, name)
+				}
+
+				// forget instances that are gone, even if they never resolved
+				for k := range unresolved {
+					if _, ok := update.ServiceInstances[k]; !ok {
+						delete(unresolved, k)
+					}
+				}
 
 				// have all instances been removed?
 				if len(update.ServiceInstances) == 0 {
 					for k := range instances {
-						// need to split k because Consul stores FQDN
-						toRemove = append(toRemove, strings.Split(k, ".")[0])
+						remove(k)
+						delete(instances, k)
+						delete(resolved, k)
 					}
 				} else {
 					// identify any deleted instances and remove from instance group
-					if len(update.ServiceInstances) < len(instances) {
-						glog.Warningf("Removing %d instances.", len(instances)-len(update.ServiceInstances))
-						var toRemove []string
+					if removing > 0 {
+						glog.Warningf("Removing %d instances.", removing)
 						for k := range instances {
 							if _, ok := update.ServiceInstances[k]; !ok {
-								// need to split k because Consul stores FQDN
-								toRemove = append(toRemove, strings.Split(k, ".")[0])
+								remove(k)
 								delete(instances, k)
+								delete(resolved, k)
 								glog.Warningf("Removing instance [%s].", k)
 							}
 						}
@@ -192,12 +891,21 @@ func handleService(name string, updates <-chan *registry.ServiceUpdate, wg sync.
 					// find new or changed instances and create or change accordingly in cloud
 					for k, v := range update.ServiceInstances {
 						if instance, ok := instances[k]; !ok {
+							// left out until resolved, so it's resolved again on retry
+							instanceName, err := resolveInstance(serviceName, v)
+							if err != nil {
+								unresolved[k] = err.Error()
+								lastErr = fmt.Errorf("Can't resolve instance [%s] to a cloud instance. %s", k, err)
+								continue
+							}
+							delete(unresolved, k)
+
 							// new instance, create
-							glog.Warningf("Adding instance [%s].", k)
+							glog.Warningf("Adding instance [%s] as cloud instance [%s].", k, instanceName)
 							instances[k] = v
+							resolved[k] = instanceName
 							// mark as new instance for further processing
-							// need to split k because Consul stores FQDN
-							toAdd = append(toAdd, strings.Split(k, ".")[0])
+							toAdd[v.Datacenter] = append(toAdd[v.Datacenter], instanceName)
 
 							// check if service port is new
 							if currentPort != v.Port {
@@ -221,13 +929,15 @@ func handleService(name string, updates <-chan *registry.ServiceUpdate, wg sync.
 				if len(toRemove) > 0 {
 					if err := client.RemoveInstancesFromInstanceGroup(toRemove, serviceName); err != nil {
 						glog.Errorf("There was an error while removing instances from instance group [%s]. %s", serviceName, err)
+						lastErr = err
 					}
 				}
 
 				// do we have new instances to add to the instance group?
-				if len(toAdd) > 0 {
-					if err := client.AddInstancesToInstanceGroup(toAdd, serviceName); err != nil {
-						glog.Errorf("There was an error while adding instances to instance group [%s]. %s", serviceName, err)
+				for dc, names := range toAdd {
+					if err := client.AddInstancesToInstanceGroup(names, serviceName, dc); err != nil {
+						glog.Errorf("There was an error while adding instances from datacenter [%s] to instance group [%s]. %s", dc, serviceName, err)
+						lastErr = err
 					}
 				}
 
@@ -235,27 +945,150 @@ func handleService(name string, updates <-chan *registry.ServiceUpdate, wg sync.
 				if currentPort != servicePort {
 					if port, err := strconv.ParseInt(currentPort, 10, 64); err != nil {
 						glog.Errorf("There was an error while setting service [%s] port. %s", serviceName, err)
+						lastErr = err
 					} else {
 						if err := client.SetPortForInstanceGroup(port, serviceName); err != nil {
-							glog.Errorf("HUMAN INTERVENTION REQUIRED: There was an error while setting service [%s] port [%s]. %s", serviceName, currentPort, err)
+							intervene(serviceName, "There was an error while setting service [%s] port [%s]. %s", serviceName, currentPort, err)
+							needsIntervention = true
+							lastErr = err
 						}
+						// no port means there was no load-balancer yet
+						creating := servicePort == ""
 						servicePort = currentPort
 
 						// propagate networking changes
-						if err := client.CreateOrUpdateLoadBalancer(serviceName, servicePort); err != nil {
-							glog.Errorf("HUMAN INTERVENTION REQUIRED: There was an error while propagating network changes for service [%s] port [%s]. %s", serviceName, servicePort, err)
+						if err := client.CreateOrUpdateLoadBalancer(serviceName, servicePort, toLoadBalancerConfig(update.ServiceConfig)); err != nil {
+							intervene(serviceName, "There was an error while propagating network changes for service [%s] port [%s]. %s", serviceName, servicePort, err)
+							needsIntervention = true
+							lastErr = err
+						} else {
+							serviceConfig = update.ServiceConfig
+							if creating {
+								notify(notifier.LoadBalancerCreated, serviceName, fmt.Sprintf("Created load-balancer for service [%s] port [%s].", serviceName, servicePort))
+							}
 						}
 					}
+				} else if servicePort != "" && !reflect.DeepEqual(serviceConfig, update.ServiceConfig) {
+					// only settings changed, so apply the difference
+					glog.Infof("Service [%s] has new settings.", serviceName)
+					if err := client.UpdateLoadBalancerConfig(serviceName, servicePort, toLoadBalancerConfig(update.ServiceConfig)); err != nil {
+						glog.Errorf("There was an error while applying settings for service [%s]. %s", serviceName, err)
+						lastErr = err
+					} else {
+						serviceConfig = update.ServiceConfig
+					}
 				}
 
+				// fix any drift, e.g. left behind by failed operations
+				if err := reconcile(serviceName, servicePort, desired); err != nil {
+					glog.Errorf("There was an error while reconciling service [%s]. %s", serviceName, err)
+					lastErr = err
+				}
+
+				// let others know about the load-balancer
+				publishStatus(serviceName, servicePort, lastErr, createdAt)
+
 				lock.Unlock()
 			default:
 				continue
 			}
-		case <-done:
-			glog.Warningf("Received termination signal for service [%s]", serviceName)
-			wg.Done()
-			return
 		}
+
+		retry()
+	}
+}
+
+// registerSelf registers the manager in Consul, along with its health endpoints as HTTP checks
+func registerSelf(cfg configuration) (*consul.SelfRegistration, error) {
+	if cfg.Admin.Address == "" {
+		glog.Fatal("Registering in Consul requires the admin API to be enabled.")
+	}
+	host, portText, err := net.SplitHostPort(cfg.Admin.Address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Admin.AdvertiseHost != "" {
+		host = cfg.Admin.AdvertiseHost
+	} else if host == "" {
+		if host, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	id := "consul-lb-gce-" + host
+	glog.Infof("Registering in Consul [ID: %s, Address: %s:%d]..", id, host, port)
+	self, err := consul.NewSelfRegistration(cfg.Consul.Url, id)
+	if err != nil {
+		return nil, err
+	}
+	base := "http://" + net.JoinHostPort(host, portText)
+	return self, self.Register("consul-lb-gce", host, port, []string{base + "/healthz/live", base + "/healthz/ready"})
+}
+
+// intervene logs an error operators must act on, and notifies them if enabled
+func intervene(serviceName string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	glog.ErrorDepth(1, "HUMAN INTERVENTION REQUIRED: "+message)
+	notify(notifier.Intervention, serviceName, message)
+}
+
+// notify notifies operators of an event, if enabled
+func notify(eventType string, serviceName string, message string) {
+	if notifications == nil {
+		return
+	}
+	notifications.Notify(eventType, serviceName, message)
+}
+
+// deletionGracePeriod returns how long to wait before tearing down a deleted service,
+// per-service settings overriding the manager's
+func deletionGracePeriod(settings managerConfiguration, desired *registry.ServiceUpdate) time.Duration {
+	if desired != nil && desired.ServiceConfig != nil && desired.ServiceConfig.DeletionGracePeriod != "" {
+		grace, err := time.ParseDuration(desired.ServiceConfig.DeletionGracePeriod)
+		if err == nil {
+			return grace
+		}
+		glog.Errorf("Ignoring invalid deletion grace period [%s] for service [%s]. %s", desired.ServiceConfig.DeletionGracePeriod, desired.ServiceName, err)
+	}
+	return settings.DeletionGracePeriod.Duration
+}
+
+// isLeader returns whether this replica should manage cloud resources
+func isLeader() bool {
+	return leader == nil || leader.IsLeader()
+}
+
+// leadership describes whether this replica is the leader, and since when if running highly available
+func leadership() map[string]interface{} {
+	if leader == nil {
+		return map[string]interface{}{"leader": true}
+	}
+	return map[string]interface{}{
+		"leader":       leader.IsLeader(),
+		"leader_since": leader.Since(),
+	}
+}
+
+// toLoadBalancerConfig converts per-service settings to load-balancer settings
+func toLoadBalancerConfig(config *registry.ServiceConfig) *cloud.LoadBalancerConfig {
+	if config == nil {
+		return nil
+	}
+	return &cloud.LoadBalancerConfig{
+		HealthCheckPath: config.HealthCheckPath,
+		TimeoutSec:      config.TimeoutSec,
+		Certificates:    config.Certificates,
+		FrontendPorts:   config.FrontendPorts,
+		Firewall: &cloud.FirewallConfig{
+			SourceRanges:          config.FirewallSourceRanges,
+			TargetTags:            config.FirewallTargetTags,
+			TargetServiceAccounts: config.FirewallTargetServiceAccounts,
+			Priority:              config.FirewallPriority,
+			Logging:               config.FirewallLogging,
+		},
 	}
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/pires/consul-lb-google/metrics"
+)
+
+var (
+	registryUpdates = metrics.NewCounterVec("consul_lb_registry_updates_total",
+		"Service updates received from the registry, by type.", "type")
+	reconcileDuration = metrics.NewHistogramVec("consul_lb_reconcile_duration_seconds",
+		"How long reconciling a service took, by result.", metrics.DefBuckets, "result")
+)
+
+func init() {
+	metrics.NewGaugeFunc("consul_lb_services", "Services by state.", "state", func() map[string]float64 {
+		byState := map[string]float64{
+			"running": 0,
+			"stopped": 0,
+			"paused":  0,
+			"failing": 0,
+			"blocked": 0,
+		}
+		for _, state := range states.list() {
+			if state.Running {
+				byState["running"]++
+			} else {
+				byState["stopped"]++
+			}
+			if state.Paused {
+				byState["paused"]++
+			}
+			if state.LastError != "" {
+				byState["failing"]++
+			}
+			if state.Blocked != nil {
+				byState["blocked"]++
+			}
+		}
+		return byState
+	})
+	metrics.NewGaugeFunc("consul_lb_is_leader", "Whether this replica manages cloud resources.", "", func() map[string]float64 {
+		if isLeader() {
+			return map[string]float64{"": 1}
+		}
+		return map[string]float64{"": 0}
+	})
+	metrics.NewGaugeFunc("consul_lb_services_requiring_intervention", "Services whose last error requires human intervention.", "", func() map[string]float64 {
+		count := 0
+		for _, state := range states.list() {
+			if state.NeedsIntervention || state.Blocked != nil {
+				count++
+			}
+		}
+		return map[string]float64{"": float64(count)}
+	})
+}
+
+// result returns a metric label for an error
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
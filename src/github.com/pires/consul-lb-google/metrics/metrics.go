@@ -0,0 +1,263 @@
+// Package metrics exposes counters, gauges and histograms in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds, fit for GCE API calls and operations
+var DefBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var (
+	lock       sync.Mutex
+	registered []metric
+
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func register(m metric) {
+	lock.Lock()
+	defer lock.Unlock()
+	registered = append(registered, m)
+}
+
+// Handler serves all metrics in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		lock.Lock()
+		defer lock.Unlock()
+		for _, m := range registered {
+			m.write(w)
+		}
+	})
+}
+
+// series is a metric's value for a set of label values
+type series struct {
+	labelValues []string
+	value       float64
+	// histograms alone
+	counts []uint64
+	count  uint64
+}
+
+// vec is a metric partitioned by labels
+type vec struct {
+	sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]*series
+}
+
+func newVec(name string, help string, kind string, labels []string) *vec {
+	return &vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+// get returns the series for label values, creating it if needed. Caller must hold the lock.
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Delete drops the series for label values, e.g. the instance group it's about is gone
+func (v *vec) Delete(labelValues ...string) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.series, strings.Join(labelValues, "\xff"))
+}
+
+// sorted returns all series sorted by label values. Caller must hold the lock.
+func (v *vec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sorted := make([]*series, len(keys))
+	for i, key := range keys {
+		sorted[i] = v.series[key]
+	}
+	return sorted
+}
+
+func (v *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, helpEscaper.Replace(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+func (v *vec) write(w io.Writer) {
+	v.Lock()
+	defer v.Unlock()
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues), formatValue(s.value))
+	}
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec registers a new counter
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter for label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.get(labelValues).value++
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	*vec
+}
+
+// NewGaugeVec registers a new gauge
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels)}
+	register(g)
+	return g
+}
+
+// Set sets the gauge for label values
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.get(labelValues).value = value
+}
+
+// GaugeFunc is a gauge partitioned by a single label, whose values are collected on every scrape
+type GaugeFunc struct {
+	*vec
+	collect func() map[string]float64
+}
+
+// NewGaugeFunc registers a new gauge collected on every scrape, keyed by label value.
+// An empty label means the gauge isn't partitioned, and is collected from the empty key.
+func NewGaugeFunc(name string, help string, label string, collect func() map[string]float64) *GaugeFunc {
+	var labels []string
+	if label != "" {
+		labels = []string{label}
+	}
+	g := &GaugeFunc{newVec(name, help, "gauge", labels), collect}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	values := g.collect()
+	g.Lock()
+	g.series = make(map[string]*series, len(values))
+	for labelValue, value := range values {
+		if len(g.labels) == 0 {
+			g.get(nil).value = value
+		} else {
+			g.get([]string{labelValue}).value = value
+		}
+	}
+	g.Unlock()
+	g.vec.write(w)
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+// NewHistogramVec registers a new histogram with the given upper bounds, in increasing order
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{newVec(name, help, "histogram", labels), buckets}
+	register(h)
+	return h
+}
+
+// Observe adds an observation for label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.get(labelValues)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	// value holds the sum of observations
+	s.value += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	h.writeHeader(w)
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, s := range h.sorted() {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, append(append([]string{}, s.labelValues...), formatValue(bound))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, append(append([]string{}, s.labelValues...), "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+// formatLabels returns labels as in `{method="GET",code="200"}`, or nothing without labels
+func formatLabels(labels []string, labelValues []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label + `="` + labelValueEscaper.Replace(labelValues[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func written(m metric) string {
+	var b bytes.Buffer
+	m.write(&b)
+	return b.String()
+}
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      []string
+		labelValues []string
+		expected    string
+	}{
+		{"none", nil, nil, ""},
+		{"one", []string{"type"}, []string{"NEW"}, `{type="NEW"}`},
+		{"many", []string{"method", "code"}, []string{"GET", "200"}, `{method="GET",code="200"}`},
+		{"backslash", []string{"path"}, []string{`C:\dir`}, `{path="C:\\dir"}`},
+		{"quote", []string{"error"}, []string{`bad "value"`}, `{error="bad \"value\""}`},
+		{"newline", []string{"error"}, []string{"line\nbreak"}, `{error="line\nbreak"}`},
+	}
+	for _, test := range tests {
+		if got := formatLabels(test.labels, test.labelValues); got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{0, "0"},
+		{1, "1"},
+		{0.25, "0.25"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+	for _, test := range tests {
+		if got := formatValue(test.value); got != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, got)
+		}
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := &CounterVec{newVec("updates_total", "Updates by type.", "counter", []string{"type"})}
+	c.Inc("NEW")
+	c.Inc("CHANGED")
+	c.Inc("CHANGED")
+
+	expected := `# HELP updates_total Updates by type.
+# TYPE updates_total counter
+updates_total{type="CHANGED"} 2
+updates_total{type="NEW"} 1
+`
+	if got := written(c); got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	c.Delete("NEW")
+	if got := written(c); strings.Contains(got, "NEW") {
+		t.Fatalf("expected deleted series to be gone, got:\n%s", got)
+	}
+}
+
+func TestHelpEscaping(t *testing.T) {
+	g := &GaugeVec{newVec("g", "Help with \\ and\nnewline.", "gauge", nil)}
+	if got := written(g); !strings.HasPrefix(got, "# HELP g Help with \\\\ and\\nnewline.\n") {
+		t.Fatalf("unexpected help line in:\n%s", got)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	values := map[string]float64{"running": 2, "stopped": 1}
+	g := &GaugeFunc{newVec("services", "Services by state.", "gauge", []string{"state"}), func() map[string]float64 {
+		return values
+	}}
+	expected := `# HELP services Services by state.
+# TYPE services gauge
+services{state="running"} 2
+services{state="stopped"} 1
+`
+	if got := written(g); got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	// values are collected on every scrape, so gone ones are dropped
+	values = map[string]float64{"running": 3}
+	if got := written(g); strings.Contains(got, "stopped") || !strings.Contains(got, `services{state="running"} 3`) {
+		t.Fatalf("unexpected scrape:\n%s", got)
+	}
+
+	// no label
+	unlabeled := &GaugeFunc{newVec("leader", "Leader.", "gauge", nil), func() map[string]float64 {
+		return map[string]float64{"": 1}
+	}}
+	if got := written(unlabeled); !strings.HasSuffix(got, "\nleader 1\n") {
+		t.Fatalf("unexpected scrape:\n%s", got)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := &HistogramVec{newVec("duration_seconds", "Durations.", "histogram", []string{"result"}), []float64{.5, 1}}
+	h.Observe(.25, "success")
+	h.Observe(.5, "success")
+	h.Observe(.75, "success")
+	h.Observe(2, "success")
+
+	// buckets are cumulative, +Inf counts every observation
+	expected := `# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{result="success",le="0.5"} 2
+duration_seconds_bucket{result="success",le="1"} 3
+duration_seconds_bucket{result="success",le="+Inf"} 4
+duration_seconds_sum{result="success"} 3.5
+duration_seconds_count{result="success"} 4
+`
+	if got := written(h); got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	h := &HistogramVec{newVec("d", "D.", "histogram", nil), []float64{1}}
+	h.Observe(3)
+	expected := `# HELP d D.
+# TYPE d histogram
+d_bucket{le="1"} 0
+d_bucket{le="+Inf"} 1
+d_sum 3
+d_count 1
+`
+	if got := written(h); got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestLabelCountMismatchPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on wrong number of label values")
+		}
+	}()
+	c := &CounterVec{newVec("c", "C.", "counter", []string{"a", "b"})}
+	c.Inc("only-one")
+}
+
+func TestHandler(t *testing.T) {
+	c := NewCounterVec("handler_test_total", "Handler test.", "code")
+	c.Inc("200")
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), `handler_test_total{code="200"} 1`) {
+		t.Fatalf("expected registered counter in:\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,219 @@
+// Package notifier sends events operators should know about to webhooks, e.g. Slack.
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Intervention when an error requires human intervention
+	Intervention = "intervention"
+	// LoadBalancerCreated when a service's load-balancer is created
+	LoadBalancerCreated = "load_balancer_created"
+	// LoadBalancerRemoved when a service's load-balancer is removed
+	LoadBalancerRemoved = "load_balancer_removed"
+	// SafetyGuard when the safety guard blocks a destructive action
+	SafetyGuard = "safety_guard"
+
+	webhookTimeout = 10 * time.Second
+	queueSize      = 64
+)
+
+// Event is something operators should know about
+type Event struct {
+	Type    string    `json:"type"`
+	Service string    `json:"service"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Webhook receives events as JSON, rendered by a template
+type Webhook struct {
+	url string
+	// what the webhook is known as in logs, as its URL may hold secrets
+	name     string
+	template *template.Template
+	// event types sent to this webhook, empty meaning all
+	events map[string]bool
+}
+
+// NewWebhook returns a webhook for url, rendering events with tmpl, e.g. `{"text": {{json .Message}}}`.
+// An empty tmpl sends events as they are, and empty events means all event types.
+func NewWebhook(address string, tmpl string, events []string) (*Webhook, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl == "" {
+		tmpl = "{{json .}}"
+	}
+	t, err := template.New(u.Host).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Webhook{
+		url:      address,
+		name:     u.Host,
+		template: t,
+		events:   make(map[string]bool, len(events)),
+	}
+	for _, event := range events {
+		w.events[event] = true
+	}
+	return w, nil
+}
+
+// wants returns whether the webhook is to receive an event type
+func (w *Webhook) wants(eventType string) bool {
+	return len(w.events) == 0 || w.events[eventType]
+}
+
+// send renders an event and posts it to the webhook
+func (w *Webhook) send(client *http.Client, e *Event) error {
+	var payload bytes.Buffer
+	if err := w.template.Execute(&payload, e); err != nil {
+		return err
+	}
+	resp, err := client.Post(w.url, "application/json", &payload)
+	if err != nil {
+		// leave URL out of errors, as it may hold secrets
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unexpected response code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Notifier sends events to webhooks in the background.
+// The same event isn't sent again within the deduplication window,
+// and no more than a maximum of events of each type are sent per minute.
+type Notifier struct {
+	sync.Mutex
+	webhooks     []*Webhook
+	client       *http.Client
+	dedupWindow  time.Duration
+	maxPerMinute int
+	// when each event, keyed by type, service and message, was last sent
+	seen map[string]time.Time
+	// when events of each type were sent within the last minute
+	sent  map[string][]time.Time
+	queue chan *Event
+}
+
+// New returns a notifier for webhooks. Zero dedupWindow or maxPerMinute disables either.
+func New(webhooks []*Webhook, dedupWindow time.Duration, maxPerMinute int) *Notifier {
+	return &Notifier{
+		webhooks:     webhooks,
+		client:       &http.Client{Timeout: webhookTimeout},
+		dedupWindow:  dedupWindow,
+		maxPerMinute: maxPerMinute,
+		seen:         make(map[string]time.Time),
+		sent:         make(map[string][]time.Time),
+		queue:        make(chan *Event, queueSize),
+	}
+}
+
+// Notify queues an event to be sent, unless it's a duplicate or its type is being rate limited.
+// It never blocks.
+func (n *Notifier) Notify(eventType string, serviceName string, message string) {
+	e := &Event{
+		Type:    eventType,
+		Service: serviceName,
+		Message: message,
+		Time:    time.Now(),
+	}
+	if !n.allow(e) {
+		return
+	}
+
+	select {
+	case n.queue <- e:
+	default:
+		glog.Warningf("Dropping notification [%s] for service [%s], queue is full.", eventType, serviceName)
+	}
+}
+
+// allow returns whether an event is to be sent, recording it if so
+func (n *Notifier) allow(e *Event) bool {
+	n.Lock()
+	defer n.Unlock()
+
+	// same event sent recently?
+	key := e.Type + "/" + e.Service + "/" + e.Message
+	if last, ok := n.seen[key]; ok && n.dedupWindow > 0 && e.Time.Sub(last) < n.dedupWindow {
+		return false
+	}
+	for k, last := range n.seen {
+		if e.Time.Sub(last) >= n.dedupWindow {
+			delete(n.seen, k)
+		}
+	}
+
+	// too many events of this type within the last minute?
+	var recent []time.Time
+	for _, sent := range n.sent[e.Type] {
+		if e.Time.Sub(sent) < time.Minute {
+			recent = append(recent, sent)
+		}
+	}
+	if n.maxPerMinute > 0 && len(recent) >= n.maxPerMinute {
+		n.sent[e.Type] = recent
+		glog.Warningf("Rate limiting notification [%s] for service [%s].", e.Type, e.Service)
+		return false
+	}
+
+	n.seen[key] = e.Time
+	n.sent[e.Type] = append(recent, e.Time)
+	return true
+}
+
+// Run sends queued events until done is closed, then sends whatever is still queued
+func (n *Notifier) Run(done <-chan struct{}) {
+	for {
+		select {
+		case e := <-n.queue:
+			n.send(e)
+		case <-done:
+			for {
+				select {
+				case e := <-n.queue:
+					n.send(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send sends an event to every webhook that wants it
+func (n *Notifier) send(e *Event) {
+	for _, w := range n.webhooks {
+		if !w.wants(e.Type) {
+			continue
+		}
+		if err := w.send(n.client, e); err != nil {
+			glog.Errorf("There was an error while sending notification [%s] for service [%s] to [%s]. %s", e.Type, e.Service, w.name, err)
+		}
+	}
+}
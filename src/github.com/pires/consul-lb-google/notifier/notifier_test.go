@@ -0,0 +1,252 @@
+package notifier
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a local webhook, recording payloads it receives
+type receiver struct {
+	sync.Mutex
+	*httptest.Server
+	payloads []string
+	// response code to answer with, defaults to 200
+	status int
+}
+
+func newReceiver(t *testing.T) *receiver {
+	r := &receiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.Lock()
+		defer r.Unlock()
+		r.payloads = append(r.payloads, string(body))
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string{}, r.payloads...)
+}
+
+func newWebhook(t *testing.T, address string, tmpl string, events []string) *Webhook {
+	w, err := NewWebhook(address, tmpl, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// drain runs a notifier until its queue is empty
+func drain(n *Notifier) {
+	done := make(chan struct{})
+	close(done)
+	n.Run(done)
+}
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		check    func(t *testing.T, payload string)
+	}{
+		{
+			name: "default",
+			check: func(t *testing.T, payload string) {
+				var e Event
+				if err := json.Unmarshal([]byte(payload), &e); err != nil {
+					t.Fatal(err)
+				}
+				if e.Type != Intervention || e.Service != "web" || e.Message != `failed "badly"` {
+					t.Fatalf("unexpected event %+v", e)
+				}
+			},
+		},
+		{
+			name:     "custom",
+			template: `{"text": {{json (printf "[%s] %s" .Type .Message)}}}`,
+			check: func(t *testing.T, payload string) {
+				if expected := `{"text": "[intervention] failed \"badly\""}`; payload != expected {
+					t.Fatalf("expected %s, got %s", expected, payload)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newReceiver(t)
+			n := New([]*Webhook{newWebhook(t, r.URL, test.template, nil)}, 0, 0)
+			n.Notify(Intervention, "web", `failed "badly"`)
+			drain(n)
+
+			payloads := r.received()
+			if len(payloads) != 1 {
+				t.Fatalf("expected 1 payload, got %d", len(payloads))
+			}
+			test.check(t, payloads[0])
+		})
+	}
+}
+
+func TestInvalidTemplate(t *testing.T) {
+	if _, err := NewWebhook("http://localhost", "{{", nil); err == nil {
+		t.Fatal("expected invalid template to fail")
+	}
+}
+
+func TestEventFiltering(t *testing.T) {
+	all := newReceiver(t)
+	some := newReceiver(t)
+	n := New([]*Webhook{
+		newWebhook(t, all.URL, "", nil),
+		newWebhook(t, some.URL, "", []string{SafetyGuard}),
+	}, 0, 0)
+	n.Notify(Intervention, "web", "intervene")
+	n.Notify(SafetyGuard, "web", "blocked")
+	n.Notify(LoadBalancerCreated, "web", "created")
+	drain(n)
+
+	if got := len(all.received()); got != 3 {
+		t.Fatalf("expected 3 events for unfiltered webhook, got %d", got)
+	}
+	payloads := some.received()
+	if len(payloads) != 1 {
+		t.Fatalf("expected 1 event for filtered webhook, got %d", len(payloads))
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(payloads[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != SafetyGuard {
+		t.Fatalf("expected %s event, got %s", SafetyGuard, e.Type)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	start := time.Now()
+	at := func(d time.Duration) *Event {
+		return &Event{Type: Intervention, Service: "web", Message: "failed", Time: start.Add(d)}
+	}
+	other := func(d time.Duration, message string) *Event {
+		return &Event{Type: Intervention, Service: "web", Message: message, Time: start.Add(d)}
+	}
+
+	tests := []struct {
+		name         string
+		dedupWindow  time.Duration
+		maxPerMinute int
+		events       []*Event
+		allowed      []bool
+	}{
+		{
+			name:        "duplicate within window",
+			dedupWindow: time.Hour,
+			events:      []*Event{at(0), at(time.Minute)},
+			allowed:     []bool{true, false},
+		},
+		{
+			name:        "duplicate after window",
+			dedupWindow: time.Hour,
+			events:      []*Event{at(0), at(time.Hour)},
+			allowed:     []bool{true, true},
+		},
+		{
+			name:        "different messages",
+			dedupWindow: time.Hour,
+			events:      []*Event{other(0, "a"), other(0, "b")},
+			allowed:     []bool{true, true},
+		},
+		{
+			name:    "dedup disabled",
+			events:  []*Event{at(0), at(0)},
+			allowed: []bool{true, true},
+		},
+		{
+			name:         "rate limited",
+			maxPerMinute: 2,
+			events:       []*Event{other(0, "a"), other(time.Second, "b"), other(2*time.Second, "c")},
+			allowed:      []bool{true, true, false},
+		},
+		{
+			name:         "rate limit after a minute",
+			maxPerMinute: 2,
+			events:       []*Event{other(0, "a"), other(time.Second, "b"), other(time.Minute, "c")},
+			allowed:      []bool{true, true, true},
+		},
+		{
+			name:         "rate limits per type",
+			maxPerMinute: 1,
+			events: []*Event{
+				{Type: Intervention, Message: "a", Time: start},
+				{Type: SafetyGuard, Message: "a", Time: start},
+				{Type: Intervention, Message: "b", Time: start},
+			},
+			allowed: []bool{true, true, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := New(nil, test.dedupWindow, test.maxPerMinute)
+			for i, e := range test.events {
+				if allowed := n.allow(e); allowed != test.allowed[i] {
+					t.Fatalf("event %d: expected allowed %t, got %t", i, test.allowed[i], allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestDrainOnDone(t *testing.T) {
+	r := newReceiver(t)
+	n := New([]*Webhook{newWebhook(t, r.URL, "", nil)}, 0, 0)
+	for _, message := range []string{"a", "b", "c"} {
+		n.Notify(Intervention, "web", message)
+	}
+
+	// queued events are sent before Run returns
+	done := make(chan struct{})
+	close(done)
+	n.Run(done)
+	if got := len(r.received()); got != 3 {
+		t.Fatalf("expected 3 events sent on done, got %d", got)
+	}
+}
+
+func TestNon2xx(t *testing.T) {
+	r := newReceiver(t)
+	r.status = http.StatusInternalServerError
+	w := newWebhook(t, r.URL, "", nil)
+	if err := w.send(http.DefaultClient, &Event{Type: Intervention}); err == nil {
+		t.Fatal("expected non-2xx response to fail")
+	}
+
+	// failures don't stop other events from being sent
+	n := New([]*Webhook{w}, 0, 0)
+	n.Notify(Intervention, "web", "a")
+	n.Notify(Intervention, "web", "b")
+	drain(n)
+	if got := len(r.received()); got != 3 {
+		t.Fatalf("expected 3 attempts, got %d", got)
+	}
+}
+
+func TestUnreachableHidesURL(t *testing.T) {
+	w := newWebhook(t, "http://127.0.0.1:1/secret-token", "", nil)
+	err := w.send(http.DefaultClient, &Event{Type: Intervention})
+	if err == nil {
+		t.Fatal("expected unreachable webhook to fail")
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Fatalf("expected error without URL, got %s", err)
+	}
+}
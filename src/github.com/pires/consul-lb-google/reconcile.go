@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pires/consul-lb-google/cloud"
+	"github.com/pires/consul-lb-google/registry"
+	"github.com/pires/consul-lb-google/resolver"
+
+	"github.com/golang/glog"
+)
+
+// reconcile makes the cloud match the desired state of a service, as last updated by the registry, fixing any drift.
+func reconcile(serviceName string, servicePort string, desired *registry.ServiceUpdate) error {
+	// nothing is known about instances yet, so there's nothing to compare against
+	if desired == nil {
+		return nil
+	}
+	// desired state may be stale while the registry is failing, so leave everything as is
+	if guard.frozen() {
+		glog.Warningf("Registry is unhealthy, not reconciling service [%s].", serviceName)
+		return nil
+	}
+
+	state := &cloud.DesiredState{
+		Instances: make(map[string][]string),
+		Port:      servicePort,
+		Config:    toLoadBalancerConfig(desired.ServiceConfig),
+	}
+	for _, v := range desired.ServiceInstances {
+		name, err := resolveInstance(serviceName, v)
+		if resolver.IsUnresolvable(err) {
+			// reported already, nothing to add for it
+			continue
+		} else if err != nil {
+			// can't tell which instances are desired, so leave everything as is
+			return err
+		}
+		state.Instances[v.Datacenter] = append(state.Instances[v.Datacenter], name)
+	}
+
+	start := time.Now()
+	err := client.Reconcile(serviceName, state)
+	reconcileDuration.Observe(time.Since(start).Seconds(), result(err))
+	return err
+}
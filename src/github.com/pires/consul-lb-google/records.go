@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+	"github.com/pires/consul-lb-google/store"
+
+	"github.com/golang/glog"
+)
+
+// saveRecord records the last applied state of a service, if the store is enabled
+func saveRecord(serviceName string, servicePort string, instances map[string]*registry.ServiceInstance, serviceConfig *registry.ServiceConfig, createdAt time.Time) {
+	if records == nil {
+		return
+	}
+
+	// copy instances, as the handler keeps changing its own
+	recorded := make(map[string]*registry.ServiceInstance, len(instances))
+	for k, v := range instances {
+		recorded[k] = v
+	}
+	record := &store.ServiceRecord{
+		Service:   serviceName,
+		Port:      servicePort,
+		Instances: recorded,
+		Config:    serviceConfig,
+		Resources: client.GetResourceNames(serviceName),
+		CreatedAt: createdAt,
+		UpdatedAt: time.Now(),
+	}
+	if err := records.Put(record); err != nil {
+		glog.Errorf("There was an error while recording state for service [%s]. %s", serviceName, err)
+	}
+}
+
+// forgetRecord removes the recorded state of a service, if the store is enabled
+func forgetRecord(serviceName string) {
+	if records == nil {
+		return
+	}
+
+	if err := records.Delete(serviceName); err != nil {
+		glog.Errorf("There was an error while forgetting recorded state for service [%s]. %s", serviceName, err)
+	}
+}
+
+// recordedService returns the recorded state of a service, if the store is enabled and has one
+func recordedService(serviceName string) (*store.ServiceRecord, bool) {
+	if records == nil {
+		return nil, false
+	}
+	return records.Get(serviceName)
+}
+
+// recordedZones returns the zones a recorded service has instance groups in
+func recordedZones(record *store.ServiceRecord) []string {
+	var zones []string
+	for kind := range record.Resources {
+		if strings.HasPrefix(kind, "instance_group/") {
+			zones = append(zones, strings.TrimPrefix(kind, "instance_group/"))
+		}
+	}
+	return zones
+}
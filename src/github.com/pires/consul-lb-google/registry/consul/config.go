@@ -0,0 +1,158 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+
+	"github.com/golang/glog"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hcl"
+)
+
+// watchConfigs retrieves per-service settings from Consul's KV endpoint, one key per service
+// under the configured prefix, e.g. "consul-lb-gce/config/web".
+// When a service's settings change, all service instances are pushed upstream along with the new settings.
+func (cr *consulRegistry) watchConfigs(upstream chan<- *registry.ServiceUpdate, done <-chan struct{}) {
+	prefix := strings.Trim(cr.configPrefix, "/") + "/"
+	var lastIndex uint64
+	for {
+		select {
+		case <-done: // app is terminating, die
+			return
+		default:
+			// continue
+		}
+
+		pairs, meta, err := cr.client.KV().List(prefix, &consul.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  consulWatchTimeout,
+		})
+		if err != nil {
+			glog.Errorf("Error refreshing service settings at [%s]: %s", prefix, err)
+			cr.health.Fail("configs", err)
+			time.Sleep(consulRetryInterval)
+			continue
+		}
+		cr.health.Clear("configs")
+		// if the index equals the previous one, the watch timed out with no update.
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		configs := make(map[string]*registry.ServiceConfig, len(pairs))
+		for _, pair := range pairs {
+			name := strings.TrimPrefix(pair.Key, prefix)
+			// ignore folders and nested keys
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			config, err := parseServiceConfig(pair.Value)
+			if err != nil {
+				glog.Errorf("Ignoring invalid settings for service [%s] at [%s]: %s", name, pair.Key, err)
+				// keep last known good settings
+				cr.RLock()
+				config = cr.configs[name]
+				cr.RUnlock()
+				if config == nil {
+					continue
+				}
+			}
+			configs[name] = config
+		}
+
+		cr.Lock()
+		select {
+		case <-done: // app is terminating, die
+			cr.Unlock()
+			return
+		default:
+			// continue
+		}
+
+		// find services whose settings were added, changed or removed
+		changed := make(map[string]bool)
+		for name, config := range configs {
+			if !reflect.DeepEqual(cr.configs[name], config) {
+				changed[name] = true
+			}
+		}
+		for name := range cr.configs {
+			if _, ok := configs[name]; !ok {
+				changed[name] = true
+			}
+		}
+		cr.configs = configs
+
+		cr.Unlock()
+
+		// sent without holding the lock, so consumers calling back into the registry meanwhile don't deadlock
+		for name := range changed {
+			glog.Infof("Settings changed for service [%s].", name)
+			if !cr.sendConfig(name, upstream, done) {
+				return
+			}
+		}
+	}
+}
+
+// sendConfig tells upstream about a service's latest settings and instances. As the lock isn't held
+// while sending, a service watcher may have sent newer instances first, so changed instances are sent again.
+// It returns false if done was closed meanwhile.
+func (cr *consulRegistry) sendConfig(name string, upstream chan<- *registry.ServiceUpdate, done <-chan struct{}) bool {
+	var sent map[string]*registry.ServiceInstance
+	for {
+		cr.RLock()
+		service, ok := cr.watchedServices[name]
+		// only tell upstream about services whose instances are known already,
+		// otherwise the service would look like it has no instances.
+		if !ok || service.Instances == nil || (sent != nil && sameInstances(sent, service.Instances)) {
+			cr.RUnlock()
+			return true
+		}
+		update := &registry.ServiceUpdate{
+			ServiceName:      service.Name,
+			UpdateType:       registry.CHANGED,
+			ServiceInstances: service.Instances,
+			ServiceConfig:    cr.configs[name],
+		}
+		cr.RUnlock()
+
+		select {
+		case upstream <- update:
+			sent = update.ServiceInstances
+		case <-done:
+			return false
+		}
+	}
+}
+
+// parseServiceConfig parses per-service settings, either JSON or HCL, e.g.
+//
+//	health_check_path = "/healthz"
+//	frontend_ports = ["80", "8080"]
+func parseServiceConfig(value []byte) (*registry.ServiceConfig, error) {
+	config := new(registry.ServiceConfig)
+	value = bytes.TrimSpace(value)
+	if !bytes.HasPrefix(value, []byte("{")) {
+		// settings are known by their JSON names, so HCL is converted to JSON
+		var document map[string]interface{}
+		// heredocs need their terminator followed by a newline
+		if err := hcl.Decode(&document, string(value)+"\n"); err != nil {
+			return nil, err
+		}
+		var err error
+		if value, err = json.Marshal(document); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(value, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,125 @@
+package consul
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+func TestParseServiceConfig(t *testing.T) {
+	logging := true
+	tests := []struct {
+		name     string
+		value    string
+		expected *registry.ServiceConfig
+	}{
+		{
+			name:  "json",
+			value: `{"health_check_path": "/healthz", "timeout_sec": 30, "frontend_ports": ["80", "8080"], "firewall_logging": true}`,
+			expected: &registry.ServiceConfig{
+				HealthCheckPath: "/healthz",
+				TimeoutSec:      30,
+				FrontendPorts:   []string{"80", "8080"},
+				FirewallLogging: &logging,
+			},
+		},
+		{
+			name: "hcl",
+			value: `
+# comments are allowed
+health_check_path = "/healthz"
+timeout_sec = 30
+frontend_ports = ["80", "8080"]
+firewall_logging = true
+`,
+			expected: &registry.ServiceConfig{
+				HealthCheckPath: "/healthz",
+				TimeoutSec:      30,
+				FrontendPorts:   []string{"80", "8080"},
+				FirewallLogging: &logging,
+			},
+		},
+		{
+			name: "hcl heredoc",
+			value: `
+health_check_path = <<EOT
+/healthz
+EOT
+`,
+			expected: &registry.ServiceConfig{
+				HealthCheckPath: "/healthz\n",
+			},
+		},
+		{
+			name:     "empty",
+			value:    "",
+			expected: &registry.ServiceConfig{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := parseServiceConfig([]byte(test.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config, test.expected) {
+				t.Fatalf("expected %+v, got %+v", test.expected, config)
+			}
+		})
+	}
+}
+
+func TestParseServiceConfigInvalid(t *testing.T) {
+	for _, value := range []string{`{"timeout_sec": "30"`, `timeout_sec = "30"`, `frontend_ports = [80]`} {
+		if _, err := parseServiceConfig([]byte(value)); err == nil {
+			t.Fatalf("expected %q to fail", value)
+		}
+	}
+}
+
+func TestSendConfig(t *testing.T) {
+	cr := &consulRegistry{
+		watchedServices: make(map[string]*consulService),
+		configs:         map[string]*registry.ServiceConfig{"web": {HealthCheckPath: "/healthz"}},
+	}
+	service := cr.newService("web")
+	service.Instances = instances(map[string]string{"n1": "80"})
+	cr.watchedServices["web"] = service
+
+	upstream := make(chan *registry.ServiceUpdate)
+	sent := make(chan bool)
+	go func() {
+		sent <- cr.sendConfig("web", upstream, nil)
+	}()
+
+	// lock isn't held while sending, so instances may change meanwhile
+	cr.Lock()
+	service.Instances = instances(map[string]string{"n1": "80", "n2": "80"})
+	cr.Unlock()
+
+	// whichever instances were sent first, the latest ones are sent last
+	var update *registry.ServiceUpdate
+	for update = range upstream {
+		if len(update.ServiceInstances) == 2 {
+			break
+		}
+	}
+	if update.ServiceConfig.HealthCheckPath != "/healthz" {
+		t.Fatalf("expected settings sent, got %+v", update.ServiceConfig)
+	}
+	if !<-sent {
+		t.Fatal("expected settings sent")
+	}
+}
+
+func TestSendConfigUnknownInstances(t *testing.T) {
+	cr := &consulRegistry{
+		watchedServices: map[string]*consulService{"web": {}},
+		configs:         make(map[string]*registry.ServiceConfig),
+	}
+	// nothing's sent, as the service would look like it has no instances
+	if !cr.sendConfig("web", nil, nil) || !cr.sendConfig("api", nil, nil) {
+		t.Fatal("expected nothing to send")
+	}
+}
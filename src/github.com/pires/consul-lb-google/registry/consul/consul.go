@@ -15,6 +15,8 @@ import (
 const (
 	consulWatchTimeout  = 30 * time.Second
 	consulRetryInterval = 15 * time.Second
+	// how often all watched services are fetched again when multiplexing, as port changes don't show in health checks
+	consulRefreshInterval = 5 * time.Minute
 )
 
 var (
@@ -28,15 +30,28 @@ type consulRegistry struct {
 	sync.RWMutex
 	watchedServices map[string]*consulService
 	tagsToWatch     []string
+	// datacenters to watch, an empty name means the agent's own datacenter
+	datacenters []string
+	// services (and their tags) as last reported by each datacenter
+	datacenterServices map[string]map[string][]string
+	// where per-service settings are kept, empty means disabled
+	configPrefix string
+	// per-service settings, e.g. config := configs["web"]
+	configs map[string]*registry.ServiceConfig
+	// whether to watch all services with a single blocking query per datacenter
+	multiplex bool
+	// failing queries, keyed by what's being queried
+	health registry.Health
 }
 
 // consulService contains data belonging to the same service.
 type consulService struct {
 	registry.Service
-	lastIndex uint64
-	removed   bool
-	running   bool
-	done      chan struct{}
+	// instances as last reported by each datacenter
+	datacenterInstances map[string]map[string]*registry.ServiceInstance
+	removed             bool
+	running             bool
+	done                chan struct{}
 }
 
 // NewRegistry returns a Consul-backed service registry
@@ -55,22 +70,75 @@ func NewRegistry(config *registry.Config) (registry.Registry, error) {
 		return nil, err
 	}
 
+	// no datacenters means the agent's own datacenter
+	datacenters := config.Datacenters
+	if len(datacenters) == 0 {
+		datacenters = []string{""}
+	}
+
 	// prepare registry
 	return &consulRegistry{
-		client:          client,
-		watchedServices: make(map[string]*consulService),
-		tagsToWatch:     config.TagsToWatch,
+		client:             client,
+		watchedServices:    make(map[string]*consulService),
+		tagsToWatch:        config.TagsToWatch,
+		datacenters:        datacenters,
+		datacenterServices: make(map[string]map[string][]string, len(datacenters)),
+		configPrefix:       config.ConfigPrefix,
+		configs:            make(map[string]*registry.ServiceConfig),
+		multiplex:          config.Multiplex,
 	}, nil
 }
 
+// Healthy returns whether the latest Consul queries succeeded
+func (cr *consulRegistry) Healthy() bool {
+	return cr.health.Healthy()
+}
+
+// LastProgress returns when Consul last answered any query
+func (cr *consulRegistry) LastProgress() time.Time {
+	return cr.health.LastProgress()
+}
+
+// Listed returns whether every datacenter's services have been sent upstream at least once
+func (cr *consulRegistry) Listed() bool {
+	return cr.health.AllListed()
+}
+
 func (cr *consulRegistry) Run(upstream chan<- *registry.ServiceUpdate, done <-chan struct{}) {
 	defer close(upstream)
 	// stop all service watchers
 	defer cr.stop()
 
+	// every datacenter is to list its services
+	for _, dc := range cr.datacenters {
+		cr.health.Expect("services/" + dc)
+	}
+
+	// watch per-service settings, if enabled.
+	// settings are sent without holding the lock, so upstream is only closed once they're no longer sent.
+	if cr.configPrefix != "" {
+		configsStopped := make(chan struct{})
+		go func() {
+			cr.watchConfigs(upstream, done)
+			close(configsStopped)
+		}()
+		defer func() { <-configsStopped }()
+	}
+
+	// multiplexed watchers send updates upstream themselves
+	if cr.multiplex {
+		for _, dc := range cr.datacenters {
+			go cr.watchAll(dc, upstream, done)
+		}
+		<-done
+		return
+	}
+
 	// internal update channel
 	update := make(chan *consulService, 16)
-	go cr.watchServices(update, done)
+	for _, dc := range cr.datacenters {
+		go cr.watchServices(dc, update, done)
+	}
 
 	for {
 		select {
@@ -91,7 +159,9 @@ func (cr *consulRegistry) Run(upstream chan<- *registry.ServiceUpdate, done <-ch
 			// it wasn't removed, so launch watcher for service
 			// but only if it wasn't running in the first place
 			if !srv.running {
-				go cr.watchService(srv, upstream)
+				for _, dc := range cr.datacenters {
+					go cr.watchService(srv, dc, upstream)
+				}
 				srv.running = true
 				upstream <- &registry.ServiceUpdate{
 					ServiceName: srv.Name,
@@ -113,24 +183,29 @@ func (cr *consulRegistry) stop() {
 	}
 }
 
-// watchServices retrieves updates from Consul's services endpoint and sends
-// potential updates to the update channel.
-func (cr *consulRegistry) watchServices(update chan<- *consulService, done <-chan struct{}) {
+// watchServices retrieves updates from Consul's services endpoint for a datacenter
+// and sends potential updates to the update channel.
+// Services are merged across all watched datacenters, so a service is only
+// considered removed once it's gone from every datacenter.
+func (cr *consulRegistry) watchServices(dc string, update chan<- *consulService, done <-chan struct{}) {
 	var lastIndex uint64
 	for {
 		// ask Consul about services
 		catalog := cr.client.Catalog()
-		services, meta, err := catalog.Services(&consul.QueryOptions{
+		dcServices, meta, err := catalog.Services(&consul.QueryOptions{
+			Datacenter: dc,
 			// is we have previously asked, then we should behave and wait for changes
 			WaitIndex: lastIndex,
 			WaitTime:  consulWatchTimeout,
 		})
 		if err != nil {
-			glog.Errorf("Error refreshing service list: %s", err)
+			glog.Errorf("Error refreshing service list in datacenter [%s]: %s", dc, err)
+			cr.health.Fail("services/"+dc, err)
 			// failure here is not catastrophic, so retry
 			time.Sleep(consulRetryInterval)
 			continue
 		}
+		cr.health.Clear("services/" + dc)
 		// if the index equals the previous one, the watch timed out with no update.
 		if meta.LastIndex == lastIndex {
 			continue
@@ -145,32 +220,24 @@ func (cr *consulRegistry) watchServices(update chan<- *consulService, done <-cha
 		default:
 			// continue
 		}
+		cr.datacenterServices[dc] = dcServices
+		services := cr.mergedServices()
 		// check for services not yet cached locally.
 		for k, v := range services {
 			// ignore all but the ones with specified tags
-			ignore := true
-			// iterate service tags
-			for tag := range v {
-				// iterate possible tags and compare
-				for tagToWatch := range cr.tagsToWatch {
-					if tag == tagToWatch {
-						ignore = false
-						// TODO add tag to watchedService
-					}
-				}
-			}
-			// have any of the tags to be watched been found?
-			if ignore {
+			if !cr.hasTagToWatch(v) {
 				continue
 			}
 
 			// is it a new service?
 			service, ok := cr.watchedServices[k]
 			if !ok { // yes
-				service = new(consulService)
-				service.Name = k
-				service.done = make(chan struct{})
+				service = cr.newService(k)
 				cr.watchedServices[k] = service
+				// listing isn't done until every datacenter's watcher sent the service's instances
+				for _, serviceDC := range cr.datacenters {
+					cr.health.Expect("service/" + k + "/" + serviceDC)
+				}
 				// since src.running == false, registry will start watching this service
 				// before sending updates upstream
 				update <- service
@@ -187,39 +254,96 @@ func (cr *consulRegistry) watchServices(update chan<- *consulService, done <-cha
 			}
 		}
 		cr.Unlock()
+		cr.health.Listed("services/" + dc)
+	}
+}
+
+// hasTagToWatch returns whether any of the specified service tags is to be watched
+func (cr *consulRegistry) hasTagToWatch(tags []string) bool {
+	for _, tag := range tags {
+		for _, tagToWatch := range cr.tagsToWatch {
+			if tag == tagToWatch {
+				// TODO add tag to watchedService
+				return true
+			}
+		}
 	}
+	return false
 }
 
-// watchService retrieves updates about a service from Consul's service endpoint.
-// On a potential update, all service instances are pushed upstream.
-func (cr *consulRegistry) watchService(service *consulService, upstream chan<- *registry.ServiceUpdate) {
+// newService returns a service to be watched
+func (cr *consulRegistry) newService(name string) *consulService {
+	service := new(consulService)
+	service.Name = name
+	service.datacenterInstances = make(map[string]map[string]*registry.ServiceInstance, len(cr.datacenters))
+	service.done = make(chan struct{})
+	return service
+}
+
+// mergeInstances merges a service's instances from all datacenters, keyed by node.
+// Node names may repeat across datacenters, e.g. GCE instance names are only unique per zone,
+// so nodes found in more than one datacenter are keyed by datacenter and node instead, e.g. "dc1/node".
+// Must be called with the registry lock held.
+func (cr *consulRegistry) mergeInstances(service *consulService) {
+	// how many datacenters each node is found in
+	found := make(map[string]int)
+	for _, dcInstances := range service.datacenterInstances {
+		for node := range dcInstances {
+			found[node]++
+		}
+	}
+	service.Instances = make(map[string]*registry.ServiceInstance)
+	for dc, dcInstances := range service.datacenterInstances {
+		for node, instance := range dcInstances {
+			if found[node] > 1 {
+				glog.Warningf("Node [%s] of service [%s] is found in many datacenters, telling it apart by datacenter [%s].", node, service.Name, dc)
+				node = dc + "/" + node
+			}
+			service.Instances[node] = instance
+		}
+	}
+}
+
+// mergedServices returns the union of services known to all watched datacenters.
+// Must be called with the registry lock held.
+func (cr *consulRegistry) mergedServices() map[string][]string {
+	services := make(map[string][]string)
+	for _, dcServices := range cr.datacenterServices {
+		for name, tags := range dcServices {
+			services[name] = append(services[name], tags...)
+		}
+	}
+	return services
+}
+
+// watchService retrieves updates about a service in a datacenter from Consul's service endpoint.
+// On a potential update, all service instances, merged across datacenters, are pushed upstream.
+func (cr *consulRegistry) watchService(service *consulService, dc string, upstream chan<- *registry.ServiceUpdate) {
+	var lastIndex uint64
 	catalog := cr.client.Catalog()
+	key := "service/" + service.Name + "/" + dc
+	// a stopped watcher is no longer failing, nor listing
+	defer cr.health.Clear(key)
+	defer cr.health.Listed(key)
 	for {
 		nodes, meta, err := catalog.Service(service.Name, "", &consul.QueryOptions{
-			WaitIndex: service.lastIndex,
-			WaitTime:  consulWatchTimeout,
+			Datacenter: dc,
+			WaitIndex:  lastIndex,
+			WaitTime:   consulWatchTimeout,
 		})
 		if err != nil {
-			glog.Errorf("Error refreshing service %s: %s", service.Name, err)
+			glog.Errorf("Error refreshing service %s in datacenter [%s]: %s", service.Name, dc, err)
+			cr.health.Fail(key, err)
 			time.Sleep(consulRetryInterval)
 			continue
 		}
+		cr.health.Clear(key)
 		// If the index equals the previous one, the watch timed out with no update.
-		if meta.LastIndex == service.lastIndex {
+		if meta.LastIndex == lastIndex {
 			continue
 		}
-		service.lastIndex = meta.LastIndex
-		service.Instances = make(map[string]*registry.ServiceInstance, len(nodes))
-
-		for _, node := range nodes {
-			service.Instances[node.Node] = &registry.ServiceInstance{
-				Host:    node.Node,
-				Address: node.Address,
-				Tags:    node.ServiceTags,
-				Port:    strconv.Itoa(node.ServicePort),
-				// ServiceId:   node.ServiceID,
-			}
-		}
+		lastIndex = meta.LastIndex
+		instances := toInstances(nodes, dc)
 
 		cr.Lock()
 		select {
@@ -230,12 +354,34 @@ func (cr *consulRegistry) watchService(service *consulService, upstream chan<- *
 			// continue
 		}
 
+		// merge instances from all datacenters.
+		service.datacenterInstances[dc] = instances
+		cr.mergeInstances(service)
+
 		// tell upstream about the updates
 		upstream <- &registry.ServiceUpdate{
 			ServiceName:      service.Name,
 			UpdateType:       registry.CHANGED,
 			ServiceInstances: service.Instances,
+			ServiceConfig:    cr.configs[service.Name],
 		}
 		cr.Unlock()
+		cr.health.Listed(key)
+	}
+}
+
+// toInstances converts Consul catalog entries for a service in a datacenter to service instances, keyed by node
+func toInstances(nodes []*consul.CatalogService, dc string) map[string]*registry.ServiceInstance {
+	instances := make(map[string]*registry.ServiceInstance, len(nodes))
+	for _, node := range nodes {
+		instances[node.Node] = &registry.ServiceInstance{
+			Host:       node.Node,
+			Address:    node.Address,
+			Tags:       node.ServiceTags,
+			Port:       strconv.Itoa(node.ServicePort),
+			Datacenter: dc,
+			// ServiceId:   node.ServiceID,
+		}
 	}
+	return instances
 }
@@ -0,0 +1,63 @@
+package consul
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+func TestMergeInstances(t *testing.T) {
+	instance := func(node string, dc string) *registry.ServiceInstance {
+		return &registry.ServiceInstance{Host: node, Datacenter: dc, Port: "80"}
+	}
+
+	tests := []struct {
+		name string
+		// instances as last reported by each datacenter
+		datacenterInstances map[string]map[string]*registry.ServiceInstance
+		expected            map[string]*registry.ServiceInstance
+	}{
+		{
+			name:                "single datacenter",
+			datacenterInstances: map[string]map[string]*registry.ServiceInstance{"dc1": {"n1": instance("n1", "dc1")}},
+			expected:            map[string]*registry.ServiceInstance{"n1": instance("n1", "dc1")},
+		},
+		{
+			name: "distinct nodes",
+			datacenterInstances: map[string]map[string]*registry.ServiceInstance{
+				"dc1": {"n1": instance("n1", "dc1")},
+				"dc2": {"n2": instance("n2", "dc2")},
+			},
+			expected: map[string]*registry.ServiceInstance{"n1": instance("n1", "dc1"), "n2": instance("n2", "dc2")},
+		},
+		{
+			name: "node name shared by datacenters",
+			datacenterInstances: map[string]map[string]*registry.ServiceInstance{
+				"dc1": {"n1": instance("n1", "dc1"), "n2": instance("n2", "dc1")},
+				"dc2": {"n1": instance("n1", "dc2")},
+			},
+			expected: map[string]*registry.ServiceInstance{
+				"dc1/n1": instance("n1", "dc1"),
+				"dc2/n1": instance("n1", "dc2"),
+				"n2":     instance("n2", "dc1"),
+			},
+		},
+		{
+			name:                "no instances",
+			datacenterInstances: map[string]map[string]*registry.ServiceInstance{"dc1": {}},
+			expected:            map[string]*registry.ServiceInstance{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cr := &consulRegistry{}
+			service := cr.newService("web")
+			service.datacenterInstances = test.datacenterInstances
+			cr.mergeInstances(service)
+			if !reflect.DeepEqual(service.Instances, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, service.Instances)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package consul
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	leaderSessionName = "consul-lb-gce"
+)
+
+var (
+	// ErrNoLockKey when no leader lock key has been specified
+	ErrNoLockKey = errors.New("No leader lock key specified")
+)
+
+// Leader campaigns for leadership amongst many replicas through a Consul session-based lock.
+type Leader struct {
+	client *consul.Client
+	key    string
+	sync.RWMutex
+	leading bool
+	// when leadership was last acquired or lost
+	since time.Time
+}
+
+// NewLeader returns a Consul-backed leader election on the specified KV key
+func NewLeader(address string, key string) (*Leader, error) {
+	// validate arguments
+	if address == "" {
+		return nil, ErrNoAddress
+	}
+	if key == "" {
+		return nil, ErrNoLockKey
+	}
+
+	// connect to Consul
+	clientConfig := consul.DefaultConfig()
+	clientConfig.Address = address
+	client, err := consul.NewClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Leader{
+		client: client,
+		key:    key,
+		since:  time.Now(),
+	}, nil
+}
+
+// IsLeader returns whether this replica currently holds the lock
+func (l *Leader) IsLeader() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.leading
+}
+
+// Since returns when leadership was last acquired or lost
+func (l *Leader) Since() time.Time {
+	l.RLock()
+	defer l.RUnlock()
+	return l.since
+}
+
+// Run campaigns for leadership until done is closed.
+// Every leadership change is sent to changes, true meaning leadership was acquired.
+func (l *Leader) Run(changes chan<- bool, done <-chan struct{}) {
+	for {
+		lock, err := l.client.LockOpts(&consul.LockOptions{
+			Key:         l.key,
+			SessionName: leaderSessionName,
+		})
+		if err != nil {
+			glog.Errorf("Error preparing leader lock [%s]: %s", l.key, err)
+			if !l.sleep(done) {
+				return
+			}
+			continue
+		}
+
+		// block until lock is acquired or done is closed
+		glog.Infof("Campaigning for leadership on [%s]..", l.key)
+		lost, err := lock.Lock(done)
+		if err != nil {
+			glog.Errorf("Error acquiring leader lock [%s]: %s", l.key, err)
+			if !l.sleep(done) {
+				return
+			}
+			continue
+		}
+		// nil channel means done was closed before acquiring lock
+		if lost == nil {
+			return
+		}
+
+		glog.Infof("Acquired leadership on [%s].", l.key)
+		l.set(true)
+		if !l.notify(changes, true, done) {
+			lock.Unlock()
+			return
+		}
+
+		select {
+		case <-lost:
+			glog.Warningf("Lost leadership on [%s].", l.key)
+			// stop acting as leader right away, as another replica may take the lock meanwhile
+			l.set(false)
+			notified := l.notify(changes, false, done)
+			// clean-up session, best-effort as the lock is gone already
+			if err := lock.Unlock(); err != nil {
+				glog.Errorf("Error releasing lost leader lock [%s]: %s", l.key, err)
+			}
+			if !notified {
+				return
+			}
+			// give others a chance before campaigning again
+			if !l.sleep(done) {
+				return
+			}
+		case <-done:
+			glog.Infof("Releasing leadership on [%s]..", l.key)
+			if err := lock.Unlock(); err != nil {
+				glog.Errorf("Error releasing leader lock [%s]: %s", l.key, err)
+			}
+			l.set(false)
+			return
+		}
+	}
+}
+
+func (l *Leader) set(leading bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.leading = leading
+	l.since = time.Now()
+}
+
+// notify sends a leadership change upstream, returning false if done was closed meanwhile.
+func (l *Leader) notify(changes chan<- bool, leading bool, done <-chan struct{}) bool {
+	select {
+	case changes <- leading:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// sleep waits before retrying, returning false if done was closed meanwhile.
+func (l *Leader) sleep(done <-chan struct{}) bool {
+	select {
+	case <-time.After(consulRetryInterval):
+		return true
+	case <-done:
+		return false
+	}
+}
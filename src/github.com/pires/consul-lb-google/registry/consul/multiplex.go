@@ -0,0 +1,227 @@
+package consul
+
+import (
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+
+	"github.com/golang/glog"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// watchAll retrieves updates from Consul's services endpoint for a datacenter, with a single
+// blocking query, instead of one blocking query per service. The services index changes
+// whenever any service instance is registered, changed or deregistered.
+// On every change, a single health state query tells which watched services' members changed,
+// and only those are fetched again. Only services whose members or ports actually changed
+// are pushed upstream.
+func (cr *consulRegistry) watchAll(dc string, upstream chan<- *registry.ServiceUpdate, done <-chan struct{}) {
+	var lastIndex uint64
+	// when all watched services were last fetched, as ports may change without members changing
+	var refreshedAt time.Time
+	catalog := cr.client.Catalog()
+	for {
+		dcServices, meta, err := catalog.Services(&consul.QueryOptions{
+			Datacenter: dc,
+			WaitIndex:  lastIndex,
+			WaitTime:   consulWatchTimeout,
+		})
+		if err != nil {
+			glog.Errorf("Error refreshing service list in datacenter [%s]: %s", dc, err)
+			cr.health.Fail("services/"+dc, err)
+			// failure here is not catastrophic, so retry
+			time.Sleep(consulRetryInterval)
+			continue
+		}
+		refresh := time.Since(refreshedAt) > consulRefreshInterval
+
+		// services to watch go by tags merged across datacenters, so other datacenters' tags
+		// may have a service of this datacenter watched without its instances fetched yet
+		cr.RLock()
+		names := cr.servicesToWatch(dc, dcServices)
+		cached := make(map[string]map[string]*registry.ServiceInstance, len(names))
+		for _, name := range names {
+			if service, ok := cr.watchedServices[name]; ok {
+				if instances, ok := service.datacenterInstances[dc]; ok {
+					cached[name] = instances
+				}
+			}
+		}
+		cr.RUnlock()
+
+		// if the index equals the previous one, the watch timed out with no update.
+		if meta.LastIndex == lastIndex && !refresh && len(cached) == len(names) {
+			cr.health.Clear("services/" + dc)
+			continue
+		}
+
+		// fetch instances of watched services in this datacenter, without blocking
+		dcInstances, err := cr.fetchInstances(dc, names, cached, refresh)
+		if err != nil {
+			glog.Errorf("Error refreshing services in datacenter [%s]: %s", dc, err)
+			cr.health.Fail("services/"+dc, err)
+			// don't move the index forward, so it's all retried
+			time.Sleep(consulRetryInterval)
+			continue
+		}
+		cr.health.Clear("services/" + dc)
+		lastIndex = meta.LastIndex
+		if refresh {
+			refreshedAt = time.Now()
+		}
+
+		cr.Lock()
+		select {
+		case <-done: // app is terminating, die
+			cr.Unlock()
+			return
+		default:
+			// continue
+		}
+		cr.datacenterServices[dc] = dcServices
+		services := cr.mergedServices()
+
+		// check for services not yet cached locally.
+		for name, tags := range services {
+			if !cr.hasTagToWatch(tags) {
+				continue
+			}
+			service, ok := cr.watchedServices[name]
+			if !ok {
+				service = cr.newService(name)
+				service.running = true
+				cr.watchedServices[name] = service
+				upstream <- &registry.ServiceUpdate{
+					ServiceName: name,
+					UpdateType:  registry.NEW,
+				}
+			}
+
+			// only tell upstream about actual changes
+			actual, ok := service.datacenterInstances[dc]
+			if ok == (dcInstances[name] != nil) && sameInstances(actual, dcInstances[name]) {
+				continue
+			}
+			if dcInstances[name] == nil {
+				delete(service.datacenterInstances, dc)
+			} else {
+				service.datacenterInstances[dc] = dcInstances[name]
+			}
+			cr.mergeInstances(service)
+			upstream <- &registry.ServiceUpdate{
+				ServiceName:      name,
+				UpdateType:       registry.CHANGED,
+				ServiceInstances: service.Instances,
+				ServiceConfig:    cr.configs[name],
+			}
+		}
+
+		// check for deleted services we should remove from cache
+		for name, srv := range cr.watchedServices {
+			if _, ok := services[name]; !ok {
+				close(srv.done)
+				delete(cr.watchedServices, name)
+				upstream <- &registry.ServiceUpdate{
+					ServiceName: name,
+					UpdateType:  registry.DELETED,
+				}
+			}
+		}
+		cr.Unlock()
+		cr.health.Listed("services/" + dc)
+	}
+}
+
+// servicesToWatch returns the services of a datacenter to watch, as if it reported dcServices,
+// going by their tags merged across all datacenters.
+// Must be called with the registry lock held.
+func (cr *consulRegistry) servicesToWatch(dc string, dcServices map[string][]string) []string {
+	var names []string
+	for name, tags := range dcServices {
+		merged := append([]string{}, tags...)
+		for other, otherServices := range cr.datacenterServices {
+			if other != dc {
+				merged = append(merged, otherServices[name]...)
+			}
+		}
+		if cr.hasTagToWatch(merged) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// fetchInstances returns the instances of services in a datacenter, keyed by service.
+// Health checks tell which nodes services are registered on, so services whose nodes are the same
+// as cached aren't fetched again, unless all are to be. Services without health checks always are.
+func (cr *consulRegistry) fetchInstances(dc string, names []string, cached map[string]map[string]*registry.ServiceInstance, all bool) (map[string]map[string]*registry.ServiceInstance, error) {
+	var members map[string]map[string]bool
+	if !all {
+		checks, _, err := cr.client.Health().State("any", &consul.QueryOptions{Datacenter: dc})
+		if err != nil {
+			return nil, err
+		}
+		members = toMembers(checks)
+	}
+
+	catalog := cr.client.Catalog()
+	dcInstances := make(map[string]map[string]*registry.ServiceInstance, len(names))
+	for _, name := range names {
+		if instances, ok := cached[name]; ok && sameMembers(instances, members[name]) {
+			dcInstances[name] = instances
+			continue
+		}
+		nodes, _, err := catalog.Service(name, "", &consul.QueryOptions{Datacenter: dc})
+		if err != nil {
+			return nil, err
+		}
+		dcInstances[name] = toInstances(nodes, dc)
+	}
+	return dcInstances, nil
+}
+
+// toMembers returns the nodes each service is registered on, keyed by service, as far as health checks tell
+func toMembers(checks []*consul.HealthCheck) map[string]map[string]bool {
+	members := make(map[string]map[string]bool)
+	for _, check := range checks {
+		// node checks don't belong to any service
+		if check.ServiceName == "" {
+			continue
+		}
+		if members[check.ServiceName] == nil {
+			members[check.ServiceName] = make(map[string]bool)
+		}
+		members[check.ServiceName][check.Node] = true
+	}
+	return members
+}
+
+// sameMembers returns whether instances are on the same nodes as members.
+// No members means nothing's known, as a service may have no health checks.
+func sameMembers(instances map[string]*registry.ServiceInstance, members map[string]bool) bool {
+	if len(members) == 0 || len(instances) != len(members) {
+		return false
+	}
+	for node := range instances {
+		if !members[node] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameInstances returns whether instances are on the same nodes, addresses and ports.
+// Other changes, e.g. tags, don't matter to load-balancing.
+func sameInstances(a map[string]*registry.ServiceInstance, b map[string]*registry.ServiceInstance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for node, instance := range a {
+		other, ok := b[node]
+		// the address resolver looks up cloud instances by address
+		if !ok || other.Port != instance.Port || other.Address != instance.Address {
+			return false
+		}
+	}
+	return true
+}
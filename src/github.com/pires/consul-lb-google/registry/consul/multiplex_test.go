@@ -0,0 +1,93 @@
+package consul
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/pires/consul-lb-google/registry"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestServicesToWatch(t *testing.T) {
+	cr := &consulRegistry{
+		tagsToWatch: []string{"lb"},
+		datacenterServices: map[string]map[string][]string{
+			"dc1": {"web": {"lb"}, "api": {"other"}},
+			"dc2": {"api": {"lb"}, "db": {"other"}},
+		},
+	}
+
+	// api is only tagged in dc2, but its dc1 instances are watched as well
+	names := cr.servicesToWatch("dc1", map[string][]string{"web": {"lb"}, "api": {"other"}, "cache": {"other"}})
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "api" || names[1] != "web" {
+		t.Fatalf("expected [api web], got %v", names)
+	}
+
+	// dc2's own previous tags don't count, only what it reports now
+	names = cr.servicesToWatch("dc2", map[string][]string{"api": {"other"}})
+	if len(names) != 0 {
+		t.Fatalf("expected nothing to watch, got %v", names)
+	}
+}
+
+func instances(ports map[string]string) map[string]*registry.ServiceInstance {
+	out := make(map[string]*registry.ServiceInstance, len(ports))
+	for node, port := range ports {
+		out[node] = &registry.ServiceInstance{Host: node, Port: port}
+	}
+	return out
+}
+
+func TestSameMembers(t *testing.T) {
+	members := toMembers([]*consul.HealthCheck{
+		{Node: "n1", CheckID: "serfHealth"},
+		{Node: "n1", ServiceName: "web", ServiceID: "web"},
+		{Node: "n1", ServiceName: "web", ServiceID: "web", CheckID: "other"},
+		{Node: "n2", ServiceName: "web", ServiceID: "web"},
+	})
+
+	tests := []struct {
+		name      string
+		instances map[string]*registry.ServiceInstance
+		members   map[string]bool
+		expected  bool
+	}{
+		{"same nodes", instances(map[string]string{"n1": "80", "n2": "80"}), members["web"], true},
+		{"node added", instances(map[string]string{"n1": "80"}), members["web"], false},
+		{"node replaced", instances(map[string]string{"n1": "80", "n3": "80"}), members["web"], false},
+		{"no health checks", instances(map[string]string{"n1": "80"}), members["api"], false},
+	}
+	for _, test := range tests {
+		if got := sameMembers(test.instances, test.members); got != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestSameInstances(t *testing.T) {
+	retagged := instances(map[string]string{"n1": "80"})
+	retagged["n1"].Tags = []string{"new"}
+	readdressed := instances(map[string]string{"n1": "80"})
+	readdressed["n1"].Address = "10.0.0.2"
+
+	tests := []struct {
+		name     string
+		a, b     map[string]*registry.ServiceInstance
+		expected bool
+	}{
+		{"same", instances(map[string]string{"n1": "80"}), instances(map[string]string{"n1": "80"}), true},
+		{"tags don't matter", instances(map[string]string{"n1": "80"}), retagged, true},
+		{"address changed", instances(map[string]string{"n1": "80"}), readdressed, false},
+		{"port changed", instances(map[string]string{"n1": "80"}), instances(map[string]string{"n1": "8080"}), false},
+		{"node added", instances(map[string]string{"n1": "80"}), instances(map[string]string{"n1": "80", "n2": "80"}), false},
+		{"node replaced", instances(map[string]string{"n1": "80"}), instances(map[string]string{"n2": "80"}), false},
+		{"both empty", nil, instances(nil), true},
+	}
+	for _, test := range tests {
+		if got := sameInstances(test.a, test.b); got != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package consul
+
+import (
+	"net/url"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// NodeMetaReader reads Consul nodes' metadata, which the vendored API client predates
+type NodeMetaReader struct {
+	client *consul.Client
+}
+
+// NewNodeMetaReader returns a reader of node metadata from the Consul agent at address
+func NewNodeMetaReader(address string) (*NodeMetaReader, error) {
+	// validate arguments
+	if address == "" {
+		return nil, ErrNoAddress
+	}
+
+	// connect to Consul
+	clientConfig := consul.DefaultConfig()
+	clientConfig.Address = address
+	client, err := consul.NewClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NodeMetaReader{client: client}, nil
+}
+
+// Meta returns the metadata of a node in the specified datacenter, nil if the node doesn't exist
+func (r *NodeMetaReader) Meta(node string, datacenter string) (map[string]string, error) {
+	var out struct {
+		Node *struct {
+			Meta map[string]string
+		}
+	}
+	if _, err := r.client.Raw().Query("/v1/catalog/node/"+url.PathEscape(node), &out, &consul.QueryOptions{Datacenter: datacenter}); err != nil {
+		return nil, err
+	}
+	if out.Node == nil {
+		return nil, nil
+	}
+	// non-nil, so nodes without metadata can be told from missing ones
+	if out.Node.Meta == nil {
+		return map[string]string{}, nil
+	}
+	return out.Node.Meta, nil
+}
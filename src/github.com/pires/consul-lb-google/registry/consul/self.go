@@ -0,0 +1,63 @@
+package consul
+
+import (
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	selfCheckInterval = "10s"
+	selfCheckTimeout  = "5s"
+)
+
+// SelfRegistration registers the manager itself as a service in the local Consul agent,
+// so it can be discovered and its health checked.
+type SelfRegistration struct {
+	client *consul.Client
+	id     string
+}
+
+// NewSelfRegistration returns a registration of the manager as a service with the specified ID
+func NewSelfRegistration(address string, id string) (*SelfRegistration, error) {
+	// validate arguments
+	if address == "" {
+		return nil, ErrNoAddress
+	}
+
+	// connect to Consul
+	clientConfig := consul.DefaultConfig()
+	clientConfig.Address = address
+	client, err := consul.NewClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SelfRegistration{
+		client: client,
+		id:     id,
+	}, nil
+}
+
+// Register registers the manager as a service named name, reachable at host and port,
+// with an HTTP check per URL in checkURLs
+func (s *SelfRegistration) Register(name string, host string, port int, checkURLs []string) error {
+	var checks consul.AgentServiceChecks
+	for _, url := range checkURLs {
+		checks = append(checks, &consul.AgentServiceCheck{
+			HTTP:     url,
+			Interval: selfCheckInterval,
+			Timeout:  selfCheckTimeout,
+		})
+	}
+	return s.client.Agent().ServiceRegister(&consul.AgentServiceRegistration{
+		ID:      s.id,
+		Name:    name,
+		Address: host,
+		Port:    port,
+		Checks:  checks,
+	})
+}
+
+// Deregister removes the manager's service, along with its checks
+func (s *SelfRegistration) Deregister() error {
+	return s.client.Agent().ServiceDeregister(s.id)
+}
@@ -0,0 +1,59 @@
+package consul
+
+import (
+	"encoding/json"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// StatusPublisher publishes documents about services to Consul KV, one key per service under a prefix.
+type StatusPublisher struct {
+	client *consul.Client
+	prefix string
+}
+
+// NewStatusPublisher returns a publisher writing to Consul KV under the specified prefix
+func NewStatusPublisher(address string, prefix string) (*StatusPublisher, error) {
+	// validate arguments
+	if address == "" {
+		return nil, ErrNoAddress
+	}
+
+	// connect to Consul
+	clientConfig := consul.DefaultConfig()
+	clientConfig.Address = address
+	client, err := consul.NewClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatusPublisher{
+		client: client,
+		prefix: strings.Trim(prefix, "/"),
+	}, nil
+}
+
+// Publish writes the JSON representation of status for the specified service
+func (p *StatusPublisher) Publish(serviceName string, status interface{}) error {
+	value, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = p.client.KV().Put(&consul.KVPair{
+		Key:   p.key(serviceName),
+		Value: value,
+	}, nil)
+	return err
+}
+
+// Remove deletes the status for the specified service
+func (p *StatusPublisher) Remove(serviceName string) error {
+	_, err := p.client.KV().Delete(p.key(serviceName), nil)
+	return err
+}
+
+// key returns the KV key for the specified service, e.g. "consul-lb-gce/web"
+func (p *StatusPublisher) key(serviceName string) string {
+	return strings.Join([]string{p.prefix, serviceName}, "/")
+}
@@ -0,0 +1,219 @@
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	filePollInterval = 5 * time.Second
+)
+
+var (
+	// ErrNoPath when no file path has been specified
+	ErrNoPath = errors.New("No file path specified")
+)
+
+// contents represents a services file, e.g. in TOML
+//
+//	[services.web.instances.client-us-01]
+//	address = "10.0.0.1"
+//	port = "11080"
+type contents struct {
+	Services map[string]*service `json:"services" toml:"services" yaml:"services"`
+}
+
+// service represents a service in a services file, instances are keyed by host
+type service struct {
+	Instances map[string]*instance `json:"instances" toml:"instances" yaml:"instances"`
+}
+
+// instance represents a service instance in a services file
+type instance struct {
+	Address    string   `json:"address" toml:"address" yaml:"address"`
+	Port       string   `json:"port" toml:"port" yaml:"port"`
+	Tags       []string `json:"tags" toml:"tags" yaml:"tags"`
+	Datacenter string   `json:"datacenter" toml:"datacenter" yaml:"datacenter"`
+}
+
+// fileRegistry is a registry backed by a YAML, JSON or TOML file, watched for changes.
+type fileRegistry struct {
+	path string
+	// services as last read from file
+	services map[string]map[string]*registry.ServiceInstance
+	// whether the file could be read last time it was checked
+	health registry.Health
+}
+
+// NewRegistry returns a file-backed service registry, the file path being the first address
+func NewRegistry(config *registry.Config) (registry.Registry, error) {
+	// validate arguments
+	if len(config.Addresses) < 1 || config.Addresses[0] == "" {
+		return nil, ErrNoPath
+	}
+
+	path := config.Addresses[0]
+	// fail early on unreadable files
+	if _, err := read(path); err != nil {
+		return nil, err
+	}
+
+	return &fileRegistry{
+		path:     path,
+		services: make(map[string]map[string]*registry.ServiceInstance),
+	}, nil
+}
+
+// Healthy returns whether the services file could be read last time it was checked
+func (fr *fileRegistry) Healthy() bool {
+	return fr.health.Healthy()
+}
+
+// LastProgress returns when the services file was last checked
+func (fr *fileRegistry) LastProgress() time.Time {
+	return fr.health.LastProgress()
+}
+
+// Listed returns whether the services file's services have been sent upstream at least once
+func (fr *fileRegistry) Listed() bool {
+	return fr.health.AllListed()
+}
+
+func (fr *fileRegistry) Run(upstream chan<- *registry.ServiceUpdate, done <-chan struct{}) {
+	defer close(upstream)
+	fr.health.Expect(fr.path)
+
+	// contents are compared, as edits within the same modification time would be missed otherwise
+	var lastSum [sha256.Size]byte
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+	for {
+		// has file changed since last read?
+		if data, err := ioutil.ReadFile(fr.path); err != nil {
+			glog.Errorf("Error checking services file [%s]: %s", fr.path, err)
+			fr.health.Fail(fr.path, err)
+		} else if sum := sha256.Sum256(data); sum != lastSum {
+			services, err := parse(fr.path, data)
+			if err != nil {
+				glog.Errorf("Error reading services file [%s]: %s", fr.path, err)
+				fr.health.Fail(fr.path, err)
+			} else {
+				fr.health.Clear(fr.path)
+				lastSum = sum
+				if !fr.update(services, upstream, done) {
+					return
+				}
+				fr.health.Listed(fr.path)
+			}
+		} else {
+			fr.health.Clear(fr.path)
+		}
+
+		fr.health.Progress()
+
+		select {
+		case <-done: // quit
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update diffs services against what was last read and sends updates upstream.
+// It returns false if done was closed meanwhile.
+func (fr *fileRegistry) update(services map[string]map[string]*registry.ServiceInstance, upstream chan<- *registry.ServiceUpdate, done <-chan struct{}) bool {
+	var updates []*registry.ServiceUpdate
+	for name, instances := range services {
+		previous, ok := fr.services[name]
+		if !ok {
+			updates = append(updates, &registry.ServiceUpdate{
+				ServiceName: name,
+				UpdateType:  registry.NEW,
+			})
+		}
+		if !ok || !reflect.DeepEqual(previous, instances) {
+			updates = append(updates, &registry.ServiceUpdate{
+				ServiceName:      name,
+				UpdateType:       registry.CHANGED,
+				ServiceInstances: instances,
+			})
+		}
+	}
+	for name := range fr.services {
+		if _, ok := services[name]; !ok {
+			updates = append(updates, &registry.ServiceUpdate{
+				ServiceName: name,
+				UpdateType:  registry.DELETED,
+			})
+		}
+	}
+	fr.services = services
+
+	for _, update := range updates {
+		select {
+		case upstream <- update:
+		case <-done:
+			return false
+		}
+	}
+	return true
+}
+
+// read reads and parses a services file
+func read(path string) (map[string]map[string]*registry.ServiceInstance, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(path, data)
+}
+
+// parse parses a YAML, JSON or TOML services file, depending on its extension
+func parse(path string, data []byte) (map[string]map[string]*registry.ServiceInstance, error) {
+	var c contents
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &c)
+	case ".json":
+		err = json.Unmarshal(data, &c)
+	case ".toml":
+		_, err = toml.Decode(string(data), &c)
+	default:
+		err = fmt.Errorf("Unsupported services file format [%s], use YAML, JSON or TOML", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]map[string]*registry.ServiceInstance, len(c.Services))
+	for name, srv := range c.Services {
+		instances := make(map[string]*registry.ServiceInstance)
+		if srv != nil {
+			for host, i := range srv.Instances {
+				instances[host] = &registry.ServiceInstance{
+					Host:       host,
+					Address:    i.Address,
+					Tags:       i.Tags,
+					Port:       i.Port,
+					Datacenter: i.Datacenter,
+				}
+			}
+		}
+		services[name] = instances
+	}
+	return services, nil
+}
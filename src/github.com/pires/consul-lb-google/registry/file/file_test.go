@@ -0,0 +1,123 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+func init() {
+	filePollInterval = 10 * time.Millisecond
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"services.yaml", `
+services:
+  web:
+    instances:
+      client-us-01:
+        address: 10.0.0.1
+        port: 11080
+        tags: [http]
+        datacenter: dc1
+`},
+		{"services.yml", `
+services:
+  web:
+    instances:
+      client-us-01: {address: 10.0.0.1, port: "11080", tags: [http], datacenter: dc1}
+`},
+		{"services.json", `{"services": {"web": {"instances": {"client-us-01": {"address": "10.0.0.1", "port": "11080", "tags": ["http"], "datacenter": "dc1"}}}}}`},
+		{"services.toml", `
+[services.web.instances.client-us-01]
+address = "10.0.0.1"
+port = "11080"
+tags = ["http"]
+datacenter = "dc1"
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			services, err := parse(test.name, []byte(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			instance, ok := services["web"]["client-us-01"]
+			if !ok || len(services) != 1 || len(services["web"]) != 1 {
+				t.Fatalf("expected web with client-us-01 only, got %v", services)
+			}
+			if instance.Host != "client-us-01" || instance.Address != "10.0.0.1" || instance.Port != "11080" ||
+				instance.Datacenter != "dc1" || len(instance.Tags) != 1 || instance.Tags[0] != "http" {
+				t.Fatalf("unexpected instance %+v", instance)
+			}
+		})
+	}
+}
+
+func TestParseUnsupported(t *testing.T) {
+	if _, err := parse("services.ini", []byte("")); err == nil {
+		t.Fatal("expected unsupported format to fail")
+	}
+}
+
+func next(t *testing.T, upstream <-chan *registry.ServiceUpdate) *registry.ServiceUpdate {
+	t.Helper()
+	select {
+	case update := <-upstream:
+		return update
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for update")
+		return nil
+	}
+}
+
+func TestSameModTimeEdit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.yaml")
+	modTime := time.Now().Truncate(time.Second)
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// edits within the file system's time granularity look the same
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("services: {web: {instances: {a: {port: 1}}}}")
+	r, err := NewRegistry(&registry.Config{Addresses: []string{path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := make(chan *registry.ServiceUpdate)
+	done := make(chan struct{})
+	defer close(done)
+	go r.Run(upstream, done)
+
+	if update := next(t, upstream); update.UpdateType != registry.NEW {
+		t.Fatalf("expected NEW, got %s", update.UpdateType)
+	}
+	if update := next(t, upstream); update.ServiceInstances["a"].Port != "1" {
+		t.Fatalf("expected port 1, got %+v", update.ServiceInstances["a"])
+	}
+
+	// same size and modification time, different contents
+	write("services: {web: {instances: {a: {port: 2}}}}")
+	update := next(t, upstream)
+	if update.UpdateType != registry.CHANGED || update.ServiceInstances["a"].Port != "2" {
+		t.Fatalf("expected CHANGED with port 2, got %s with %+v", update.UpdateType, update.ServiceInstances["a"])
+	}
+}
@@ -0,0 +1,131 @@
+package nomad
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+// serviceListStub is a namespace's entry in Nomad's services endpoint
+type serviceListStub struct {
+	Namespace string
+	Services  []*serviceStub
+}
+
+// serviceStub is a service's entry in Nomad's services endpoint
+type serviceStub struct {
+	ServiceName string
+	Tags        []string
+}
+
+// serviceRegistration is a service instance as registered by a Nomad allocation
+type serviceRegistration struct {
+	ID          string
+	ServiceName string
+	Namespace   string
+	NodeID      string
+	Datacenter  string
+	JobID       string
+	AllocID     string
+	Tags        []string
+	Address     string
+	Port        int
+}
+
+// node is a Nomad client node
+type node struct {
+	ID         string
+	Name       string
+	Datacenter string
+}
+
+// job is a Nomad job
+type job struct {
+	ID   string
+	Meta map[string]string
+}
+
+// client is a minimal Nomad HTTP API client supporting blocking queries.
+type client struct {
+	address string
+	http    *http.Client
+}
+
+func newClient(address string) *client {
+	if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+		address = "http://" + address
+	}
+	return &client{
+		address: strings.TrimSuffix(address, "/"),
+		http:    cleanhttp.DefaultClient(),
+	}
+}
+
+// query GETs endpoint and decodes the response into out.
+// A non-zero index turns the request into a blocking query, waiting at most wait for changes.
+// It returns the index to be used in the next blocking query.
+func (c *client) query(endpoint string, index uint64, wait time.Duration, out interface{}) (uint64, error) {
+	params := url.Values{}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%dms", wait/time.Millisecond))
+	}
+	u := c.address + endpoint
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	resp, err := c.http.Get(u)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("Unexpected response code %d from %s: %s", resp.StatusCode, endpoint, body)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return 0, err
+	}
+
+	// endpoints without an index don't support blocking
+	lastIndex, _ := strconv.ParseUint(resp.Header.Get("X-Nomad-Index"), 10, 64)
+	return lastIndex, nil
+}
+
+// services lists all services
+func (c *client) services(index uint64, wait time.Duration) ([]*serviceListStub, uint64, error) {
+	var out []*serviceListStub
+	lastIndex, err := c.query("/v1/services", index, wait, &out)
+	return out, lastIndex, err
+}
+
+// service lists all registrations of a service
+func (c *client) service(name string, index uint64, wait time.Duration) ([]*serviceRegistration, uint64, error) {
+	var out []*serviceRegistration
+	lastIndex, err := c.query("/v1/service/"+url.PathEscape(name), index, wait, &out)
+	return out, lastIndex, err
+}
+
+// node returns a client node by ID
+func (c *client) node(id string) (*node, error) {
+	out := new(node)
+	_, err := c.query("/v1/node/"+url.PathEscape(id), 0, 0, out)
+	return out, err
+}
+
+// job returns a job by ID
+func (c *client) job(id string) (*job, error) {
+	out := new(job)
+	_, err := c.query("/v1/job/"+url.PathEscape(id), 0, 0, out)
+	return out, err
+}
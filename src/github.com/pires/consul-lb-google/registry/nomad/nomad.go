@@ -0,0 +1,359 @@
+package nomad
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+
+	"github.com/golang/glog"
+)
+
+var (
+	nomadWatchTimeout  = 30 * time.Second
+	nomadRetryInterval = 15 * time.Second
+)
+
+var (
+	// ErrNoAddress when no Nomad address has been specified
+	ErrNoAddress = errors.New("No Nomad address specified")
+)
+
+// nomadRegistry is a registry for local caching and further watching of Nomad service registrations.
+type nomadRegistry struct {
+	client *client
+	sync.RWMutex
+	watchedServices map[string]*nomadService
+	tagsToWatch     []string
+	// job meta key marking jobs whose services are to be watched, empty means disabled
+	jobMetaKey string
+	// node names never change, so they're cached by node ID
+	nodeNames map[string]string
+	// failing queries, keyed by what's being queried
+	health registry.Health
+}
+
+// nomadService contains data belonging to the same service.
+type nomadService struct {
+	registry.Service
+	lastIndex uint64
+	removed   bool
+	running   bool
+	done      chan struct{}
+}
+
+// NewRegistry returns a Nomad-backed service registry
+func NewRegistry(config *registry.Config) (registry.Registry, error) {
+	// validate arguments
+	if len(config.Addresses) < 1 {
+		return nil, ErrNoAddress
+	}
+
+	// prepare registry, select first address alone
+	return &nomadRegistry{
+		client:          newClient(config.Addresses[0]),
+		watchedServices: make(map[string]*nomadService),
+		tagsToWatch:     config.TagsToWatch,
+		jobMetaKey:      config.JobMetaKey,
+		nodeNames:       make(map[string]string),
+	}, nil
+}
+
+// Healthy returns whether the latest Nomad queries succeeded
+func (nr *nomadRegistry) Healthy() bool {
+	return nr.health.Healthy()
+}
+
+// LastProgress returns when Nomad last answered any query
+func (nr *nomadRegistry) LastProgress() time.Time {
+	return nr.health.LastProgress()
+}
+
+// Listed returns whether every watched service has been sent upstream at least once
+func (nr *nomadRegistry) Listed() bool {
+	return nr.health.AllListed()
+}
+
+func (nr *nomadRegistry) Run(upstream chan<- *registry.ServiceUpdate, done <-chan struct{}) {
+	defer close(upstream)
+	// stop all service watchers
+	defer nr.stop()
+
+	nr.health.Expect("services")
+
+	// internal update channel
+	update := make(chan *nomadService, 16)
+	go nr.watchServices(update, done)
+
+	for {
+		select {
+		case <-done: // quit
+			return
+		case srv := <-update:
+			// was it removed?
+			if srv.removed {
+				close(srv.done)
+
+				// send clearing update upstream.
+				upstream <- &registry.ServiceUpdate{
+					ServiceName: srv.Name,
+					UpdateType:  registry.DELETED,
+				}
+				break
+			}
+			// it wasn't removed, so launch watcher for service
+			// but only if it wasn't running in the first place
+			if !srv.running {
+				go nr.watchService(srv, upstream)
+				srv.running = true
+				upstream <- &registry.ServiceUpdate{
+					ServiceName: srv.Name,
+					UpdateType:  registry.NEW,
+				}
+			}
+		}
+	}
+}
+
+func (nr *nomadRegistry) stop() {
+	// lock prevents Run from terminating while the watchers attempt
+	// to send on their channels.
+	nr.Lock()
+	defer nr.Unlock()
+
+	for _, srv := range nr.watchedServices {
+		close(srv.done)
+	}
+}
+
+// watchServices retrieves updates from Nomad's services endpoint and sends
+// potential updates to the update channel.
+func (nr *nomadRegistry) watchServices(update chan<- *nomadService, done <-chan struct{}) {
+	var lastIndex uint64
+	for {
+		namespaces, index, err := nr.client.services(lastIndex, nomadWatchTimeout)
+		if err != nil {
+			glog.Errorf("Error refreshing service list: %s", err)
+			nr.health.Fail("services", err)
+			// failure here is not catastrophic, so retry
+			time.Sleep(nomadRetryInterval)
+			continue
+		}
+		nr.health.Clear("services")
+		// if the index equals the previous one, the watch timed out with no update.
+		if index == lastIndex {
+			continue
+		}
+
+		// select services to be watched, either by tags or job meta.
+		// services whose jobs can't be read keep their previous selection, so they aren't torn down.
+		services := make(map[string]bool)
+		var selectErr error
+		for _, namespace := range namespaces {
+			for _, srv := range namespace.Services {
+				if nr.hasTagToWatch(srv.Tags) {
+					services[srv.ServiceName] = true
+					continue
+				}
+				watch, err := nr.hasJobMetaToWatch(srv.ServiceName)
+				if err != nil {
+					glog.Errorf("Error selecting service %s by job meta: %s", srv.ServiceName, err)
+					selectErr = err
+					nr.RLock()
+					_, watch = nr.watchedServices[srv.ServiceName]
+					nr.RUnlock()
+				}
+				if watch {
+					services[srv.ServiceName] = true
+				}
+			}
+		}
+		if selectErr != nil {
+			nr.health.Fail("jobs", selectErr)
+		} else {
+			nr.health.Clear("jobs")
+			lastIndex = index
+		}
+
+		nr.Lock()
+		select {
+		case <-done: // app is terminating, die
+			nr.Unlock()
+			return
+		default:
+			// continue
+		}
+		// check for services not yet cached locally.
+		for name := range services {
+			if _, ok := nr.watchedServices[name]; !ok {
+				service := new(nomadService)
+				service.Name = name
+				service.done = make(chan struct{})
+				nr.watchedServices[name] = service
+				// listing isn't done until the service's watcher sent its instances
+				nr.health.Expect("service/" + name)
+				// since src.running == false, registry will start watching this service
+				// before sending updates upstream
+				update <- service
+			}
+		}
+		// check for deleted services we should remove from cache
+		for name, srv := range nr.watchedServices {
+			if !services[name] {
+				srv.removed = true
+				// Run will take care of sending this upstream
+				update <- srv
+				delete(nr.watchedServices, name)
+			}
+		}
+		nr.Unlock()
+
+		// services whose jobs couldn't be read may be missing, so the listing isn't complete
+		if selectErr == nil {
+			nr.health.Listed("services")
+		}
+
+		// index wasn't taken, so selection is retried right away
+		if selectErr != nil {
+			time.Sleep(nomadRetryInterval)
+		}
+	}
+}
+
+// watchService retrieves updates about a service from Nomad's service endpoint.
+// On a potential update, all service instances are pushed upstream.
+func (nr *nomadRegistry) watchService(service *nomadService, upstream chan<- *registry.ServiceUpdate) {
+	key := "service/" + service.Name
+	// a stopped watcher is no longer failing, nor listing
+	defer nr.health.Clear(key)
+	defer nr.health.Listed(key)
+	for {
+		registrations, index, err := nr.client.service(service.Name, service.lastIndex, nomadWatchTimeout)
+		if err != nil {
+			glog.Errorf("Error refreshing service %s: %s", service.Name, err)
+			nr.health.Fail(key, err)
+			time.Sleep(nomadRetryInterval)
+			continue
+		}
+		// If the index equals the previous one, the watch timed out with no update.
+		if index == service.lastIndex {
+			nr.health.Clear(key)
+			continue
+		}
+		instances, err := nr.toInstances(service.Name, registrations)
+		if err != nil {
+			// leaving instances out would look like they were removed, so try again
+			nr.health.Fail(key, err)
+			time.Sleep(nomadRetryInterval)
+			continue
+		}
+		nr.health.Clear(key)
+		service.lastIndex = index
+
+		nr.Lock()
+		select {
+		case <-service.done:
+			nr.Unlock()
+			return
+		default:
+			// continue
+		}
+
+		service.Instances = instances
+		// tell upstream about the updates
+		upstream <- &registry.ServiceUpdate{
+			ServiceName:      service.Name,
+			UpdateType:       registry.CHANGED,
+			ServiceInstances: service.Instances,
+		}
+		nr.Unlock()
+		nr.health.Listed(key)
+	}
+}
+
+// toInstances converts registrations to service instances, failing if any node can't be resolved
+func (nr *nomadRegistry) toInstances(serviceName string, registrations []*serviceRegistration) (map[string]*registry.ServiceInstance, error) {
+	instances := make(map[string]*registry.ServiceInstance, len(registrations))
+	for _, reg := range registrations {
+		// GCE instances are known by their node names
+		host, err := nr.nodeName(reg.NodeID)
+		if err != nil {
+			glog.Errorf("Error resolving node [%s] for allocation [%s] of service %s: %s", reg.NodeID, reg.AllocID, serviceName, err)
+			return nil, err
+		}
+		instances[host] = &registry.ServiceInstance{
+			Host:       host,
+			Address:    reg.Address,
+			Tags:       reg.Tags,
+			Port:       strconv.Itoa(reg.Port),
+			Datacenter: reg.Datacenter,
+		}
+	}
+	return instances, nil
+}
+
+// hasTagToWatch returns whether any of the specified tags is to be watched
+func (nr *nomadRegistry) hasTagToWatch(tags []string) bool {
+	for _, tag := range tags {
+		for _, tagToWatch := range nr.tagsToWatch {
+			if tag == tagToWatch {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasJobMetaToWatch returns whether any job registering the specified service has the job meta key to watch.
+// It fails if any job can't be read, unless another one has the key.
+func (nr *nomadRegistry) hasJobMetaToWatch(serviceName string) (bool, error) {
+	if nr.jobMetaKey == "" {
+		return false, nil
+	}
+
+	registrations, _, err := nr.client.service(serviceName, 0, 0)
+	if err != nil {
+		return false, err
+	}
+
+	// many allocations of the same job register the same service
+	checked := make(map[string]bool)
+	var lastErr error
+	for _, reg := range registrations {
+		if checked[reg.JobID] {
+			continue
+		}
+		checked[reg.JobID] = true
+		job, err := nr.client.job(reg.JobID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if _, ok := job.Meta[nr.jobMetaKey]; ok {
+			return true, nil
+		}
+	}
+	return false, lastErr
+}
+
+// nodeName returns the name of a node by ID
+func (nr *nomadRegistry) nodeName(id string) (string, error) {
+	nr.RLock()
+	name, ok := nr.nodeNames[id]
+	nr.RUnlock()
+	if ok {
+		return name, nil
+	}
+
+	node, err := nr.client.node(id)
+	if err != nil {
+		return "", err
+	}
+
+	nr.Lock()
+	nr.nodeNames[id] = node.Name
+	nr.Unlock()
+	return node.Name, nil
+}
@@ -0,0 +1,328 @@
+package nomad
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+func init() {
+	nomadWatchTimeout = 100 * time.Millisecond
+	nomadRetryInterval = 10 * time.Millisecond
+}
+
+// fakeNomad is a local Nomad HTTP API, answering blocking queries once its state changes
+type fakeNomad struct {
+	sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	services []*serviceStub
+	// registrations keyed by service
+	registrations map[string][]*serviceRegistration
+	// index each service's registrations last changed at, as Nomad's are per service
+	serviceIndex map[string]uint64
+	nodes        map[string]*node
+	jobs         map[string]*job
+	// endpoint prefixes answering with an error, e.g. "/v1/job/"
+	failing map[string]bool
+}
+
+func newFakeNomad() *fakeNomad {
+	return &fakeNomad{
+		index:         1,
+		changed:       make(chan struct{}),
+		registrations: make(map[string][]*serviceRegistration),
+		serviceIndex:  make(map[string]uint64),
+		nodes:         make(map[string]*node),
+		jobs:          make(map[string]*job),
+		failing:       make(map[string]bool),
+	}
+}
+
+// update changes state, waking up blocking queries
+func (f *fakeNomad) update(change func()) {
+	f.Lock()
+	defer f.Unlock()
+	before, _ := json.Marshal(f.registrations)
+	change()
+	f.index++
+	after, _ := json.Marshal(f.registrations)
+	if string(before) != string(after) {
+		for name := range f.registrations {
+			f.serviceIndex[name] = f.index
+		}
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// indexOf returns the index of what's at path, which must be locked
+func (f *fakeNomad) indexOf(path string) uint64 {
+	if strings.HasPrefix(path, "/v1/service/") {
+		if index, ok := f.serviceIndex[strings.TrimPrefix(path, "/v1/service/")]; ok {
+			return index
+		}
+		return 1
+	}
+	return f.index
+}
+
+func (f *fakeNomad) fail(prefix string, failing bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.failing[prefix] = failing
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	for prefix, failing := range f.failing {
+		if failing && strings.HasPrefix(r.URL.Path, prefix) {
+			f.Unlock()
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// block until what's queried changes, or wait elapses
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+	timeout := time.After(wait)
+	for index > 0 && index >= f.indexOf(r.URL.Path) {
+		changed := f.changed
+		f.Unlock()
+		select {
+		case <-changed:
+			f.Lock()
+			continue
+		case <-timeout:
+		}
+		f.Lock()
+		break
+	}
+	defer f.Unlock()
+
+	var out interface{}
+	switch {
+	case r.URL.Path == "/v1/services":
+		out = []*serviceListStub{{Namespace: "default", Services: f.services}}
+	case strings.HasPrefix(r.URL.Path, "/v1/service/"):
+		out = f.registrations[strings.TrimPrefix(r.URL.Path, "/v1/service/")]
+	case strings.HasPrefix(r.URL.Path, "/v1/node/"):
+		n, ok := f.nodes[strings.TrimPrefix(r.URL.Path, "/v1/node/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		out = n
+	case strings.HasPrefix(r.URL.Path, "/v1/job/"):
+		j, ok := f.jobs[strings.TrimPrefix(r.URL.Path, "/v1/job/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		out = j
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(f.indexOf(r.URL.Path), 10))
+	json.NewEncoder(w).Encode(out)
+}
+
+// run starts a registry against a fake Nomad, stopped once the test ends
+func run(t *testing.T, fake *fakeNomad, config *registry.Config) (registry.Registry, <-chan *registry.ServiceUpdate) {
+	server := httptest.NewServer(fake)
+	config.Addresses = []string{server.URL}
+	r, err := NewRegistry(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := make(chan *registry.ServiceUpdate)
+	done := make(chan struct{})
+	go r.Run(upstream, done)
+	t.Cleanup(func() {
+		close(done)
+		// drain until Run returns, so blocked watchers don't leak
+		for range upstream {
+		}
+		server.Close()
+	})
+	return r, upstream
+}
+
+func next(t *testing.T, upstream <-chan *registry.ServiceUpdate) *registry.ServiceUpdate {
+	t.Helper()
+	select {
+	case update := <-upstream:
+		return update
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for update")
+		return nil
+	}
+}
+
+func expectNone(t *testing.T, upstream <-chan *registry.ServiceUpdate, wait time.Duration) {
+	t.Helper()
+	select {
+	case update := <-upstream:
+		t.Fatalf("unexpected %s update for service %s", update.UpdateType, update.ServiceName)
+	case <-time.After(wait):
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// withService sets up a service with one registration on node "n1", named "web-1", from job "job-<name>"
+func withService(f *fakeNomad, name string, tags []string, meta map[string]string) {
+	f.services = append(f.services, &serviceStub{ServiceName: name, Tags: tags})
+	f.registrations[name] = []*serviceRegistration{
+		{ServiceName: name, NodeID: "n1", Datacenter: "dc1", JobID: "job-" + name, AllocID: "a1", Address: "10.0.0.1", Port: 8080},
+	}
+	f.nodes["n1"] = &node{ID: "n1", Name: "web-1", Datacenter: "dc1"}
+	f.jobs["job-"+name] = &job{ID: "job-" + name, Meta: meta}
+}
+
+func TestSelection(t *testing.T) {
+	tests := []struct {
+		name   string
+		tags   []string
+		meta   map[string]string
+		config *registry.Config
+		watch  bool
+	}{
+		{"tag", []string{"lb"}, nil, &registry.Config{TagsToWatch: []string{"lb"}}, true},
+		{"other tag", []string{"other"}, nil, &registry.Config{TagsToWatch: []string{"lb"}}, false},
+		{"job meta", nil, map[string]string{"lb": "true"}, &registry.Config{JobMetaKey: "lb"}, true},
+		{"other job meta", nil, map[string]string{"other": "true"}, &registry.Config{JobMetaKey: "lb"}, false},
+		{"job meta disabled", nil, map[string]string{"lb": "true"}, &registry.Config{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeNomad()
+			withService(fake, "web", test.tags, test.meta)
+			_, upstream := run(t, fake, test.config)
+
+			if !test.watch {
+				expectNone(t, upstream, 200*time.Millisecond)
+				return
+			}
+			if update := next(t, upstream); update.UpdateType != registry.NEW || update.ServiceName != "web" {
+				t.Fatalf("expected NEW for web, got %s for %s", update.UpdateType, update.ServiceName)
+			}
+		})
+	}
+}
+
+func TestEvents(t *testing.T) {
+	fake := newFakeNomad()
+	withService(fake, "web", []string{"lb"}, nil)
+	_, upstream := run(t, fake, &registry.Config{TagsToWatch: []string{"lb"}})
+
+	if update := next(t, upstream); update.UpdateType != registry.NEW {
+		t.Fatalf("expected NEW, got %s", update.UpdateType)
+	}
+	update := next(t, upstream)
+	if update.UpdateType != registry.CHANGED {
+		t.Fatalf("expected CHANGED, got %s", update.UpdateType)
+	}
+	instance, ok := update.ServiceInstances["web-1"]
+	if !ok || len(update.ServiceInstances) != 1 {
+		t.Fatalf("expected instance web-1 only, got %v", update.ServiceInstances)
+	}
+	if instance.Address != "10.0.0.1" || instance.Port != "8080" || instance.Datacenter != "dc1" {
+		t.Fatalf("unexpected instance %+v", instance)
+	}
+
+	// another allocation on another node
+	fake.update(func() {
+		fake.nodes["n2"] = &node{ID: "n2", Name: "web-2"}
+		fake.registrations["web"] = append(fake.registrations["web"], &serviceRegistration{ServiceName: "web", NodeID: "n2", Port: 8080})
+	})
+	if update := next(t, upstream); update.UpdateType != registry.CHANGED || len(update.ServiceInstances) != 2 {
+		t.Fatalf("expected CHANGED with 2 instances, got %s with %d", update.UpdateType, len(update.ServiceInstances))
+	}
+
+	fake.update(func() {
+		fake.services = nil
+	})
+	if update := next(t, upstream); update.UpdateType != registry.DELETED || update.ServiceName != "web" {
+		t.Fatalf("expected DELETED for web, got %s for %s", update.UpdateType, update.ServiceName)
+	}
+}
+
+func TestJobErrorsKeepSelection(t *testing.T) {
+	fake := newFakeNomad()
+	withService(fake, "web", nil, map[string]string{"lb": "true"})
+	r, upstream := run(t, fake, &registry.Config{JobMetaKey: "lb"})
+
+	if update := next(t, upstream); update.UpdateType != registry.NEW {
+		t.Fatalf("expected NEW, got %s", update.UpdateType)
+	}
+	next(t, upstream)
+
+	// jobs can't be read while services change
+	fake.fail("/v1/job/", true)
+	fake.update(func() {
+		fake.services = append(fake.services, &serviceStub{ServiceName: "other"})
+	})
+	waitFor(t, "registry to be unhealthy", func() bool { return !r.Healthy() })
+	expectNone(t, upstream, 200*time.Millisecond)
+
+	fake.fail("/v1/job/", false)
+	waitFor(t, "registry to be healthy", r.Healthy)
+	expectNone(t, upstream, 200*time.Millisecond)
+}
+
+func TestServicesErrorsMarkUnhealthy(t *testing.T) {
+	fake := newFakeNomad()
+	fake.fail("/v1/services", true)
+	r, upstream := run(t, fake, &registry.Config{TagsToWatch: []string{"lb"}})
+
+	waitFor(t, "registry to be unhealthy", func() bool { return !r.Healthy() })
+	expectNone(t, upstream, 100*time.Millisecond)
+
+	fake.fail("/v1/services", false)
+	waitFor(t, "registry to be healthy", r.Healthy)
+}
+
+func TestNodeErrorsDontDropInstances(t *testing.T) {
+	fake := newFakeNomad()
+	withService(fake, "web", []string{"lb"}, nil)
+	r, upstream := run(t, fake, &registry.Config{TagsToWatch: []string{"lb"}})
+
+	next(t, upstream)
+	if update := next(t, upstream); len(update.ServiceInstances) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(update.ServiceInstances))
+	}
+
+	// a new allocation whose node can't be read
+	fake.fail("/v1/node/", true)
+	fake.update(func() {
+		fake.registrations["web"] = append(fake.registrations["web"], &serviceRegistration{ServiceName: "web", NodeID: "n2", Port: 8080})
+		fake.nodes["n2"] = &node{ID: "n2", Name: "web-2"}
+	})
+	waitFor(t, "registry to be unhealthy", func() bool { return !r.Healthy() })
+	expectNone(t, upstream, 200*time.Millisecond)
+
+	fake.fail("/v1/node/", false)
+	if update := next(t, upstream); update.UpdateType != registry.CHANGED || len(update.ServiceInstances) != 2 {
+		t.Fatalf("expected CHANGED with 2 instances, got %s with %d", update.UpdateType, len(update.ServiceInstances))
+	}
+	waitFor(t, "registry to be healthy", r.Healthy)
+}
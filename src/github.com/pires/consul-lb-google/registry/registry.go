@@ -1,5 +1,16 @@
 package registry
 
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pires/consul-lb-google/metrics"
+)
+
+var queryErrors = metrics.NewCounterVec("consul_lb_registry_query_errors_total",
+	"Failed registry queries, e.g. blocking queries, by query.", "query")
+
 const (
 	NEW     = "NEW"
 	CHANGED = "CHANGED"
@@ -14,10 +25,27 @@ type Service struct {
 
 // ServiceInstance represents an instance of a service
 type ServiceInstance struct {
-	Host    string
-	Address string
-	Tags    []string
-	Port    string // cloud providers usually use string, not numbers
+	Host       string
+	Address    string
+	Tags       []string
+	Port       string // cloud providers usually use string, not numbers
+	Datacenter string // datacenter the instance was discovered in
+}
+
+// ServiceConfig represents per-service load-balancer settings
+type ServiceConfig struct {
+	HealthCheckPath string   `json:"health_check_path" toml:"health_check_path"`
+	TimeoutSec      int64    `json:"timeout_sec" toml:"timeout_sec"`
+	Certificates    []string `json:"certificates" toml:"certificates"`     // names of existing SSL certificates
+	FrontendPorts   []string `json:"frontend_ports" toml:"frontend_ports"` // HTTP frontend ports
+	// how long to wait before tearing down a deleted service, e.g. "10m"
+	DeletionGracePeriod string `json:"deletion_grace_period" toml:"deletion_grace_period"`
+	// firewall rule settings, overriding the global ones
+	FirewallSourceRanges          []string `json:"firewall_source_ranges" toml:"firewall_source_ranges"`
+	FirewallTargetTags            []string `json:"firewall_target_tags" toml:"firewall_target_tags"`
+	FirewallTargetServiceAccounts []string `json:"firewall_target_service_accounts" toml:"firewall_target_service_accounts"`
+	FirewallPriority              int64    `json:"firewall_priority" toml:"firewall_priority"`
+	FirewallLogging               *bool    `json:"firewall_logging" toml:"firewall_logging"`
 }
 
 // ServiceUpdate represents a service update event
@@ -25,16 +53,112 @@ type ServiceUpdate struct {
 	ServiceName      string
 	UpdateType       string
 	ServiceInstances map[string]*ServiceInstance
+	// ServiceConfig is nil when no per-service settings exist
+	ServiceConfig *ServiceConfig
 }
 
 // Config represents a registry's configuration
 type Config struct {
 	Addresses   []string
 	TagsToWatch []string
+	// Datacenters to watch services in. Empty means the agent's own datacenter.
+	Datacenters []string
+	// ConfigPrefix is where per-service settings are kept. Empty disables per-service settings.
+	ConfigPrefix string
+	// Multiplex watches all services with a single blocking query, instead of one per service. Consul only.
+	Multiplex bool
+	// JobMetaKey marks jobs whose services are to be watched, besides TagsToWatch. Nomad only.
+	JobMetaKey string
 }
 
 // Registry represents a registry for services
 type Registry interface {
 	// Run starts the registry returning a channel for registry cancelation
 	Run(upstream chan<- *ServiceUpdate, done <-chan struct{})
+	// Healthy returns whether the registry's latest queries succeeded
+	Healthy() bool
+	// LastProgress returns when the registry last got an answer, successful or not, from any query
+	LastProgress() time.Time
+	// Listed returns whether every watched service has been sent upstream at least once
+	Listed() bool
+}
+
+// Health tracks failing registry queries, keyed by what's being queried, e.g. a service.
+// The zero value is healthy.
+type Health struct {
+	sync.Mutex
+	failing map[string]error
+	// when a query last returned
+	progressed time.Time
+	// queries yet to send their first results upstream, nil until any is expected
+	pending map[string]bool
+}
+
+// Fail marks a query as failing
+func (h *Health) Fail(key string, err error) {
+	// e.g. "service/web/dc1" is counted as "service"
+	queryErrors.Inc(strings.SplitN(key, "/", 2)[0])
+
+	h.Lock()
+	defer h.Unlock()
+	if h.failing == nil {
+		h.failing = make(map[string]error)
+	}
+	h.failing[key] = err
+	h.progressed = time.Now()
+}
+
+// Clear marks a query as no longer failing, e.g. it succeeded or stopped
+func (h *Health) Clear(key string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.failing, key)
+	h.progressed = time.Now()
+}
+
+// Progress marks the registry as making progress, without any query returning
+func (h *Health) Progress() {
+	h.Lock()
+	defer h.Unlock()
+	h.progressed = time.Now()
+}
+
+// LastProgress returns when a query last returned, zero if none ever did
+func (h *Health) LastProgress() time.Time {
+	h.Lock()
+	defer h.Unlock()
+	return h.progressed
+}
+
+// Expect marks queries as having to send their first results upstream before everything is listed
+func (h *Health) Expect(keys ...string) {
+	h.Lock()
+	defer h.Unlock()
+	if h.pending == nil {
+		h.pending = make(map[string]bool)
+	}
+	for _, key := range keys {
+		h.pending[key] = true
+	}
+}
+
+// Listed marks a query as having sent its results upstream, or as no longer expected to, e.g. it stopped
+func (h *Health) Listed(key string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.pending, key)
+}
+
+// AllListed returns whether every expected query has sent its first results upstream
+func (h *Health) AllListed() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.pending != nil && len(h.pending) == 0
+}
+
+// Healthy returns whether no query is failing
+func (h *Health) Healthy() bool {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.failing) == 0
 }
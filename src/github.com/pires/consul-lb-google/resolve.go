@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/pires/consul-lb-google/registry"
+	"github.com/pires/consul-lb-google/registry/consul"
+	"github.com/pires/consul-lb-google/resolver"
+
+	"github.com/golang/glog"
+)
+
+// newResolver returns the resolver mapping registry instances to cloud instances, as configured
+func newResolver(cfg configuration) (resolver.Resolver, error) {
+	switch cfg.Resolver.Strategy {
+	case "", "hostname":
+		return resolver.NewHostname(), nil
+	case "address":
+		return resolver.NewAddress(client.ListInstanceAddresses), nil
+	case "node_meta":
+		if cfg.Registry.Type != "" && cfg.Registry.Type != "consul" {
+			glog.Fatalf("Resolving instances by node metadata requires the Consul registry, not [%s].", cfg.Registry.Type)
+		}
+		reader, err := consul.NewNodeMetaReader(cfg.Consul.Url)
+		if err != nil {
+			return nil, err
+		}
+		return resolver.NewNodeMeta(cfg.Resolver.NodeMetaKey, reader.Meta), nil
+	default:
+		return nil, resolver.ErrUnknownStrategy
+	}
+}
+
+// resolveInstance returns the name of the cloud instance a registry instance runs on,
+// reporting instances that can't be resolved. Zones resolved along are passed on to the cloud.
+func resolveInstance(serviceName string, instance *registry.ServiceInstance) (string, error) {
+	name, zone, err := nodes.Resolve(instance)
+	if err != nil {
+		glog.Errorf("Can't resolve instance [%s] of service [%s] to a cloud instance [Address: %s, Datacenter: %s]. %s", instance.Host, serviceName, instance.Address, instance.Datacenter, err)
+		return "", err
+	}
+	if zone != "" {
+		client.SetInstanceZone(name, zone)
+	}
+	return name, nil
+}
@@ -0,0 +1,153 @@
+// Package resolver maps registry instances, e.g. Consul nodes, to the cloud instances they run on.
+package resolver
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+const (
+	// how long resolved instances are cached
+	cacheTTL = 5 * time.Minute
+	// how often addresses may be listed again, when an address isn't known
+	minRefreshInterval = 30 * time.Second
+)
+
+var (
+	// ErrUnresolvable when no cloud instance matches a registry instance
+	ErrUnresolvable = errors.New("No matching cloud instance")
+	// ErrNodeNotFound when a registry instance's node doesn't exist
+	ErrNodeNotFound = errors.New("No such node")
+	// ErrNodeMetaNotSet when a registry instance's node doesn't have the metadata key set
+	ErrNodeMetaNotSet = errors.New("Node metadata key isn't set")
+	// ErrUnknownStrategy when there's no such resolution strategy
+	ErrUnknownStrategy = errors.New("Unknown resolution strategy")
+)
+
+// Resolver maps registry instances to cloud instance names
+type Resolver interface {
+	// Resolve returns the name of the cloud instance a registry instance runs on,
+	// along with its zone, empty unless known
+	Resolve(instance *registry.ServiceInstance) (name string, zone string, err error)
+}
+
+// IsUnresolvable returns whether an error means no cloud instance matches a registry instance,
+// as opposed to resolution failing
+func IsUnresolvable(err error) bool {
+	return err == ErrUnresolvable || err == ErrNodeNotFound || err == ErrNodeMetaNotSet
+}
+
+// hostnameResolver takes the host name up to the first ".", e.g. "web-1.c.my-project.internal" is "web-1"
+type hostnameResolver struct{}
+
+// NewHostname returns a resolver taking instance names from host names
+func NewHostname() Resolver {
+	return &hostnameResolver{}
+}
+
+func (r *hostnameResolver) Resolve(instance *registry.ServiceInstance) (string, string, error) {
+	name := strings.Split(instance.Host, ".")[0]
+	if name == "" {
+		return "", "", ErrUnresolvable
+	}
+	return name, "", nil
+}
+
+// addressResolver matches addresses against cloud instances' network interfaces
+type addressResolver struct {
+	sync.Mutex
+	// lists cloud instance names by address
+	list        func() (map[string]string, error)
+	addresses   map[string]string
+	refreshedAt time.Time
+}
+
+// NewAddress returns a resolver matching addresses against those listed by list, keyed by address
+func NewAddress(list func() (map[string]string, error)) Resolver {
+	return &addressResolver{list: list}
+}
+
+func (r *addressResolver) Resolve(instance *registry.ServiceInstance) (string, string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	name, ok := r.addresses[instance.Address]
+	// instance may be new, so list again unless that was just done
+	if age := time.Since(r.refreshedAt); age > cacheTTL || (!ok && age > minRefreshInterval) {
+		addresses, err := r.list()
+		if err != nil {
+			return "", "", err
+		}
+		r.addresses = addresses
+		r.refreshedAt = time.Now()
+		name, ok = r.addresses[instance.Address]
+	}
+	if !ok {
+		return "", "", ErrUnresolvable
+	}
+	return name, "", nil
+}
+
+// nodeMetaResolver reads instance names from node metadata, e.g. "gce-instance" = "us-east1-d/web-1"
+type nodeMetaResolver struct {
+	sync.Mutex
+	key string
+	// returns a node's metadata, nil if the node doesn't exist
+	meta func(node string, datacenter string) (map[string]string, error)
+	// resolved node names, keyed by datacenter and node
+	resolved map[string]resolvedNode
+}
+
+type resolvedNode struct {
+	name string
+	// empty unless the metadata tells
+	zone       string
+	resolvedAt time.Time
+}
+
+// NewNodeMeta returns a resolver reading instance names from the node metadata key,
+// holding either "<name>" or "<zone>/<name>". meta returns a node's metadata.
+func NewNodeMeta(key string, meta func(node string, datacenter string) (map[string]string, error)) Resolver {
+	return &nodeMetaResolver{
+		key:      key,
+		meta:     meta,
+		resolved: make(map[string]resolvedNode),
+	}
+}
+
+func (r *nodeMetaResolver) Resolve(instance *registry.ServiceInstance) (string, string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	cacheKey := instance.Datacenter + "/" + instance.Host
+	if resolved, ok := r.resolved[cacheKey]; ok && time.Since(resolved.resolvedAt) < cacheTTL {
+		return resolved.name, resolved.zone, nil
+	}
+
+	meta, err := r.meta(instance.Host, instance.Datacenter)
+	if err != nil {
+		return "", "", err
+	}
+	if meta == nil {
+		return "", "", ErrNodeNotFound
+	}
+	value, ok := meta[r.key]
+	if !ok {
+		return "", "", ErrNodeMetaNotSet
+	}
+	var zone, name string
+	if i := strings.LastIndex(value, "/"); i >= 0 {
+		zone, name = value[:i], value[i+1:]
+	} else {
+		name = value
+	}
+	if name == "" {
+		return "", "", ErrUnresolvable
+	}
+	r.resolved[cacheKey] = resolvedNode{name: name, zone: zone, resolvedAt: time.Now()}
+	return name, zone, nil
+}
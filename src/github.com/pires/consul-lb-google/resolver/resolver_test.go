@@ -0,0 +1,132 @@
+package resolver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+func TestHostname(t *testing.T) {
+	tests := []struct {
+		host string
+		name string
+		err  error
+	}{
+		{"web-1", "web-1", nil},
+		{"web-1.c.my-project.internal", "web-1", nil},
+		{"", "", ErrUnresolvable},
+		{".internal", "", ErrUnresolvable},
+	}
+	r := NewHostname()
+	for _, test := range tests {
+		name, zone, err := r.Resolve(&registry.ServiceInstance{Host: test.host})
+		if name != test.name || zone != "" || err != test.err {
+			t.Errorf("host %q: expected (%q, %v), got (%q, %q, %v)", test.host, test.name, test.err, name, zone, err)
+		}
+	}
+}
+
+func TestAddress(t *testing.T) {
+	addresses := map[string]string{"10.0.0.1": "web-1"}
+	lists := 0
+	var listErr error
+	r := NewAddress(func() (map[string]string, error) {
+		lists++
+		return addresses, listErr
+	}).(*addressResolver)
+
+	tests := []struct {
+		name    string
+		address string
+		// how long ago addresses were last listed, before resolving
+		age       time.Duration
+		listErr   error
+		expected  string
+		err       error
+		listCount int
+	}{
+		{"first lookup lists", "10.0.0.1", cacheTTL + time.Second, nil, "web-1", nil, 1},
+		{"known address is cached", "10.0.0.1", time.Second, nil, "web-1", nil, 0},
+		{"unknown address lists again", "10.0.0.2", minRefreshInterval + time.Second, nil, "", ErrUnresolvable, 1},
+		{"unknown address doesn't list too often", "10.0.0.2", time.Second, nil, "", ErrUnresolvable, 0},
+		{"expired cache lists again", "10.0.0.1", cacheTTL + time.Second, nil, "web-1", nil, 1},
+		{"list errors are returned", "10.0.0.1", cacheTTL + time.Second, errors.New("unavailable"), "", errors.New("unavailable"), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r.refreshedAt = time.Now().Add(-test.age)
+			listErr = test.listErr
+			lists = 0
+			name, _, err := r.Resolve(&registry.ServiceInstance{Address: test.address})
+			if name != test.expected || (err == nil) != (test.err == nil) || (err != nil && err.Error() != test.err.Error()) {
+				t.Fatalf("expected (%q, %v), got (%q, %v)", test.expected, test.err, name, err)
+			}
+			if lists != test.listCount {
+				t.Fatalf("expected %d lists, got %d", test.listCount, lists)
+			}
+		})
+	}
+}
+
+func TestNodeMeta(t *testing.T) {
+	nodes := map[string]map[string]string{
+		"dc1/zoned":   {"gce-instance": "us-east1-d/web-1"},
+		"dc1/unzoned": {"gce-instance": "web-2"},
+		"dc1/empty":   {"gce-instance": ""},
+		"dc1/other":   {"other": "web-3"},
+		"dc1/no-meta": {},
+	}
+	tests := []struct {
+		node string
+		name string
+		zone string
+		err  error
+	}{
+		{"zoned", "web-1", "us-east1-d", nil},
+		{"unzoned", "web-2", "", nil},
+		{"empty", "", "", ErrUnresolvable},
+		{"other", "", "", ErrNodeMetaNotSet},
+		{"no-meta", "", "", ErrNodeMetaNotSet},
+		{"missing", "", "", ErrNodeNotFound},
+	}
+	r := NewNodeMeta("gce-instance", func(node string, datacenter string) (map[string]string, error) {
+		return nodes[datacenter+"/"+node], nil
+	})
+	for _, test := range tests {
+		name, zone, err := r.Resolve(&registry.ServiceInstance{Host: test.node, Datacenter: "dc1"})
+		if name != test.name || zone != test.zone || err != test.err {
+			t.Errorf("node %s: expected (%q, %q, %v), got (%q, %q, %v)", test.node, test.name, test.zone, test.err, name, zone, err)
+		}
+		if err != nil && !IsUnresolvable(err) {
+			t.Errorf("node %s: expected %v to be unresolvable", test.node, err)
+		}
+	}
+}
+
+func TestNodeMetaCache(t *testing.T) {
+	reads := 0
+	var readErr error
+	r := NewNodeMeta("gce-instance", func(node string, datacenter string) (map[string]string, error) {
+		reads++
+		return map[string]string{"gce-instance": "us-east1-d/web-1"}, readErr
+	}).(*nodeMetaResolver)
+	instance := &registry.ServiceInstance{Host: "web-1", Datacenter: "dc1"}
+
+	for i := 0; i < 2; i++ {
+		if name, zone, err := r.Resolve(instance); name != "web-1" || zone != "us-east1-d" || err != nil {
+			t.Fatalf("expected web-1 in us-east1-d, got (%q, %q, %v)", name, zone, err)
+		}
+	}
+	if reads != 1 {
+		t.Fatalf("expected 1 read, got %d", reads)
+	}
+
+	// read failures aren't unresolvable instances
+	readErr = errors.New("unavailable")
+	r.resolved["dc1/web-1"] = resolvedNode{resolvedAt: time.Now().Add(-cacheTTL)}
+	if _, _, err := r.Resolve(instance); err != readErr || IsUnresolvable(err) {
+		t.Fatalf("expected read error, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// retryQueue schedules retries of failed services, keyed by service name,
+// with per-service exponential backoff up to a maximum delay.
+// Retries are handed to the service's own handler, so only one worker ever handles a given service at a time.
+type retryQueue struct {
+	sync.Mutex
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	items     map[string]*retryItem
+}
+
+// retryItem is a failed service waiting to be retried
+type retryItem struct {
+	Retries   int       `json:"retries"`
+	LastError string    `json:"last_error"`
+	NextRetry time.Time `json:"next_retry"`
+	timer     *time.Timer
+}
+
+func newRetryQueue(baseDelay time.Duration, maxDelay time.Duration) *retryQueue {
+	return &retryQueue{
+		baseDelay: baseDelay,
+		maxDelay:  maxDelay,
+		items:     make(map[string]*retryItem),
+	}
+}
+
+// addRateLimited schedules retry to be called for a failed service once its backoff expires.
+// A service already waiting to be retried keeps its schedule.
+func (q *retryQueue) addRateLimited(serviceName string, err error, retry func()) {
+	q.Lock()
+	defer q.Unlock()
+
+	item, ok := q.items[serviceName]
+	if !ok {
+		item = new(retryItem)
+		q.items[serviceName] = item
+	}
+	item.LastError = err.Error()
+	if item.timer != nil {
+		return
+	}
+
+	// exponential backoff, e.g. 5s, 10s, 20s, ..
+	delay := q.baseDelay
+	for i := 0; i < item.Retries && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.maxDelay {
+		delay = q.maxDelay
+	}
+	item.Retries++
+	item.NextRetry = time.Now().Add(delay)
+	glog.Warningf("Retrying service [%s] in %s [Attempt: %d, Queue Depth: %d].", serviceName, delay, item.Retries, len(q.items))
+	item.timer = time.AfterFunc(delay, func() {
+		q.Lock()
+		item.timer = nil
+		q.Unlock()
+		retry()
+	})
+}
+
+// forget stops retrying a service, e.g. it succeeded or was deleted
+func (q *retryQueue) forget(serviceName string) {
+	q.Lock()
+	defer q.Unlock()
+
+	if item, ok := q.items[serviceName]; ok {
+		if item.timer != nil {
+			item.timer.Stop()
+		}
+		delete(q.items, serviceName)
+	}
+}
+
+// len returns how many services are waiting to be retried
+func (q *retryQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items)
+}
+
+// status returns a snapshot of services waiting to be retried
+func (q *retryQueue) status() map[string]retryItem {
+	q.Lock()
+	defer q.Unlock()
+
+	status := make(map[string]retryItem, len(q.items))
+	for name, item := range q.items {
+		status[name] = retryItem{
+			Retries:   item.Retries,
+			LastError: item.LastError,
+			NextRetry: item.NextRetry,
+		}
+	}
+	return status
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name      string
+		baseDelay time.Duration
+		maxDelay  time.Duration
+		// retries already made
+		retries  int
+		expected time.Duration
+	}{
+		{"first", 5 * time.Second, time.Minute, 0, 5 * time.Second},
+		{"second", 5 * time.Second, time.Minute, 1, 10 * time.Second},
+		{"third", 5 * time.Second, time.Minute, 2, 20 * time.Second},
+		{"capped", 5 * time.Second, time.Minute, 4, time.Minute},
+		{"stays capped", 5 * time.Second, time.Minute, 100, time.Minute},
+		{"base above max", 2 * time.Minute, time.Minute, 0, time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newRetryQueue(test.baseDelay, test.maxDelay)
+			q.items["web"] = &retryItem{Retries: test.retries}
+			start := time.Now()
+			q.addRateLimited("web", errors.New("failed"), func() {})
+			defer q.forget("web")
+
+			status := q.status()["web"]
+			if delay := status.NextRetry.Sub(start); delay < test.expected || delay > test.expected+time.Second {
+				t.Fatalf("expected retry in %s, got %s", test.expected, delay)
+			}
+			if status.Retries != test.retries+1 || status.LastError != "failed" {
+				t.Fatalf("unexpected status %+v", status)
+			}
+		})
+	}
+}
+
+func TestRetryKeepsSchedule(t *testing.T) {
+	q := newRetryQueue(time.Hour, time.Hour)
+	defer q.forget("web")
+	q.addRateLimited("web", errors.New("first"), func() {})
+	scheduled := q.status()["web"].NextRetry
+
+	// failing again while waiting doesn't push the retry back, only records the error
+	q.addRateLimited("web", errors.New("second"), func() {})
+	status := q.status()["web"]
+	if !status.NextRetry.Equal(scheduled) || status.Retries != 1 || status.LastError != "second" {
+		t.Fatalf("expected schedule kept with latest error, got %+v", status)
+	}
+}
+
+func TestRetryFires(t *testing.T) {
+	q := newRetryQueue(10*time.Millisecond, time.Second)
+	defer q.forget("web")
+	retried := make(chan struct{}, 2)
+	retry := func() { retried <- struct{}{} }
+
+	q.addRateLimited("web", errors.New("failed"), retry)
+	select {
+	case <-retried:
+	case <-time.After(time.Second):
+		t.Fatal("expected retry")
+	}
+
+	// once fired, failing again schedules the next retry with more backoff
+	q.addRateLimited("web", errors.New("failed"), retry)
+	if status := q.status()["web"]; status.Retries != 2 {
+		t.Fatalf("expected 2 retries, got %d", status.Retries)
+	}
+	select {
+	case <-retried:
+	case <-time.After(time.Second):
+		t.Fatal("expected second retry")
+	}
+}
+
+func TestRetryForget(t *testing.T) {
+	q := newRetryQueue(10*time.Millisecond, time.Second)
+	retried := make(chan struct{}, 1)
+	q.addRateLimited("web", errors.New("failed"), func() { retried <- struct{}{} })
+	q.forget("web")
+
+	if q.len() != 0 {
+		t.Fatalf("expected empty queue, got %d", q.len())
+	}
+	select {
+	case <-retried:
+		t.Fatal("expected forgotten retry not to fire")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// backoff starts over
+	q.addRateLimited("web", errors.New("failed"), func() {})
+	defer q.forget("web")
+	if status := q.status()["web"]; status.Retries != 1 {
+		t.Fatalf("expected backoff to start over, got %d retries", status.Retries)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pires/consul-lb-google/notifier"
+
+	"github.com/golang/glog"
+)
+
+// safetyGuard blocks destructive actions that look like a registry outage rather than an
+// intended change, e.g. Consul returning no instances during a leader election.
+// Blocked actions are kept, keyed by service name, until they're allowed or manually overridden.
+type safetyGuard struct {
+	sync.Mutex
+	settings safetyConfiguration
+	// whether the registry's latest queries succeeded
+	healthy func() bool
+	blocked map[string]*blockedAction
+	// services allowed to go through their next blocked action
+	overrides map[string]bool
+}
+
+// blockedAction is a destructive action waiting for manual override
+type blockedAction struct {
+	Action    string    `json:"action"`
+	Reason    string    `json:"reason"`
+	BlockedAt time.Time `json:"blocked_at"`
+}
+
+func newSafetyGuard(settings safetyConfiguration, healthy func() bool) *safetyGuard {
+	return &safetyGuard{
+		settings:  settings,
+		healthy:   healthy,
+		blocked:   make(map[string]*blockedAction),
+		overrides: make(map[string]bool),
+	}
+}
+
+// frozen returns whether destructive actions are blocked because the registry looks unhealthy
+func (g *safetyGuard) frozen() bool {
+	return g.settings.FreezeOnRegistryErrors && !g.healthy()
+}
+
+// checkRemoval returns an error if removing instances from a service breaks any threshold,
+// left being how many instances the service would have afterwards, new ones included
+func (g *safetyGuard) checkRemoval(serviceName string, current int, removing int, left int) error {
+	action := fmt.Sprintf("remove %d of %d instances", removing, current)
+	var reason string
+	switch {
+	case removing == 0:
+		// nothing to remove, so nothing to block
+	case g.frozen():
+		reason = "registry is unhealthy"
+	case left < g.settings.MinInstances:
+		reason = fmt.Sprintf("less than %d instances would be left", g.settings.MinInstances)
+	case float64(removing)/float64(current) > g.settings.MaxRemovalFraction:
+		reason = fmt.Sprintf("more than %.0f%% of instances would be removed", g.settings.MaxRemovalFraction*100)
+	}
+	return g.check(serviceName, action, reason)
+}
+
+// checkTeardown returns an error if tearing down a service isn't safe
+func (g *safetyGuard) checkTeardown(serviceName string) error {
+	var reason string
+	if g.frozen() {
+		reason = "registry is unhealthy"
+	}
+	return g.check(serviceName, "tear down load-balancer", reason)
+}
+
+// check records an action as blocked for a non-empty reason, unless it's been overridden
+func (g *safetyGuard) check(serviceName string, action string, reason string) error {
+	g.Lock()
+	defer g.Unlock()
+
+	if reason == "" || g.overrides[serviceName] {
+		if reason != "" {
+			glog.Warningf("Allowing blocked action for service [%s] by manual override [Action: %s, Reason: %s].", serviceName, action, reason)
+		}
+		delete(g.blocked, serviceName)
+		delete(g.overrides, serviceName)
+		return nil
+	}
+
+	if _, ok := g.blocked[serviceName]; !ok {
+		g.blocked[serviceName] = &blockedAction{BlockedAt: time.Now()}
+	}
+	g.blocked[serviceName].Action = action
+	g.blocked[serviceName].Reason = reason
+	err := fmt.Errorf("Safety guard blocked action [%s] because %s", action, reason)
+	notify(notifier.SafetyGuard, serviceName, err.Error())
+	return err
+}
+
+// override allows a service's blocked action to go through next time it's attempted.
+// It returns false if nothing is blocked for the service.
+func (g *safetyGuard) override(serviceName string) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	if _, ok := g.blocked[serviceName]; !ok {
+		return false
+	}
+	glog.Warningf("Manual override for blocked action of service [%s].", serviceName)
+	g.overrides[serviceName] = true
+	return true
+}
+
+// forget drops anything blocked for a service, e.g. it was deleted
+func (g *safetyGuard) forget(serviceName string) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.blocked, serviceName)
+	delete(g.overrides, serviceName)
+}
+
+// status returns a snapshot of blocked actions, keyed by service name
+func (g *safetyGuard) status() map[string]blockedAction {
+	g.Lock()
+	defer g.Unlock()
+
+	status := make(map[string]blockedAction, len(g.blocked))
+	for name, action := range g.blocked {
+		status[name] = *action
+	}
+	return status
+}
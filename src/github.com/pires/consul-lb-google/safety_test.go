@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckRemoval(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings safetyConfiguration
+		healthy  bool
+		current  int
+		removing int
+		left     int
+		blocked  bool
+	}{
+		{"nothing removed", safetyConfiguration{MaxRemovalFraction: 0.5, MinInstances: 10, FreezeOnRegistryErrors: true}, false, 4, 0, 4, false},
+		{"within fraction", safetyConfiguration{MaxRemovalFraction: 0.5}, true, 4, 2, 2, false},
+		{"above fraction", safetyConfiguration{MaxRemovalFraction: 0.5}, true, 4, 3, 1, true},
+		{"all removed", safetyConfiguration{MaxRemovalFraction: 0.5}, true, 4, 4, 0, true},
+		{"fraction of one allows all", safetyConfiguration{MaxRemovalFraction: 1}, true, 4, 4, 0, false},
+		{"at min instances", safetyConfiguration{MaxRemovalFraction: 1, MinInstances: 2}, true, 4, 2, 2, false},
+		{"below min instances", safetyConfiguration{MaxRemovalFraction: 1, MinInstances: 2}, true, 4, 3, 1, true},
+		{"new instances count as left", safetyConfiguration{MaxRemovalFraction: 1, MinInstances: 2}, true, 4, 3, 3, false},
+		{"registry unhealthy", safetyConfiguration{MaxRemovalFraction: 1, FreezeOnRegistryErrors: true}, false, 4, 1, 3, true},
+		{"registry unhealthy without freeze", safetyConfiguration{MaxRemovalFraction: 1}, false, 4, 1, 3, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := newSafetyGuard(test.settings, func() bool { return test.healthy })
+			err := g.checkRemoval("web", test.current, test.removing, test.left)
+			if blocked := err != nil; blocked != test.blocked {
+				t.Fatalf("expected blocked %t, got %v", test.blocked, err)
+			}
+			if _, ok := g.status()["web"]; ok != test.blocked {
+				t.Fatalf("expected blocked action recorded %t, got %t", test.blocked, ok)
+			}
+		})
+	}
+}
+
+func TestCheckTeardown(t *testing.T) {
+	tests := []struct {
+		name    string
+		freeze  bool
+		healthy bool
+		blocked bool
+	}{
+		{"healthy", true, true, false},
+		{"unhealthy", true, false, true},
+		{"unhealthy without freeze", false, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := newSafetyGuard(safetyConfiguration{FreezeOnRegistryErrors: test.freeze}, func() bool { return test.healthy })
+			if err := g.checkTeardown("web"); (err != nil) != test.blocked {
+				t.Fatalf("expected blocked %t, got %v", test.blocked, err)
+			}
+			if g.frozen() != (test.freeze && !test.healthy) {
+				t.Fatalf("unexpected frozen %t", g.frozen())
+			}
+		})
+	}
+}
+
+func TestOverride(t *testing.T) {
+	g := newSafetyGuard(safetyConfiguration{MaxRemovalFraction: 0.5}, func() bool { return true })
+
+	// nothing blocked, nothing to override
+	if g.override("web") {
+		t.Fatal("expected override without blocked action to fail")
+	}
+
+	if err := g.checkRemoval("web", 4, 4, 0); err == nil {
+		t.Fatal("expected removal to be blocked")
+	}
+	blockedAt := g.status()["web"].BlockedAt
+
+	// blocked again, e.g. retried, keeps when it was first blocked
+	if err := g.checkRemoval("web", 4, 3, 1); err == nil {
+		t.Fatal("expected removal to be blocked again")
+	}
+	if status := g.status()["web"]; !status.BlockedAt.Equal(blockedAt) || status.Action != "remove 3 of 4 instances" {
+		t.Fatalf("unexpected blocked action %+v", status)
+	}
+
+	// override lets the next attempt through, once
+	if !g.override("web") {
+		t.Fatal("expected override to succeed")
+	}
+	if err := g.checkRemoval("web", 4, 4, 0); err != nil {
+		t.Fatalf("expected overridden removal to go through, got %v", err)
+	}
+	if _, ok := g.status()["web"]; ok {
+		t.Fatal("expected blocked action to be cleared")
+	}
+	if err := g.checkRemoval("web", 4, 4, 0); err == nil {
+		t.Fatal("expected override to apply once only")
+	}
+
+	// other services aren't affected by overrides
+	g.override("web")
+	if err := g.checkRemoval("api", 4, 4, 0); err == nil {
+		t.Fatal("expected other service's removal to be blocked")
+	}
+}
+
+func TestForget(t *testing.T) {
+	g := newSafetyGuard(safetyConfiguration{MaxRemovalFraction: 0.5}, func() bool { return true })
+	g.checkRemoval("web", 4, 4, 0)
+	g.override("web")
+	g.forget("web")
+
+	if _, ok := g.status()["web"]; ok {
+		t.Fatal("expected blocked action to be forgotten")
+	}
+	// so is the override
+	if err := g.checkRemoval("web", 4, 4, 0); err == nil {
+		t.Fatal("expected override to be forgotten")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pires/consul-lb-google/registry"
+)
+
+// serviceState is what a handler last reported about its service
+type serviceState struct {
+	Service           string              `json:"service"`
+	Running           bool                `json:"running"`
+	Paused            bool                `json:"paused"`
+	Port              string              `json:"port,omitempty"`
+	Instances         []string            `json:"instances,omitempty"`
+	Unresolved        map[string]string   `json:"unresolved,omitempty"`
+	Zones             []string            `json:"zones,omitempty"`
+	Members           map[string][]string `json:"members,omitempty"`
+	Resources         map[string]string   `json:"resources,omitempty"`
+	LastError         string              `json:"last_error,omitempty"`
+	NeedsIntervention bool                `json:"needs_intervention"`
+	Retry             *retryItem          `json:"retry,omitempty"`
+	Blocked           *blockedAction      `json:"blocked,omitempty"`
+	CreatedAt         time.Time           `json:"created_at"`
+	UpdatedAt         time.Time           `json:"updated_at"`
+}
+
+// serviceStates keeps track of every service handler, keyed by service name,
+// so services can be inspected and controlled from outside their handlers.
+type serviceStates struct {
+	sync.RWMutex
+	mailboxes map[string]*mailbox
+	states    map[string]*serviceState
+	paused    map[string]bool
+}
+
+func newServiceStates() *serviceStates {
+	return &serviceStates{
+		mailboxes: make(map[string]*mailbox),
+		states:    make(map[string]*serviceState),
+		paused:    make(map[string]bool),
+	}
+}
+
+// register keeps track of a new service handler
+func (s *serviceStates) register(serviceName string, updates *mailbox) {
+	s.Lock()
+	defer s.Unlock()
+	s.mailboxes[serviceName] = updates
+}
+
+// report records what a handler knows about its service
+func (s *serviceStates) report(name string, serviceName string, servicePort string, isRunning bool, instances map[string]*registry.ServiceInstance, unresolved map[string]string, lastErr error, needsIntervention bool, createdAt time.Time) {
+	state := &serviceState{
+		Service:           name,
+		Running:           isRunning,
+		Port:              servicePort,
+		NeedsIntervention: needsIntervention,
+		CreatedAt:         createdAt,
+		UpdatedAt:         time.Now(),
+	}
+	for host := range instances {
+		state.Instances = append(state.Instances, host)
+	}
+	sort.Strings(state.Instances)
+	if len(unresolved) > 0 {
+		state.Unresolved = make(map[string]string, len(unresolved))
+		for host, reason := range unresolved {
+			state.Unresolved[host] = reason
+		}
+	}
+	if isRunning {
+		state.Resources = client.GetResourceNames(serviceName)
+		if group, ok := client.GetInstanceGroup(serviceName); ok {
+			state.Members = make(map[string][]string, len(group.Zones))
+			for zone, ig := range group.Zones {
+				state.Zones = append(state.Zones, zone)
+				for instanceName := range ig.Instances {
+					state.Members[zone] = append(state.Members[zone], instanceName)
+				}
+				sort.Strings(state.Members[zone])
+			}
+		}
+		sort.Strings(state.Zones)
+	}
+	if lastErr != nil {
+		state.LastError = lastErr.Error()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.states[name] = state
+}
+
+// get returns a snapshot of a service's state, along with retries and blocked actions
+func (s *serviceStates) get(name string) (*serviceState, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if _, ok := s.mailboxes[name]; !ok {
+		return nil, false
+	}
+	state := &serviceState{Service: name}
+	if reported, ok := s.states[name]; ok {
+		*state = *reported
+	}
+	state.Paused = s.paused[name]
+	if retry, ok := retries.status()[name]; ok {
+		state.Retry = &retry
+	}
+	if blocked, ok := guard.status()[name]; ok {
+		state.Blocked = &blocked
+	}
+	return state, true
+}
+
+// list returns a snapshot of all services' states, sorted by name
+func (s *serviceStates) list() []*serviceState {
+	s.RLock()
+	names := make([]string, 0, len(s.mailboxes))
+	for name := range s.mailboxes {
+		names = append(names, name)
+	}
+	s.RUnlock()
+
+	sort.Strings(names)
+	list := make([]*serviceState, 0, len(names))
+	for _, name := range names {
+		if state, ok := s.get(name); ok {
+			list = append(list, state)
+		}
+	}
+	return list
+}
+
+// resync makes a service's handler apply its latest desired state again.
+// It returns false for unknown services.
+func (s *serviceStates) resync(name string) bool {
+	s.RLock()
+	updates, ok := s.mailboxes[name]
+	s.RUnlock()
+
+	if ok {
+		updates.retry()
+	}
+	return ok
+}
+
+// pause stops a service's handler from touching the cloud, until resumed.
+// It returns false for unknown services.
+func (s *serviceStates) pause(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.mailboxes[name]; !ok {
+		return false
+	}
+	s.paused[name] = true
+	return true
+}
+
+// resume lets a service's handler touch the cloud again, applying whatever changed meanwhile.
+// It returns false for unknown services.
+func (s *serviceStates) resume(name string) bool {
+	s.Lock()
+	_, ok := s.mailboxes[name]
+	delete(s.paused, name)
+	s.Unlock()
+
+	return ok && s.resync(name)
+}
+
+// isPaused returns whether a service's handler is to leave the cloud alone
+func (s *serviceStates) isPaused(name string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.paused[name]
+}
+
+// adopted returns whether every service handler has gone through its first updates
+func (s *serviceStates) adopted() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	for name := range s.mailboxes {
+		if _, ok := s.states[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isManaged returns whether a service is either in the registry or still has cloud resources being managed
+func (s *serviceStates) isManaged(name string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	updates, ok := s.mailboxes[name]
+	if !ok {
+		return false
+	}
+	if state, ok := s.states[name]; ok && state.Running {
+		return true
+	}
+	updates.Lock()
+	defer updates.Unlock()
+	return updates.exists
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// serviceStatus is the document published for each managed service
+type serviceStatus struct {
+	Service      string            `json:"service"`
+	IPAddress    string            `json:"ip_address,omitempty"`
+	PortRange    string            `json:"port_range,omitempty"`
+	Frontends    []*frontend       `json:"frontends,omitempty"`
+	InstancePort string            `json:"instance_port,omitempty"`
+	Health       map[string]string `json:"health,omitempty"`
+	LastError    string            `json:"last_error,omitempty"`
+	Blocked      *blockedAction    `json:"blocked,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+// frontend is a load-balancer frontend in a published status
+type frontend struct {
+	IPAddress string `json:"ip_address"`
+	PortRange string `json:"port_range"`
+	Protocol  string `json:"protocol"`
+}
+
+// publishStatus publishes the current load-balancer status for a service, if publishing is enabled
+func publishStatus(serviceName string, servicePort string, lastErr error, createdAt time.Time) {
+	if publisher == nil {
+		return
+	}
+
+	status := &serviceStatus{
+		Service:      serviceName,
+		InstancePort: servicePort,
+		CreatedAt:    createdAt,
+		UpdatedAt:    time.Now(),
+	}
+	if lastErr != nil {
+		status.LastError = lastErr.Error()
+	}
+	if blocked, ok := guard.status()[serviceName]; ok {
+		status.Blocked = &blocked
+	}
+
+	// load-balancer may not exist yet, e.g. there are no instances
+	if lb, err := client.GetLoadBalancerStatus(serviceName); err != nil {
+		glog.Warningf("Couldn't retrieve load-balancer status for service [%s]. %s", serviceName, err)
+	} else {
+		status.IPAddress = lb.IPAddress
+		status.PortRange = lb.PortRange
+		for _, f := range lb.Frontends {
+			status.Frontends = append(status.Frontends, &frontend{f.IPAddress, f.PortRange, f.Protocol})
+		}
+		status.Health = lb.Health
+	}
+
+	if err := publisher.Publish(serviceName, status); err != nil {
+		glog.Errorf("There was an error while publishing status for service [%s]. %s", serviceName, err)
+	}
+}
+
+// unpublishStatus removes the published status for a service, if publishing is enabled
+func unpublishStatus(serviceName string) {
+	if publisher == nil {
+		return
+	}
+
+	if err := publisher.Remove(serviceName); err != nil {
+		glog.Errorf("There was an error while removing status for service [%s]. %s", serviceName, err)
+	}
+}
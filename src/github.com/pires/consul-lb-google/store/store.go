@@ -0,0 +1,171 @@
+// Package store keeps the last applied state of managed services on disk, so it survives restarts.
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pires/consul-lb-google/cloud/gce"
+	"github.com/pires/consul-lb-google/registry"
+)
+
+// ServiceRecord is the last applied state of a managed service
+type ServiceRecord struct {
+	Service   string                               `json:"service"`
+	Port      string                               `json:"port,omitempty"`
+	Instances map[string]*registry.ServiceInstance `json:"instances,omitempty"`
+	Config    *registry.ServiceConfig              `json:"config,omitempty"`
+	// cloud resources, keyed by kind, e.g. Resources["instance_group/us-east1-d"] == "us-east1-d-web"
+	Resources map[string]string `json:"resources,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// snapshot is what's written to disk
+type snapshot struct {
+	Services map[string]*ServiceRecord `json:"services"`
+	// how far provisioning of each load-balancer got
+	Provisionings map[string]*gce.Provisioning `json:"provisionings,omitempty"`
+}
+
+// Store is a JSON snapshot of managed services, rewritten and synced to disk on every change
+type Store struct {
+	sync.Mutex
+	path          string
+	services      map[string]*ServiceRecord
+	provisionings map[string]*gce.Provisioning
+}
+
+// Open returns a store kept at path, reading any existing snapshot
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:          path,
+		services:      make(map[string]*ServiceRecord),
+		provisionings: make(map[string]*gce.Provisioning),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	if snap.Services != nil {
+		s.services = snap.Services
+	}
+	if snap.Provisionings != nil {
+		s.provisionings = snap.Provisionings
+	}
+	return s, nil
+}
+
+// Get returns the record of a service
+func (s *Store) Get(serviceName string) (*ServiceRecord, bool) {
+	s.Lock()
+	defer s.Unlock()
+	record, ok := s.services[serviceName]
+	return record, ok
+}
+
+// Len returns how many services are recorded
+func (s *Store) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.services)
+}
+
+// Put records a service, replacing any previous record, and syncs the store to disk
+func (s *Store) Put(record *ServiceRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	s.services[record.Service] = record
+	return s.save()
+}
+
+// Delete forgets about a service and syncs the store to disk
+func (s *Store) Delete(serviceName string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.services[serviceName]; !ok {
+		return nil
+	}
+	delete(s.services, serviceName)
+	return s.save()
+}
+
+// GetProvisioning returns how far provisioning of a load-balancer got
+func (s *Store) GetProvisioning(name string) (*gce.Provisioning, bool) {
+	s.Lock()
+	defer s.Unlock()
+	p, ok := s.provisionings[name]
+	if !ok {
+		return nil, false
+	}
+	return p.Copy(), true
+}
+
+// PutProvisioning records how far provisioning of a load-balancer got, and syncs the store to disk
+func (s *Store) PutProvisioning(name string, p *gce.Provisioning) error {
+	s.Lock()
+	defer s.Unlock()
+	s.provisionings[name] = p.Copy()
+	return s.save()
+}
+
+// DeleteProvisioning forgets about provisioning of a load-balancer, and syncs the store to disk
+func (s *Store) DeleteProvisioning(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.provisionings[name]; !ok {
+		return nil
+	}
+	delete(s.provisionings, name)
+	return s.save()
+}
+
+// save writes a snapshot to a temporary file, syncs it and renames it over the previous one,
+// so a crash never leaves a partial snapshot behind. Caller must hold the lock.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(&snapshot{Services: s.services, Provisionings: s.provisionings}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	// sync directory as well, so the rename itself is durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pires/consul-lb-google/cloud/gce"
+	"github.com/pires/consul-lb-google/registry"
+)
+
+func TestOpenMissing(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 0 {
+		t.Fatalf("expected empty store, got %d services", s.Len())
+	}
+	if _, ok := s.GetProvisioning("web"); ok {
+		t.Fatal("expected no provisioning")
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := ioutil.WriteFile(path, []byte(`{"services": {"web": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// an empty store would have every load-balancer adopted from scratch
+	if _, err := Open(path); err == nil {
+		t.Fatal("expected corrupt snapshot to fail")
+	}
+}
+
+func TestServicesSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	web := &ServiceRecord{
+		Service:   "web",
+		Port:      "8080",
+		Instances: map[string]*registry.ServiceInstance{"n1": {Host: "n1", Address: "10.0.0.1", Port: "8080"}},
+		Resources: map[string]string{"instance_group/us-east1-b": "us-east1-b-web"},
+		CreatedAt: createdAt,
+		UpdatedAt: createdAt,
+	}
+	api := &ServiceRecord{Service: "api", Port: "9090", CreatedAt: createdAt, UpdatedAt: createdAt}
+	for _, record := range []*ServiceRecord{web, api} {
+		if err := s.Put(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("api"); err != nil {
+		t.Fatal(err)
+	}
+	// deleting unknown services is a no-op
+	if err := s.Delete("unknown"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 1 {
+		t.Fatalf("expected 1 service, got %d", s.Len())
+	}
+	record, ok := s.Get("web")
+	if !ok || !reflect.DeepEqual(record, web) {
+		t.Fatalf("expected %+v, got %+v", web, record)
+	}
+	if _, ok := s.Get("api"); ok {
+		t.Fatal("expected deleted service to stay deleted")
+	}
+}
+
+func TestProvisioningsSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &gce.Provisioning{Steps: map[string]string{"health_check": "v1", "backend_service": ""}}
+	if err := s.PutProvisioning("web", p); err != nil {
+		t.Fatal(err)
+	}
+	// stored provisionings are copies
+	p.Steps["backend_service"] = "v1"
+	if err := s.PutProvisioning("api", &gce.Provisioning{Steps: map[string]string{}, Created: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteProvisioning("api"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &gce.Provisioning{Steps: map[string]string{"health_check": "v1", "backend_service": ""}}
+	if actual, ok := s.GetProvisioning("web"); !ok || !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, actual)
+	}
+	if _, ok := s.GetProvisioning("api"); ok {
+		t.Fatal("expected deleted provisioning to stay deleted")
+	}
+}
+
+func TestSaveReplacesSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []string{"8080", "9090"} {
+		if err := s.Put(&ServiceRecord{Service: "web", Port: port}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// temporary files are renamed over the snapshot, none are left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "state.json" {
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		t.Fatalf("expected only state.json, got %v", names)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, ok := s.Get("web"); !ok || record.Port != "9090" {
+		t.Fatalf("expected latest record, got %+v", record)
+	}
+}
+
+func TestSaveFails(t *testing.T) {
+	// directory is gone, so the temporary file can't be created
+	s, err := Open(filepath.Join(t.TempDir(), "missing", "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(&ServiceRecord{Service: "web"}); err == nil {
+		t.Fatal("expected save to fail")
+	}
+}